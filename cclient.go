@@ -0,0 +1,566 @@
+package p9p
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Client offers an os-like API to the files served over a Session, on top
+// of CFileSys, so that 9p slots into code written for the os package.
+//
+// Paths are slash separated and relative to the attach point. A leading
+// slash is ignored. Errors are reported as *fs.PathError, or *os.LinkError
+// for Rename, so that errors.Is works with fs.ErrNotExist and the like.
+//
+// All requests are made with the context given to NewClient. A Client is
+// safe for concurrent use.
+type Client struct {
+	ctx  context.Context
+	root Dirent
+}
+
+// NewClient attaches to aname as uname over session.
+func NewClient(ctx context.Context, session Session, uname, aname string) (*Client, error) {
+	root, err := CFileSys(session).Attach(ctx, uname, aname, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{ctx: ctx, root: root}, nil
+}
+
+// NewDirentClient returns a Client for the files below root, typically
+// obtained from CFileSys. Closing the Client clunks root.
+func NewDirentClient(ctx context.Context, root Dirent) *Client {
+	return &Client{ctx: ctx, root: root}
+}
+
+// Close clunks the attach point. The session is left open.
+func (c *Client) Close() error {
+	return c.root.Clunk(c.ctx)
+}
+
+// steps splits name into the names to walk from the attach point.
+func steps(name string) ([]string, error) {
+	names, bsp := NormalizePath(strings.Split(name, "/"))
+	if bsp < 0 {
+		return nil, fs.ErrInvalid
+	}
+	return names, nil
+}
+
+// walk returns a new Dirent for name.
+func (c *Client) walk(names []string) (Dirent, error) {
+	_, ent, err := c.root.Walk(c.ctx, names...)
+	return ent, err
+}
+
+// walkParent returns a new Dirent for the directory holding name, and the
+// last element of name.
+func (c *Client) walkParent(name string) (Dirent, string, error) {
+	names, err := steps(name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	n := len(names)
+	if n == 0 || names[n-1] == ".." {
+		return nil, "", fs.ErrInvalid
+	}
+
+	dir, err := c.walk(names[:n-1])
+	if err != nil {
+		return nil, "", err
+	}
+	return dir, names[n-1], nil
+}
+
+// Open opens the named file for reading.
+func (c *Client) Open(name string) (*CFile, error) {
+	return c.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates the named file, opened for reading and
+// writing.
+func (c *Client) Create(name string) (*CFile, error) {
+	return c.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// OpenFile opens the named file with the flags of os.OpenFile. With
+// O_CREATE, a missing file is created with perm.
+func (c *Client) OpenFile(name string, flag int, perm fs.FileMode) (*CFile, error) {
+	var mode Flag
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		mode = OREAD
+	case os.O_WRONLY:
+		mode = OWRITE
+	default:
+		mode = ORDWR
+	}
+	if flag&os.O_TRUNC != 0 {
+		mode |= OTRUNC
+	}
+
+	names, err := steps(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	ent, err := c.walk(names)
+	if err == nil {
+		if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+			ent.Clunk(c.ctx)
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+		}
+
+		if IsDir(ent) && mode == OREAD {
+			next, err := ent.OpenDir(c.ctx)
+			if err != nil {
+				ent.Clunk(c.ctx)
+				return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+			}
+			return &CFile{name: name, ctx: c.ctx, ent: ent, dir: next}, nil
+		}
+
+		file, err := ent.Open(c.ctx, mode)
+		if err != nil {
+			ent.Clunk(c.ctx)
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return c.newFile(name, ent, file, flag), nil
+	}
+
+	if flag&os.O_CREATE == 0 || !errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	dir, base, err := c.walkParent(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	// The fid of dir now refers to the new file.
+	ent, file, err := dir.Create(c.ctx, base, dirMode(perm), mode)
+	if err != nil {
+		dir.Clunk(c.ctx)
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return c.newFile(name, ent, file, flag), nil
+}
+
+// Stat returns a FileInfo for the named file. Its Sys method returns the
+// Dir.
+func (c *Client) Stat(name string) (fs.FileInfo, error) {
+	names, err := steps(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	ent, err := c.walk(names)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	defer ent.Clunk(c.ctx)
+
+	dir, err := ent.Stat(c.ctx)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return dirInfo{dir}, nil
+}
+
+// Remove removes the named file or empty directory.
+func (c *Client) Remove(name string) error {
+	names, err := steps(name)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+
+	ent, err := c.walk(names)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+
+	if err := ent.Remove(c.ctx); err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
+
+// Rename renames oldpath to newpath. As 9p renames through Twstat, both
+// must be in the same directory, otherwise ErrNotsupported is returned.
+func (c *Client) Rename(oldpath, newpath string) error {
+	oldnames, err := steps(oldpath)
+	if err == nil {
+		var newnames []string
+		newnames, err = steps(newpath)
+		if err == nil && (len(oldnames) == 0 || len(newnames) != len(oldnames) ||
+			path.Join(oldnames[:len(oldnames)-1]...) != path.Join(newnames[:len(newnames)-1]...)) {
+			err = ErrNotsupported
+		}
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+
+	ent, err := c.walk(oldnames)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	defer ent.Clunk(c.ctx)
+
+	dir := nullDir()
+	dir.Name = path.Base(newpath)
+	if err := ent.WStat(c.ctx, dir); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	return nil
+}
+
+// Mkdir creates the named directory with perm.
+func (c *Client) Mkdir(name string, perm fs.FileMode) error {
+	dir, base, err := c.walkParent(name)
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+
+	// The fid of dir now refers to the new directory.
+	ent, _, err := dir.Create(c.ctx, base, dirMode(perm)|DMDIR, OREAD)
+	if err != nil {
+		dir.Clunk(c.ctx)
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return ent.Clunk(c.ctx)
+}
+
+// MkdirAll creates the named directory along with any missing parents.
+// Nothing is done if the directory exists.
+func (c *Client) MkdirAll(name string, perm fs.FileMode) error {
+	names, err := steps(name)
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+
+	for i := range names {
+		p := path.Join(names[:i+1]...)
+		info, err := c.Stat(p)
+		if err == nil {
+			if !info.IsDir() {
+				return &fs.PathError{Op: "mkdir", Path: p, Err: syscall.ENOTDIR}
+			}
+			continue
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err := c.Mkdir(p, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadDir reads the named directory, returning its entries sorted by name.
+func (c *Client) ReadDir(name string) ([]fs.DirEntry, error) {
+	names, err := steps(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	f, err := c.Open(path.Join(names...))
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.Unwrap(err)}
+	}
+	defer f.Close()
+
+	entries, err := f.ReadDir(-1)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.Unwrap(err)}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+// ReadFile returns the contents of the named file.
+func (c *Client) ReadFile(name string) ([]byte, error) {
+	f, err := c.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	size := 512
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		size = int(info.Size())
+	}
+
+	data := make([]byte, 0, size)
+	for {
+		if len(data) == cap(data) {
+			data = append(data, 0)[:len(data)]
+		}
+
+		n, err := f.Read(data[len(data):cap(data)])
+		data = data[:len(data)+n]
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			return data, err
+		}
+	}
+}
+
+// WriteFile writes data to the named file, creating it with perm if
+// needed, and truncating it otherwise.
+func (c *Client) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	f, err := c.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// CFile is a file opened by a Client. It implements io.Reader, io.Writer,
+// io.Seeker, io.ReaderAt, io.WriterAt and io.Closer. Large reads and writes
+// are pipelined, see PipelinedFile.
+//
+// Directories opened for reading implement fs.ReadDirFile instead, and
+// fail other reads and writes with EISDIR.
+type CFile struct {
+	name   string
+	ctx    context.Context
+	ent    Dirent
+	pf     *PipelinedFile // nil for directories
+	dir    ReadNext       // only for directories
+	append bool
+
+	mu      sync.Mutex // protects the fields below
+	offset  int64
+	closed  bool
+	dirs    []Dir // read from dir, not yet returned by ReadDir
+	dirDone bool
+}
+
+func (c *Client) newFile(name string, ent Dirent, file File, flag int) *CFile {
+	return &CFile{
+		name:   name,
+		ctx:    c.ctx,
+		ent:    ent,
+		pf:     NewPipelinedFile(c.ctx, file, 0),
+		append: flag&os.O_APPEND != 0,
+	}
+}
+
+// wrap reports err as a PathError, except for io.EOF.
+func (f *CFile) wrap(op string, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	return &fs.PathError{Op: op, Path: f.name, Err: err}
+}
+
+func (f *CFile) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+// Name returns the name given to Open.
+func (f *CFile) Name() string {
+	return f.name
+}
+
+func (f *CFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, f.wrap("read", fs.ErrClosed)
+	}
+	if f.pf == nil {
+		return 0, f.wrap("read", syscall.EISDIR)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	n, err := f.pf.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, f.wrap("read", err)
+}
+
+func (f *CFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, f.wrap("write", fs.ErrClosed)
+	}
+	if f.pf == nil {
+		return 0, f.wrap("write", syscall.EISDIR)
+	}
+
+	if f.append {
+		dir, err := f.ent.Stat(f.ctx)
+		if err != nil {
+			return 0, f.wrap("write", err)
+		}
+		f.offset = int64(dir.Length)
+	}
+
+	n, err := f.pf.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, f.wrap("write", err)
+}
+
+// Seek sets the offset of the next Read or Write. Seeking relative to the
+// end takes a Tstat.
+func (f *CFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, f.wrap("seek", fs.ErrClosed)
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		dir, err := f.ent.Stat(f.ctx)
+		if err != nil {
+			return 0, f.wrap("seek", err)
+		}
+		offset += int64(dir.Length)
+	default:
+		return 0, f.wrap("seek", fs.ErrInvalid)
+	}
+
+	if offset < 0 {
+		return 0, f.wrap("seek", fs.ErrInvalid)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *CFile) ReadAt(p []byte, offset int64) (int, error) {
+	if f.isClosed() {
+		return 0, f.wrap("readat", fs.ErrClosed)
+	}
+	if f.pf == nil {
+		return 0, f.wrap("readat", syscall.EISDIR)
+	}
+	if offset < 0 {
+		return 0, f.wrap("readat", fs.ErrInvalid)
+	}
+
+	n, err := f.pf.ReadAt(p, offset)
+	return n, f.wrap("readat", err)
+}
+
+// WriteAt fails on files opened with O_APPEND, as with os.File.
+func (f *CFile) WriteAt(p []byte, offset int64) (int, error) {
+	if f.isClosed() {
+		return 0, f.wrap("writeat", fs.ErrClosed)
+	}
+	if f.pf == nil {
+		return 0, f.wrap("writeat", syscall.EISDIR)
+	}
+	if f.append {
+		return 0, f.wrap("writeat", errors.New("invalid use of WriteAt on file opened with O_APPEND"))
+	}
+	if offset < 0 {
+		return 0, f.wrap("writeat", fs.ErrInvalid)
+	}
+
+	n, err := f.pf.WriteAt(p, offset)
+	return n, f.wrap("writeat", err)
+}
+
+// ReadDir reads the entries of a directory, in the order of the server,
+// following fs.ReadDirFile: with n > 0, it returns at most n entries, and
+// io.EOF at the end of the directory. Otherwise, it returns all the
+// remaining entries.
+func (f *CFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil, f.wrap("readdir", fs.ErrClosed)
+	}
+	if f.dir == nil {
+		return nil, f.wrap("readdir", syscall.ENOTDIR)
+	}
+
+	for !f.dirDone && (n <= 0 || len(f.dirs) < n) {
+		next, err := f.dir(f.ctx)
+		if err != nil {
+			return nil, f.wrap("readdir", err)
+		}
+		if len(next) == 0 {
+			f.dirDone = true
+		}
+		f.dirs = append(f.dirs, next...)
+	}
+
+	k := len(f.dirs)
+	if n > 0 && k > n {
+		k = n
+	}
+	if n > 0 && k == 0 {
+		return nil, io.EOF
+	}
+
+	entries := make([]fs.DirEntry, k)
+	for i, d := range f.dirs[:k] {
+		entries[i] = fs.FileInfoToDirEntry(dirInfo{d})
+	}
+	f.dirs = f.dirs[k:]
+	return entries, nil
+}
+
+// Stat returns a FileInfo for the file. Its Sys method returns the Dir.
+func (f *CFile) Stat() (fs.FileInfo, error) {
+	if f.isClosed() {
+		return nil, f.wrap("stat", fs.ErrClosed)
+	}
+	dir, err := f.ent.Stat(f.ctx)
+	if err != nil {
+		return nil, f.wrap("stat", err)
+	}
+	return dirInfo{dir}, nil
+}
+
+// Close clunks the file.
+func (f *CFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return f.wrap("close", fs.ErrClosed)
+	}
+	f.closed = true
+
+	return f.wrap("close", f.ent.Clunk(f.ctx))
+}
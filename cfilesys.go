@@ -1,48 +1,117 @@
 package p9p
 
 import (
-	"bytes"
 	"context"
-	"io"
+	"errors"
+	"fmt"
+	"io/fs"
 	"strings"
+	"sync"
 )
 
 // State of a filesystem as seen from the client side.
 type fsState struct {
 	session Session
-	//fids	map[*cEnt]Fid
-	nextfid Fid  // newFid increments, then returns
+	fids    fidPool
 	root    cEnt // what holds the rootfid
 }
 
 func CFileSys(session Session) FileSys {
-	return &fsState{session: session, nextfid: Fid(0)}
+	return &fsState{session: session}
+}
+
+// fidPool allocates the fids of a client. Fids are handed out in increasing
+// order, starting from 1, and recycled once released. NOFID is never handed
+// out. It is safe for concurrent use.
+type fidPool struct {
+	mu   sync.Mutex
+	last Fid              // the highest fid handed out so far
+	free []Fid            // released fids, reused first
+	used map[Fid]struct{} // fids handed out and not yet released
+}
+
+// get returns an unused fid, or ErrNofids when all of them are in use.
+func (p *fidPool) get() (Fid, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.used == nil {
+		p.used = make(map[Fid]struct{})
+	}
+
+	var fid Fid
+	if n := len(p.free); n > 0 {
+		fid = p.free[n-1]
+		p.free = p.free[:n-1]
+	} else {
+		if p.last+1 == NOFID {
+			return NOFID, ErrNofids
+		}
+		p.last++
+		fid = p.last
+	}
+
+	p.used[fid] = struct{}{}
+	return fid, nil
+}
+
+// put releases fid for reuse. Releasing a fid that is not in use, such as
+// NOFID or a fid released already, does nothing.
+func (p *fidPool) put(fid Fid) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.used[fid]; !ok {
+		return
+	}
+	delete(p.used, fid)
+	p.free = append(p.free, fid)
+}
+
+// putAfter releases fid after the call meant to make it failed with err.
+// A call abandoned by its context may yet succeed on the server, which is
+// then told to clunk the fid, see fcallRequest. Until it does, the fid may
+// not be reused, so it is dropped instead.
+func (p *fidPool) putAfter(fid Fid, err error) {
+	if !errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded) {
+		p.put(fid)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.used, fid)
 }
 
 // AuthFile interface
 type aFile struct {
-	session Session
+	fs      *fsState
 	afid    Fid
+	success bool // set by the client side of an auth protocol
 }
 
-var noAuth aFile = aFile{session: nil, afid: NOFID}
-
-// Cannot be programmatically determined from the client side.
-func (af aFile) Success() bool {
-	return false
+// Cannot be programmatically determined from the client side,
+// unless the protocol was run by HMACAuthenticate.
+func (af *aFile) Success() bool {
+	return af.success
 }
-func (af aFile) Close(ctx context.Context) error {
-	return nil
+
+// Close clunks the afid.
+func (af *aFile) Close(ctx context.Context) error {
+	err := af.fs.session.Clunk(ctx, af.afid)
+	af.fs.fids.put(af.afid)
+	return err
 }
-func (af aFile) Read(ctx context.Context, p []byte, offset int64) (int, error) {
-	return af.session.Read(ctx, af.afid, p, offset)
+func (af *aFile) Read(ctx context.Context, p []byte, offset int64) (int, error) {
+	return af.fs.session.Read(ctx, af.afid, p, offset)
 }
-func (af aFile) Write(ctx context.Context, p []byte, offset int64) (int, error) {
-	return af.session.Write(ctx, af.afid, p, offset)
+func (af *aFile) Write(ctx context.Context, p []byte, offset int64) (int, error) {
+	return af.fs.session.Write(ctx, af.afid, p, offset)
 }
-func (af aFile) IOUnit() int {
-	msize, _ := af.session.Version()
-	return msize - 11
+func (af *aFile) IOUnit() int {
+	msize, _ := af.fs.session.Version()
+	return msize - rreadHeader
 }
 
 // Cannot be programmatically determined from the client side.
@@ -54,12 +123,16 @@ func (fs *fsState) RequireAuth(ctx context.Context) bool {
 }
 func (fs *fsState) Auth(ctx context.Context, uname, aname string,
 ) (AuthFile, error) {
-	aFid := fs.newFid()
-	_, err := fs.session.Auth(ctx, aFid, uname, aname)
+	aFid, err := fs.fids.get()
 	if err != nil {
-		return noAuth, err
+		return nil, err
 	}
-	return aFile{session: fs.session, afid: aFid}, nil
+	_, err = fs.session.Auth(ctx, aFid, uname, aname)
+	if err != nil {
+		fs.fids.putAfter(aFid, err)
+		return nil, err
+	}
+	return &aFile{fs: fs, afid: aFid}, nil
 }
 
 // Initializes a session by sending an Attach,
@@ -67,21 +140,24 @@ func (fs *fsState) Auth(ctx context.Context, uname, aname string,
 // Does no cleanup (assumes no old state).
 func (fs *fsState) Attach(ctx context.Context, uname, aname string,
 	af AuthFile) (Dirent, error) {
-	rootFid := fs.newFid()
-
 	var aFid Fid
 	if af == nil {
 		aFid = NOFID
 	} else {
-		af1, ok := af.(aFile)
+		af1, ok := af.(*aFile)
 		if !ok {
 			return noEnt, ErrUnknownfid
 		}
 		aFid = af1.afid
 	}
 
+	rootFid, err := fs.fids.get()
+	if err != nil {
+		return noEnt, err
+	}
 	qid, err := fs.session.Attach(ctx, rootFid, aFid, uname, aname)
 	if err != nil {
+		fs.fids.putAfter(rootFid, err)
 		return noEnt, err
 	}
 
@@ -94,11 +170,6 @@ func (fs *fsState) Attach(ctx context.Context, uname, aname string,
 	}, nil
 }
 
-func (fs *fsState) newFid() Fid {
-	fs.nextfid++
-	return fs.nextfid
-}
-
 type Warning struct {
 	s string
 }
@@ -107,6 +178,50 @@ func (w Warning) Error() string {
 	return w.s
 }
 
+// WalkError is returned by the Walk of a client Dirent that stops short of
+// its destination. Names holds the normalized names walked, and Qids the
+// Qids of those walked successfully, so Names[Index()] is the failing name.
+// Err is the error reported for it, if any: servers only report an error
+// when the first name of a Twalk fails.
+type WalkError struct {
+	Names []string
+	Qids  []Qid
+	Err   error
+}
+
+func (e *WalkError) Error() string {
+	msg := fmt.Sprintf("p9p: walk failed at %q, element %d of %s",
+		e.Name(), e.Index()+1, strings.Join(e.Names, "/"))
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Index returns the position in Names of the element that failed.
+func (e *WalkError) Index() int {
+	return len(e.Qids)
+}
+
+// Name returns the element that failed, if any.
+func (e *WalkError) Name() string {
+	if e.Index() < len(e.Names) {
+		return e.Names[e.Index()]
+	}
+	return ""
+}
+
+// Unwrap returns Err.
+func (e *WalkError) Unwrap() error {
+	return e.Err
+}
+
+// Is lets errors.Is match a WalkError without Err with fs.ErrNotExist.
+// Otherwise, Err is matched.
+func (e *WalkError) Is(target error) bool {
+	return e.Err == nil && target == fs.ErrNotExist
+}
+
 type cEnt struct {
 	//path []string // absolute path
 	fid Fid
@@ -119,28 +234,43 @@ var noEnt cEnt = cEnt{NOFID, Qid{}, nil}
 type fileRef struct {
 	cEnt
 	iounit int
+	wunit  int // data in a Twrite, see writeUnit
 }
 
-var noFile fileRef = fileRef{noEnt, 0}
+var noFile fileRef = fileRef{noEnt, 0, 0}
+
+// Sizes of the headers of Rread and Twrite. Without an iounit from the
+// server, they are what msize leaves for the data.
+const (
+	rreadHeader  = 11 // size[4] type[1] tag[2] count[4]
+	twriteHeader = 23 // size[4] type[1] tag[2] fid[4] offset[8] count[4]
+)
+
+// newFileRef returns a File for ent, opened with iounit.
+func newFileRef(ent cEnt, iounit uint32) fileRef {
+	if iounit > 0 {
+		return fileRef{ent, int(iounit), int(iounit)}
+	}
+	msize, _ := ent.fs.session.Version()
+	return fileRef{ent, msize - rreadHeader, msize - twriteHeader}
+}
 
 // New entry has no path set yet!
-func (fs *fsState) newEnt() cEnt {
+func (fs *fsState) newEnt() (cEnt, error) {
+	fid, err := fs.fids.get()
+	if err != nil {
+		return noEnt, err
+	}
 	return cEnt{
-		fid: fs.newFid(),
+		fid: fid,
 		fs:  fs,
-	}
+	}, nil
 }
 
 // Note: This always returns returns a file with a nonzero IOUnit.
 func (ent cEnt) Open(ctx context.Context, mode Flag) (File, error) {
 	_, iounit, err := ent.fs.session.Open(ctx, ent.fid, mode)
-	iou := int(iounit)
-	if iounit < 1 {
-		msize, _ := ent.fs.session.Version()
-		// size of message max minus fcall io header (Rread)
-		iou = msize - 11
-	}
-	return fileRef{ent, iou}, err
+	return newFileRef(ent, iounit), err
 }
 
 func (f fileRef) Read(ctx context.Context, p []byte, offset int64) (int, error) {
@@ -152,71 +282,28 @@ func (f fileRef) Write(ctx context.Context, p []byte, offset int64) (int, error)
 func (f fileRef) IOUnit() int {
 	return f.iounit
 }
+
+// writeUnit is less than IOUnit when the server gave no iounit, for the
+// header of Twrite is larger than that of Rread.
+func (f fileRef) writeUnit() int {
+	return f.wunit
+}
 func (f fileRef) Close(ctx context.Context) error {
 	return nil
 }
 
-type openDir struct {
-	fileRef
-	done  bool
-	nread int64
-	buf   []byte
-}
-
-// Note: This always returns returns a file with a nonzero IOUnit,
+// Note: This always reads with a nonzero IOUnit,
 // (because cEnt.Open does)
 func (ent cEnt) OpenDir(ctx context.Context) (ReadNext, error) {
 	file, err := ent.Open(ctx, OREAD)
 	if err != nil {
 		return nil, err
 	}
-	ref, ok := file.(fileRef)
-	if !ok {
-		return nil, MessageRerror{"Invalid return value from Open"}
-	}
-	dir := openDir{
-		ref,
-		false,
-		0,
-		make([]byte, file.IOUnit()),
-	}
-	return dir.Next, nil
-}
-
-func (dir *openDir) Next(ctx context.Context) ([]Dir, error) {
-	if dir.done {
-		return nil, nil
-	}
-	var n int
-	var err error
-
-	n, err = dir.Read(ctx, dir.buf, dir.nread)
+	dr, err := NewDirReader(ent.fs.session, ent.fid, file.IOUnit())
 	if err != nil {
-		if err == io.EOF {
-			dir.done = true
-			return nil, nil
-		}
 		return nil, err
 	}
-	dir.nread += int64(n)
-
-	rd := bytes.NewReader(dir.buf[:n])
-	codec := NewCodec() // TODO(stevvooe): Need way to resolve codec based on session.
-	ret := make([]Dir, 0, 10)
-	for {
-		var d Dir
-		if err = DecodeDir(codec, rd, &d); err != nil {
-			if err == io.EOF {
-				err = nil
-			}
-			break
-		}
-		ret = append(ret, d)
-	}
-	if len(ret) == 0 {
-		dir.done = true
-	}
-	return ret, err
+	return dr.ReadDirs, nil
 }
 
 func (ent cEnt) Qid() Qid {
@@ -226,7 +313,7 @@ func (ent cEnt) Qid() Qid {
 func (ent cEnt) Create(ctx context.Context, name string,
 	perm uint32, mode Flag) (Dirent, File, error) {
 	if len(name) == 0 || name == "." || name == ".." || strings.Contains(name, "/\\") {
-		return noEnt, noFile, MessageRerror{"Invalid filename"}
+		return noEnt, noFile, MessageRerror{Ename: "Invalid filename"}
 	}
 	if !IsDir(ent) {
 		return noEnt, noFile, ErrCreatenondir
@@ -238,14 +325,7 @@ func (ent cEnt) Create(ctx context.Context, name string,
 	//ent.path = append(ent.path, name)
 	ent.qid = qid
 
-	// TODO(frobnitzem): this appears twice, make a fileEnt function.
-	iou := int(iounit)
-	if iounit < 1 {
-		msize, _ := ent.fs.session.Version()
-		// size of message max minus fcall io header (Rread)
-		iou = msize - 11
-	}
-	return ent, fileRef{ent, iou}, err
+	return ent, newFileRef(ent, iounit), err
 }
 func (ent cEnt) Stat(ctx context.Context) (Dir, error) {
 	return ent.fs.session.Stat(ctx, ent.fid)
@@ -253,26 +333,36 @@ func (ent cEnt) Stat(ctx context.Context) (Dir, error) {
 func (ent cEnt) WStat(ctx context.Context, stat Dir) error {
 	return ent.fs.session.WStat(ctx, ent.fid, stat)
 }
+
+// Clunk and Remove release the fid, even on error, as in clunk(5) and
+// remove(5). The Dirent must not be used afterwards.
 func (ent cEnt) Clunk(ctx context.Context) error {
+	defer ent.fs.fids.put(ent.fid)
 	return ent.fs.session.Clunk(ctx, ent.fid)
 }
 func (ent cEnt) Remove(ctx context.Context) error {
+	defer ent.fs.fids.put(ent.fid)
 	return ent.fs.session.Remove(ctx, ent.fid)
 }
 func (ent cEnt) Walk(ctx context.Context,
 	names ...string) ([]Qid, Dirent, error) {
 	steps, bsp := NormalizePath(names)
 	if bsp < 0 { //|| bsp > len(ent.path) {
-		return nil, ent, MessageRerror{"invalid path: " + strings.Join(names, "/")}
+		return nil, ent, MessageRerror{Ename: "invalid path: " + strings.Join(names, "/")}
 	}
 
-	next := ent.fs.newEnt()
-	qids, err := ent.fs.session.Walk(ctx, ent.fid, next.fid, steps...)
+	next, err := ent.fs.newEnt()
 	if err != nil {
 		return nil, noEnt, err
 	}
-	if len(qids) != len(names) { // incomplete = failure to get new ent
-		return qids, noEnt, Warning{"Incomplete walk result"}
+	// Long paths take several Twalks, see walkChained.
+	qids, err := walkChained(ctx, ent.fs.session, ent.fid, next.fid, steps)
+	if err != nil || len(qids) != len(steps) { // incomplete = failure to get new ent
+		ent.fs.fids.putAfter(next.fid, err)
+		if len(steps) == 0 { // a clone, which has no element to fail
+			return nil, noEnt, err
+		}
+		return qids, noEnt, &WalkError{Names: steps, Qids: qids, Err: err}
 	}
 	// drop part of ent.path
 	//steps = steps[:len(qids)]
@@ -117,6 +117,13 @@ func (ch *channel) SetMSize(msize int) {
 	ch.rdbuf = make([]byte, msize)
 }
 
+// SetCodec replaces the codec used to read and write messages, as required
+// when a protocol version has been negotiated. This must never be called
+// concurrently with ReadFcall or WriteFcall.
+func (ch *channel) SetCodec(codec Codec) {
+	ch.codec = codec
+}
+
 // ReadFcall reads the next message from the channel into fcall.
 //
 // If the incoming message overflows the msize, Overflow(err) will return
@@ -1,8 +1,10 @@
 package p9p
 
 import (
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/context"
+	"io"
 	"net"
 	"sync"
 	"testing"
@@ -258,3 +260,524 @@ func TestClient(t *testing.T) {
 	}()
 	wg.Wait()
 }
+
+/** Cancel a call and check that the client flushes it, and does not reuse
+ *  its tag before the server has answered the flush.
+ */
+func TestClientFlush(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reqC, repC := net.Pipe()
+	srv := NewChannel(repC, 1024)
+
+	// srv is not safe for concurrent use, so wait for the version
+	// exchange to finish before using it again.
+	versioned := make(chan struct{})
+	go func() {
+		defer close(versioned)
+		inp := new(Fcall)
+		assert.Nil(srv.ReadFcall(ctx, inp))
+		assert.Nil(srv.WriteFcall(ctx, newFcall(inp.Tag, MessageRversion{
+			Version: "9P2000",
+			MSize:   1024,
+		})))
+	}()
+
+	session, err := CSession(ctx, reqC)
+	assert.Nil(err)
+	<-versioned
+
+	// The read is left unanswered until the caller gives up.
+	rctx, rcancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() {
+		_, err := session.Read(rctx, Fid(1), make([]byte, 10), 0)
+		done <- err
+	}()
+
+	tread := new(Fcall)
+	assert.Nil(srv.ReadFcall(ctx, tread))
+	_, ok := tread.Message.(MessageTread)
+	assert.True(ok)
+
+	rcancel()
+	assert.Equal(context.Canceled, <-done)
+
+	tflush := new(Fcall)
+	assert.Nil(srv.ReadFcall(ctx, tflush))
+	flush, ok := tflush.Message.(MessageTflush)
+	assert.True(ok)
+	assert.Equal(tread.Tag, flush.Oldtag)
+
+	// A new call while the flush is pending must use another tag.
+	go func() {
+		_, err := session.Stat(ctx, Fid(1))
+		done <- err
+	}()
+	tstat := new(Fcall)
+	assert.Nil(srv.ReadFcall(ctx, tstat))
+	assert.NotEqual(tread.Tag, tstat.Tag)
+	assert.NotEqual(tflush.Tag, tstat.Tag)
+
+	// The late Rread is discarded, then the flush completes.
+	assert.Nil(srv.WriteFcall(ctx, newFcall(tread.Tag, MessageRread{Data: []byte("late")})))
+	assert.Nil(srv.WriteFcall(ctx, newFcall(tflush.Tag, MessageRflush{})))
+	assert.Nil(srv.WriteFcall(ctx, newFcall(tstat.Tag, MessageRstat{})))
+	assert.Nil(<-done)
+
+	// The connection is still usable.
+	go func() {
+		_, err := session.Read(ctx, Fid(1), make([]byte, 10), 0)
+		done <- err
+	}()
+	tread2 := new(Fcall)
+	assert.Nil(srv.ReadFcall(ctx, tread2))
+	assert.Nil(srv.WriteFcall(ctx, newFcall(tread2.Tag, MessageRread{Data: []byte("ok")})))
+	assert.Nil(<-done)
+}
+
+/** A walk that succeeds on the server after its caller gave up leaves no
+ *  fid behind, and its fid is not handed out again meanwhile.
+ */
+func TestClientFlushedWalk(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reqC, repC := net.Pipe()
+	srv := NewChannel(repC, 1024)
+
+	versioned := make(chan struct{})
+	go func() {
+		defer close(versioned)
+		inp := new(Fcall)
+		assert.Nil(srv.ReadFcall(ctx, inp))
+		assert.Nil(srv.WriteFcall(ctx, newFcall(inp.Tag, MessageRversion{
+			Version: "9P2000",
+			MSize:   1024,
+		})))
+		assert.Nil(srv.ReadFcall(ctx, inp))
+		assert.Nil(srv.WriteFcall(ctx, newFcall(inp.Tag, MessageRattach{})))
+	}()
+
+	session, err := CSession(ctx, reqC)
+	if !assert.Nil(err) {
+		return
+	}
+	root, err := CFileSys(session).Attach(ctx, "glenda", "", nil)
+	<-versioned
+	if !assert.Nil(err) {
+		return
+	}
+
+	wctx, wcancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() {
+		_, _, err := root.Walk(wctx, "a")
+		done <- err
+	}()
+	twalk := new(Fcall)
+	assert.Nil(srv.ReadFcall(ctx, twalk))
+	walk, ok := twalk.Message.(MessageTwalk)
+	assert.True(ok)
+
+	wcancel()
+	assert.True(errors.Is(<-done, context.Canceled))
+	tflush := new(Fcall)
+	assert.Nil(srv.ReadFcall(ctx, tflush))
+
+	// The walk succeeded after all: its newfid is clunked.
+	assert.Nil(srv.WriteFcall(ctx, newFcall(twalk.Tag,
+		MessageRwalk{Qids: []Qid{{Path: 1}}})))
+	tclunk := new(Fcall)
+	assert.Nil(srv.ReadFcall(ctx, tclunk))
+	assert.Equal(MessageTclunk{Fid: walk.Newfid}, tclunk.Message)
+	assert.Nil(srv.WriteFcall(ctx, newFcall(tclunk.Tag, MessageRclunk{})))
+	assert.Nil(srv.WriteFcall(ctx, newFcall(tflush.Tag, MessageRflush{})))
+
+	go func() {
+		_, _, err := root.Walk(ctx, "b")
+		done <- err
+	}()
+	assert.Nil(srv.ReadFcall(ctx, twalk))
+	assert.NotEqual(walk.Newfid, twalk.Message.(MessageTwalk).Newfid)
+	assert.Nil(srv.WriteFcall(ctx, newFcall(twalk.Tag,
+		MessageRwalk{Qids: []Qid{{Path: 2}}})))
+	assert.Nil(<-done)
+}
+
+/** Responses matching no request are reported, and dropped or fatal
+ *  depending on the handler.
+ */
+func TestClientTagErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	var tagErrors []*TagError
+	fatal := errors.New("fatal")
+
+	reqC, repC := net.Pipe()
+	srv := NewChannel(repC, 1024)
+
+	// srv is not safe for concurrent use, so wait for the version
+	// exchange to finish before using it again.
+	versioned := make(chan struct{})
+	go func() {
+		defer close(versioned)
+		inp := new(Fcall)
+		assert.Nil(srv.ReadFcall(ctx, inp))
+		assert.Nil(srv.WriteFcall(ctx, newFcall(inp.Tag, MessageRversion{
+			Version: "9P2000",
+			MSize:   1024,
+		})))
+	}()
+
+	session, err := CSession(ctx, reqC, WithTagErrorHandler(func(err *TagError) error {
+		mu.Lock()
+		defer mu.Unlock()
+		tagErrors = append(tagErrors, err)
+		if len(tagErrors) == 3 {
+			return fatal
+		}
+		return nil
+	}))
+	assert.Nil(err)
+	<-versioned
+
+	done := make(chan error)
+	go func() {
+		_, err := session.Stat(ctx, Fid(1))
+		done <- err
+	}()
+
+	tstat := new(Fcall)
+	assert.Nil(srv.ReadFcall(ctx, tstat))
+
+	// Unknown tag, then a duplicate: both are dropped.
+	assert.Nil(srv.WriteFcall(ctx, newFcall(tstat.Tag+1, MessageRclunk{})))
+	assert.Nil(srv.WriteFcall(ctx, newFcall(tstat.Tag, MessageRclunk{})))
+	assert.Nil(srv.WriteFcall(ctx, newFcall(tstat.Tag, MessageRstat{})))
+	assert.Nil(<-done)
+
+	mu.Lock()
+	if assert.Equal(2, len(tagErrors)) {
+		assert.True(errors.Is(tagErrors[0], ErrUnknownTag))
+		assert.Nil(tagErrors[0].Request)
+		assert.True(errors.Is(tagErrors[1], ErrDuptag))
+		assert.Equal(MessageTstat{Fid: 1}, tagErrors[1].Request)
+	}
+	mu.Unlock()
+
+	// The third one fails the connection.
+	go func() {
+		_, err := session.Stat(ctx, Fid(1))
+		done <- err
+	}()
+	assert.Nil(srv.ReadFcall(ctx, tstat))
+	assert.Nil(srv.WriteFcall(ctx, newFcall(tstat.Tag+1, MessageRclunk{})))
+	assert.Equal(fatal, <-done)
+
+	_, err = session.Stat(ctx, Fid(1))
+	assert.Equal(fatal, err)
+}
+
+func TestFidPool(t *testing.T) {
+	assert := assert.New(t)
+
+	var pool fidPool
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	seen := map[Fid]bool{}
+
+	// Concurrent allocations never hand out the same fid twice.
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				fid, err := pool.get()
+				assert.Nil(err)
+				mu.Lock()
+				assert.False(seen[fid], "fid %v handed out twice", fid)
+				seen[fid] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(800, len(seen))
+	assert.False(seen[NOFID])
+
+	// Released fids are reused, once.
+	pool.put(Fid(7))
+	pool.put(Fid(7))
+	pool.put(NOFID)
+	fid, err := pool.get()
+	assert.Nil(err)
+	assert.Equal(Fid(7), fid)
+	fid, err = pool.get()
+	assert.Nil(err)
+	assert.Equal(Fid(801), fid)
+
+	// NOFID is never reached.
+	pool.last = NOFID - 2
+	fid, err = pool.get()
+	assert.Nil(err)
+	assert.Equal(NOFID-1, fid)
+	_, err = pool.get()
+	assert.Equal(ErrNofids, err)
+	pool.put(fid)
+	fid, err = pool.get()
+	assert.Nil(err)
+	assert.Equal(NOFID-1, fid)
+}
+
+// chunkFile is an in-memory File that answers at most iounit bytes per
+// request, and half that much past the middle, to produce short replies.
+type chunkFile struct {
+	mu       sync.Mutex
+	data     []byte
+	iounit   int
+	inflight int
+	most     int // the most requests in flight at once
+}
+
+func (f *chunkFile) enter() int {
+	f.mu.Lock()
+	f.inflight++
+	if f.inflight > f.most {
+		f.most = f.inflight
+	}
+	f.mu.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inflight--
+	return len(f.data)
+}
+
+func (f *chunkFile) limit(n int, offset int64) int {
+	if n > f.iounit {
+		n = f.iounit
+	}
+	if offset > int64(len(f.data)/2) && n > 1 {
+		n /= 2
+	}
+	return n
+}
+
+func (f *chunkFile) Read(ctx context.Context, p []byte, offset int64) (int, error) {
+	size := f.enter()
+	if offset >= int64(size) {
+		return 0, io.EOF
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return copy(p[:f.limit(len(p), offset)], f.data[offset:]), nil
+}
+
+func (f *chunkFile) Write(ctx context.Context, p []byte, offset int64) (int, error) {
+	f.enter()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := f.limit(len(p), offset)
+	copy(f.data[offset:], p[:n])
+	if n < len(p) {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+func (f *chunkFile) IOUnit() int {
+	return f.iounit
+}
+
+func TestPipelinedFile(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	file := &chunkFile{data: make([]byte, len(data)), iounit: 64}
+	pf := NewPipelinedFile(ctx, file, 4)
+
+	n, err := pf.WriteAt(data, 0)
+	assert.Nil(err)
+	assert.Equal(len(data), n)
+	assert.Equal(data, file.data)
+	assert.Equal(4, file.most)
+
+	p := make([]byte, len(data))
+	n, err = pf.ReadAt(p, 0)
+	assert.Nil(err)
+	assert.Equal(len(data), n)
+	assert.Equal(data, p)
+
+	// Reading past the end returns what is there, with io.EOF.
+	n, err = pf.ReadAt(p, 900)
+	assert.Equal(io.EOF, err)
+	assert.Equal(100, n)
+	assert.Equal(data[900:], p[:n])
+
+	n, err = pf.ReadAt(p[:10], 1000)
+	assert.Equal(io.EOF, err)
+	assert.Equal(0, n)
+}
+
+// writeHandler opens files without an iounit, and counts the writes and
+// bytes it is sent.
+type writeHandler struct {
+	mu     sync.Mutex
+	writes int
+	bytes  int
+}
+
+func (h *writeHandler) Handle(ctx context.Context, msg Message) (Message, error) {
+	switch msg := msg.(type) {
+	case MessageTattach:
+		return MessageRattach{}, nil
+	case MessageTopen:
+		return MessageRopen{}, nil
+	case MessageTwrite:
+		h.mu.Lock()
+		h.writes++
+		h.bytes += len(msg.Data)
+		h.mu.Unlock()
+		return MessageRwrite{Count: uint32(len(msg.Data))}, nil
+	}
+	return nil, ErrNotsupported
+}
+
+func (h *writeHandler) Stop(err error) error { return err }
+
+// Without an iounit, write chunks fit in msize along with the header of
+// Twrite, so that none is truncated and written again.
+func TestPipelinedWriteUnit(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	h := &writeHandler{}
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	go ServeConn(ctx, sc, h)
+
+	session, err := CSession(ctx, cc)
+	if !assert.Nil(err) {
+		return
+	}
+	root, err := CFileSys(session).Attach(ctx, "glenda", "", nil)
+	if !assert.Nil(err) {
+		return
+	}
+	file, err := root.Open(ctx, OWRITE)
+	if !assert.Nil(err) {
+		return
+	}
+
+	msize, _ := session.Version()
+	data := make([]byte, 3*(msize-23))
+	n, err := NewPipelinedFile(ctx, file, 4).WriteAt(data, 0)
+	assert.Nil(err)
+	assert.Equal(len(data), n)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	assert.Equal(3, h.writes)
+	assert.Equal(len(data), h.bytes)
+}
+
+// A walk failing on the server is a WalkError, unless it had no element to
+// fail, as a clone.
+func TestWalkError(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	go ServeConn(ctx, sc, &writeHandler{})
+
+	session, err := CSession(ctx, cc)
+	if !assert.Nil(err) {
+		return
+	}
+	root, err := CFileSys(session).Attach(ctx, "glenda", "", nil)
+	if !assert.Nil(err) {
+		return
+	}
+
+	_, _, err = root.Walk(ctx)
+	assert.Equal(ErrNotsupported, err)
+	_, _, err = root.Walk(ctx, "a", "b")
+	var werr *WalkError
+	if assert.True(errors.As(err, &werr), "%v", err) {
+		assert.Equal(0, werr.Index())
+		assert.Equal("a", werr.Name())
+		assert.Equal(ErrNotsupported, werr.Err)
+	}
+
+	assert.Equal("", (&WalkError{}).Name())
+	assert.NotEmpty((&WalkError{Err: ErrNotsupported}).Error())
+}
+
+// unameHandler records the numeric uids of the auths and attaches it is
+// sent, over 9P2000.L.
+type unameHandler struct {
+	nunames chan uint32
+}
+
+func (h unameHandler) Handle(ctx context.Context, msg Message) (Message, error) {
+	switch msg := msg.(type) {
+	case MessageTauth:
+		h.nunames <- msg.Nuname
+		return MessageRauth{}, nil
+	case MessageTattach:
+		h.nunames <- msg.Nuname
+		return MessageRattach{}, nil
+	}
+	return nil, ErrNotsupported
+}
+
+func (h unameHandler) Stop(err error) error { return err }
+
+func (h unameHandler) Versions() VersionInfo {
+	return VersionInfo{Versions: []string{Version9P2000L}}
+}
+
+// The client does not claim any numeric uid, in particular not root's.
+func TestClientNuname(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	h := unameHandler{make(chan uint32, 2)}
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	go ServeConn(ctx, sc, h)
+
+	session, err := CSessionL(ctx, cc)
+	if !assert.Nil(err) {
+		return
+	}
+	_, err = session.Auth(ctx, 1, "glenda", "")
+	assert.Nil(err)
+	_, err = session.Attach(ctx, 0, 1, "glenda", "")
+	assert.Nil(err)
+	assert.Equal(NONUNAME, <-h.nunames)
+	assert.Equal(NONUNAME, <-h.nunames)
+}
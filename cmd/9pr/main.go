@@ -20,13 +20,19 @@ import (
 )
 
 var (
-	addr string
-	perf bool
+	addr      string
+	perf      bool
+	reconnect bool
+	user      string
+	secrets   string
 )
 
 func init() {
 	flag.StringVar(&addr, "addr", "localhost:5640", "addr of 9p service")
 	flag.BoolVar(&perf, "perf", false, "Run a performance profile server?")
+	flag.BoolVar(&reconnect, "reconnect", false, "Redial the server when the connection is lost?")
+	flag.StringVar(&user, "user", "anonymous", "user to attach as")
+	flag.StringVar(&secrets, "secrets", "", "authenticate with the secret of -user from this file (lines of user and secret)")
 }
 
 func main() {
@@ -41,6 +47,10 @@ func main() {
 	ctx := context.Background()
 	log.SetFlags(0)
 	flag.Parse()
+	if reconnect && secrets != "" {
+		// A reconnecting session re-attaches without an afid.
+		log.Fatalln("-secrets can not be used with -reconnect")
+	}
 
 	proto := "tcp"
 	if strings.HasPrefix(addr, "unix:") {
@@ -49,12 +59,22 @@ func main() {
 	}
 
 	log.Println("dialing", addr)
-	conn, err := net.Dial(proto, addr)
-	if err != nil {
-		log.Fatal(err)
+	var csession p9p.Session
+	var err error
+	if reconnect {
+		dial := func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, proto, addr)
+		}
+		csession, err = p9p.ReconnectingSession(ctx, dial)
+	} else {
+		var conn net.Conn
+		conn, err = net.Dial(proto, addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		csession, err = p9p.CSession(ctx, conn)
 	}
-
-	csession, err := p9p.CSession(ctx, conn)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -65,10 +85,28 @@ func main() {
 	log.Println("9p version", version, msize)
 
 	fs := p9p.CFileSys(csession)
-	root, err := fs.Attach(ctx, "anonymous", "/", nil)
+	var af p9p.AuthFile
+	if secrets != "" {
+		keys, err := p9p.ReadSecrets(secrets)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		secret, ok := keys[user]
+		if !ok {
+			log.Fatalln("no secret for", user, "in", secrets)
+		}
+		af, err = p9p.HMACAuthenticate(ctx, fs, user, "/", secret)
+		if err != nil {
+			log.Fatalln("error authenticating:", err)
+		}
+	}
+	root, err := fs.Attach(ctx, user, "/", af)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if af != nil {
+		af.Close(ctx)
+	}
 	// clone the pwd fid so we can clunk it
 	_, pwd, err := root.Walk(ctx)
 	if err != nil {
@@ -4,30 +4,42 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
-	"strings"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/frobnitzem/go-p9p"
-	"github.com/frobnitzem/go-p9p/ufs"
-	"github.com/frobnitzem/go-p9p/sleepfs"
 	"github.com/frobnitzem/go-p9p/ramfs"
+	"github.com/frobnitzem/go-p9p/sleepfs"
+	"github.com/frobnitzem/go-p9p/ufs"
 	"golang.org/x/net/context"
 )
 
 var (
-	root string
-	addr string
-	perf bool
-	debug bool
+	root     string
+	addr     string
+	perf     bool
+	metrics  bool
+	debug    bool
+	logLevel string
+	peercred string
+	secrets  string
 )
 
 func init() {
-	flag.StringVar(&root, "root", "/tmp", "root of filesystem to serve over 9p")
+	flag.StringVar(&root, "root", "/tmp", "root of filesystem to serve over 9p, or ramfs or sleepfs (also reachable as those anames)")
 	flag.StringVar(&addr, "addr", "localhost:5640", "bind addr for 9p server, prefix with unix: for unix socket")
 	flag.BoolVar(&perf, "perf", false, "Run a performance profile server?")
-	flag.BoolVar(&debug, "v", false, "Verbose debugging output.")
+	flag.BoolVar(&metrics, "metrics", false, "Serve Prometheus metrics on http://localhost:6060/metrics?")
+	flag.BoolVar(&debug, "v", false, "Verbose debugging output, same as -log debug.")
+	flag.StringVar(&logLevel, "log", "", "Log requests at this level: debug, info, warn or error.")
+	flag.StringVar(&secrets, "secrets", "", "Require clients to authenticate with the secrets in this file (lines of user and secret).")
+	flag.StringVar(&peercred, "peercred", "", "Authenticate unix socket clients by their uid, and reject or rewrite attaches as other users.")
 }
 
 func main() {
@@ -35,54 +47,99 @@ func main() {
 	log.SetFlags(0)
 	flag.Parse()
 
+	var mws []p9p.Middleware
+	if debug && logLevel == "" {
+		logLevel = "debug"
+	}
+	if logLevel != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+			log.Fatalln("bad -log level:", err)
+		}
+		logger := slog.New(slog.NewTextHandler(os.Stdout,
+			&slog.HandlerOptions{Level: level}))
+		mws = append(mws, p9p.Logging(logger, p9p.LogOptions{}))
+	}
+
+	switch peercred {
+	case "", "reject", "rewrite":
+	default:
+		log.Fatalln("bad -peercred mode:", peercred)
+	}
+
+	var keys p9p.Secrets
+	if secrets != "" {
+		var err error
+		if keys, err = p9p.ReadSecrets(secrets); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	var stats *p9p.Metrics
+	if metrics {
+		stats = p9p.NewMetrics()
+		mws = append(mws, stats.Middleware())
+		http.Handle("/metrics", stats)
+		fmt.Println("Serving metrics on http://localhost:6060/metrics")
+	}
 	if perf {
 		fmt.Println("Starting a pprof server on http://localhost:6060/debug/pprof")
 		fmt.Println("See https://pkg.go.dev/net/http/pprof for details.")
+	}
+	if perf || metrics {
 		go func() {
 			log.Println(http.ListenAndServe("localhost:6060", nil))
 		}()
 	}
 
 	fmt.Println("Serving ", root, " at ", addr)
-	proto := "tcp"
-	if strings.HasPrefix(addr, "unix:") {
-		proto = "unix"
-		addr = addr[5:]
-	}
-
-	listener, err := net.Listen(proto, addr)
-	if err != nil {
-		log.Fatalln("error listening:", err)
-	}
-	defer listener.Close()
-
-	for {
-		c, err := listener.Accept()
-		if err != nil {
-			log.Fatalln("error accepting:", err)
-			continue
-		}
-
-		go func(conn net.Conn) {
-			defer conn.Close()
-
-			ctx := context.WithValue(ctx, "conn", conn)
+	srv := &p9p.Server{
+		BaseContext: func(_ net.Listener) context.Context {
+			return ctx
+		},
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			// The address is also kept, see p9p.GetRemoteAddr.
 			log.Println("connected", conn.RemoteAddr())
-			var session p9p.Session
-			if root == "sleepfs" {
-				session = p9p.SFileSys(sleepfs.NewServer(ctx))
-			} else if root == "ramfs" {
-				session = p9p.SFileSys(ramfs.NewServer(ctx))
+			return ctx
+		},
+		NewHandler: func(ctx context.Context) (p9p.Handler, error) {
+			// Clients may also pick a tree by attaching to its aname.
+			mux := p9p.NewMux()
+			mux.Handle("sleepfs", sleepfs.NewServer(ctx))
+			mux.Handle("ramfs", ramfs.NewServer(ctx))
+			if root == "sleepfs" || root == "ramfs" {
+				mux.HandleDefault(mux.Route(root))
 			} else {
-				session = p9p.SFileSys(ufs.NewServer(ctx, root))
-			}
-			if debug {
-				session = p9p.NewLogger("", session)
+				mux.HandleDefault(ufs.NewServer(ctx, root))
 			}
 
-			if err := p9p.ServeConn(ctx, conn, p9p.SSession(session)); err != nil {
-				log.Printf("serving conn: %v", err)
+			var fsys p9p.FileSys = mux
+			if keys != nil {
+				fsys = p9p.HMACAuth(fsys, keys)
+			}
+			if peercred != "" {
+				fsys = p9p.PeerCredAuth(fsys, peercred == "rewrite")
 			}
-		}(c)
+
+			handler := p9p.SSession(p9p.SFileSys(fsys))
+			return p9p.Chain(handler, mws...), nil
+		},
+	}
+
+	// Drain the connections on an interrupt.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		log.Println("shutting down")
+		sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(sctx); err != nil {
+			srv.Close()
+		}
+	}()
+
+	if err := srv.ListenAndServe(addr); err != p9p.ErrServerClosed {
+		log.Fatalln("error serving:", err)
 	}
 }
@@ -2,13 +2,19 @@ package p9p
 
 import (
 	"context"
+	"net"
 	"time"
 )
 
 type contextKey string
 
 const (
-	versionKey contextKey = "9p.version"
+	versionKey    contextKey = "9p.version"
+	msizeKey      contextKey = "9p.msize"
+	remoteAddrKey contextKey = "9p.remoteaddr"
+	identityKey   contextKey = "9p.identity"
+	requestKey    contextKey = "9p.request"
+	peerCredKey   contextKey = "9p.peercred"
 )
 
 func withVersion(ctx context.Context, version string) context.Context {
@@ -26,6 +32,100 @@ func GetVersion(ctx context.Context) string {
 	return v
 }
 
+func withMSize(ctx context.Context, msize int) context.Context {
+	return context.WithValue(ctx, msizeKey, msize)
+}
+
+// GetMSize returns the negotiated message size from the context, or zero if
+// it is not known.
+func GetMSize(ctx context.Context) int {
+	v, ok := ctx.Value(msizeKey).(int)
+	if !ok {
+		return 0
+	}
+	return v
+}
+
+func withRemoteAddr(ctx context.Context, addr net.Addr) context.Context {
+	return context.WithValue(ctx, remoteAddrKey, addr)
+}
+
+// GetRemoteAddr returns the address of the client from the context, or nil
+// if it is not known. ServeConn sets it for every request.
+func GetRemoteAddr(ctx context.Context) net.Addr {
+	v, ok := ctx.Value(remoteAddrKey).(net.Addr)
+	if !ok {
+		return nil
+	}
+	return v
+}
+
+func withPeerCred(ctx context.Context, cred PeerCred) context.Context {
+	return context.WithValue(ctx, peerCredKey, cred)
+}
+
+// GetPeerCred returns the credentials of the client from the context. They
+// are only known when ServeConn serves a *net.UnixConn, on systems
+// supporting SO_PEERCRED.
+func GetPeerCred(ctx context.Context) (PeerCred, bool) {
+	v, ok := ctx.Value(peerCredKey).(PeerCred)
+	return v, ok
+}
+
+// identity is the user and aname a fid was attached with.
+type identity struct {
+	uname, aname string
+}
+
+func withIdentity(ctx context.Context, uname, aname string) context.Context {
+	return context.WithValue(ctx, identityKey, identity{uname, aname})
+}
+
+// GetUser returns the uname given when attaching the fid of the request, or
+// an empty string if it is not known. SFileSys sets it for every call on a
+// FileSys, Dirent or File.
+func GetUser(ctx context.Context) string {
+	v, _ := ctx.Value(identityKey).(identity)
+	return v.uname
+}
+
+// GetAname returns the aname given when attaching the fid of the request,
+// or an empty string if it is not known. It is set along with GetUser.
+func GetAname(ctx context.Context) string {
+	v, _ := ctx.Value(identityKey).(identity)
+	return v.aname
+}
+
+// request identifies the request a context was made for.
+type request struct {
+	tag Tag
+	fid Fid
+}
+
+func withRequest(ctx context.Context, tag Tag, fid Fid) context.Context {
+	return context.WithValue(ctx, requestKey, request{tag, fid})
+}
+
+// GetFid returns the fid the request operates on, or NOFID if it is not
+// known or the request has none. ServeConn sets it for every request, along
+// with the tag.
+func GetFid(ctx context.Context) Fid {
+	v, ok := ctx.Value(requestKey).(request)
+	if !ok {
+		return NOFID
+	}
+	return v.fid
+}
+
+// GetTag returns the tag of the request, or NOTAG if it is not known.
+func GetTag(ctx context.Context) Tag {
+	v, ok := ctx.Value(requestKey).(request)
+	if !ok {
+		return NOTAG
+	}
+	return v.tag
+}
+
 // Simple context representing a past-due deadline.
 type CancelledCtxt struct{}
 
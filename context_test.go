@@ -0,0 +1,128 @@
+package p9p
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ctxInfo is what a server learns of a request from its context.
+type ctxInfo struct {
+	user, aname string
+	fid         Fid
+	tag         Tag
+	remote      net.Addr
+}
+
+func infoFromContext(ctx context.Context) ctxInfo {
+	return ctxInfo{GetUser(ctx), GetAname(ctx), GetFid(ctx),
+		GetTag(ctx), GetRemoteAddr(ctx)}
+}
+
+// infoFS records the context of the calls made to it, by name.
+type infoFS struct {
+	mu    sync.Mutex
+	calls map[string]ctxInfo
+}
+
+func (fs *infoFS) record(ctx context.Context, name string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.calls[name] = infoFromContext(ctx)
+}
+
+func (fs *infoFS) RequireAuth(ctx context.Context) bool { return false }
+
+func (fs *infoFS) Auth(ctx context.Context, uname, aname string) (AuthFile, error) {
+	return nil, ErrNotsupported
+}
+
+func (fs *infoFS) Attach(ctx context.Context, uname, aname string,
+	af AuthFile) (Dirent, error) {
+	fs.record(ctx, "attach")
+	return infoEnt{fs, QTDIR}, nil
+}
+
+type infoEnt struct {
+	fs *infoFS
+	t  QType
+}
+
+func (e infoEnt) Qid() Qid { return Qid{Type: e.t} }
+
+func (e infoEnt) OpenDir(ctx context.Context) (ReadNext, error) {
+	return nil, ErrNotsupported
+}
+
+func (e infoEnt) Walk(ctx context.Context, names ...string) ([]Qid, Dirent, error) {
+	e.fs.record(ctx, "walk")
+	return []Qid{{}}, infoEnt{e.fs, QTFILE}, nil
+}
+
+func (e infoEnt) Create(ctx context.Context, name string, perm uint32,
+	mode Flag) (Dirent, File, error) {
+	return nil, nil, ErrNotsupported
+}
+
+func (e infoEnt) Open(ctx context.Context, mode Flag) (File, error) {
+	return nil, ErrNotsupported
+}
+
+func (e infoEnt) Remove(ctx context.Context) error { return ErrNotsupported }
+
+func (e infoEnt) Clunk(ctx context.Context) error {
+	e.fs.record(ctx, "clunk")
+	return nil
+}
+
+func (e infoEnt) Stat(ctx context.Context) (Dir, error) {
+	e.fs.record(ctx, "stat")
+	return Dir{}, nil
+}
+
+func (e infoEnt) WStat(ctx context.Context, dir Dir) error {
+	return ErrNotsupported
+}
+
+func TestRequestContext(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	fs := &infoFS{calls: make(map[string]ctxInfo)}
+	cc, sc := net.Pipe()
+	go ServeConn(ctx, sc, SSession(SFileSys(fs)))
+
+	session, err := CSession(ctx, cc)
+	if !assert.Nil(err) {
+		return
+	}
+	_, err = session.Attach(ctx, 3, NOFID, "glenda", "main")
+	assert.Nil(err)
+	_, err = session.Walk(ctx, 3, 4, "file")
+	assert.Nil(err)
+	_, err = session.Stat(ctx, 4)
+	assert.Nil(err)
+	assert.Nil(session.Clunk(ctx, 4))
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for name, fid := range map[string]Fid{"attach": 3, "walk": 3, "stat": 4, "clunk": 4} {
+		info := fs.calls[name]
+		assert.Equal("glenda", info.user, name)
+		assert.Equal("main", info.aname, name)
+		assert.Equal(fid, info.fid, name)
+		assert.NotEqual(NOTAG, info.tag, name)
+		if assert.NotNil(info.remote, name) {
+			assert.Equal("pipe", info.remote.String())
+		}
+	}
+
+	// Outside of a server, nothing is known.
+	assert.Equal(ctxInfo{fid: NOFID, tag: NOTAG},
+		infoFromContext(context.Background()))
+}
@@ -0,0 +1,480 @@
+package p9p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// DialFunc opens a new connection to a 9p server.
+type DialFunc func(ctx context.Context) (net.Conn, error)
+
+// StaleError is returned by a reconnecting session for a fid whose file has
+// changed while the session was disconnected. After the reconnect, walking
+// the fid's path led to a file with a different Qid, so the fid is not
+// re-established. It matches ErrStale under errors.Is. The fid stays stale
+// until clunked.
+type StaleError struct {
+	Fid  Fid
+	Path []string // the path walked from the attach point
+	Want Qid      // the Qid known before the disconnect
+	Got  Qid      // the Qid found after it
+}
+
+func (e *StaleError) Error() string {
+	return fmt.Sprintf("p9p: stale fid %v at /%s: %v became %v",
+		e.Fid, strings.Join(e.Path, "/"), e.Want, e.Got)
+}
+
+// Is lets errors.Is match a StaleError with ErrStale.
+func (e *StaleError) Is(target error) bool {
+	return target == ErrStale
+}
+
+// ReconnectingSession returns a client session that survives the loss of its
+// connection, such as a server restart. The connection is opened with dial,
+// and opened again before a call if it is known to be lost, or after a call
+// fails because the connection was lost. The version is re-negotiated.
+//
+// A call failing with the connection is retried once if it can safely be
+// repeated: auth, attach, walk, open, read and stat. Create, remove, write
+// and wstat may have been applied by the server before the connection was
+// lost, so they fail with the error instead.
+//
+// The session records how each fid was obtained: its attach parameters, the
+// names walked from the attach point, and the mode it was opened or created
+// with. After a reconnect, each fid is re-established lazily on its next use
+// by attaching, walking the recorded path and opening it again. OTRUNC is
+// dropped from the mode, so that the contents are not lost a second time. If
+// the file found no longer has the same Qid type and path, the call fails
+// with a StaleError.
+//
+// Auth fids are not recorded. Fids attached with an afid are re-attached
+// with NOFID, which only works with servers that do not require
+// authentication.
+//
+// The Context ctx has the same role as for CSession, for every connection.
+func ReconnectingSession(ctx context.Context, dial DialFunc, opts ...ClientOption) (Session, error) {
+	r := &rsession{
+		ctx:     ctx,
+		dial:    dial,
+		version: DefaultVersion,
+		opts:    opts,
+		fids:    make(map[Fid]*rfid),
+	}
+
+	if err := r.connect(ctx); err != nil {
+		return nil, err
+	}
+	// Stick with the version first agreed upon.
+	_, r.version = r.client.Version()
+
+	return r, nil
+}
+
+// rsession is the session returned by ReconnectingSession. All fields after
+// mu are protected by it.
+type rsession struct {
+	ctx     context.Context
+	dial    DialFunc
+	version string
+	opts    []ClientOption
+
+	mu      sync.Mutex
+	client  *client
+	conn    net.Conn
+	gen     int // counts connections
+	stopped bool
+	fids    map[Fid]*rfid
+}
+
+// rfid records how a fid was obtained.
+type rfid struct {
+	uname, aname string
+	path         []string // names walked from the attach point
+	qid          Qid
+	open         bool
+	mode         Flag
+	gen          int  // connection where the fid is established
+	stale        bool // the file changed over a reconnect
+}
+
+var _ Session = &rsession{}
+
+// connect dials a new connection and negotiates the version.
+// r.mu must be held, unless r is not shared yet.
+func (r *rsession) connect(ctx context.Context) error {
+	if r.stopped {
+		return ErrClosed
+	}
+
+	conn, err := r.dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	c, err := newClient(r.ctx, conn, r.version, r.opts)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	r.client, r.conn = c, conn
+	r.gen++
+
+	return nil
+}
+
+// reconnect replaces the connection gen, unless that has been done already.
+func (r *rsession) reconnect(ctx context.Context, gen int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.gen != gen {
+		return nil
+	}
+	return r.connect(ctx)
+}
+
+// use returns the current client and its connection, after re-establishing
+// fid on it if needed. fid may be NOFID, or a fid that is not recorded.
+func (r *rsession) use(ctx context.Context, fid Fid) (*client, int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped {
+		return nil, r.gen, ErrClosed
+	}
+
+	if r.client.lost() {
+		if err := r.connect(ctx); err != nil {
+			return nil, r.gen, err
+		}
+	}
+	if f, ok := r.fids[fid]; ok && fid != NOFID {
+		if err := r.revive(ctx, fid, f); err != nil {
+			return nil, r.gen, err
+		}
+	}
+	return r.client, r.gen, nil
+}
+
+// revive re-establishes fid on the current connection, if it was obtained
+// on an earlier one. r.mu must be held.
+func (r *rsession) revive(ctx context.Context, fid Fid, f *rfid) error {
+	if f.stale {
+		return &StaleError{Fid: fid, Path: f.path, Want: f.qid}
+	}
+	if f.gen == r.gen {
+		return nil
+	}
+
+	c := r.client
+	qid, err := c.Attach(ctx, fid, NOFID, f.uname, f.aname)
+	if err != nil {
+		return err
+	}
+
+	// Walk in place, at most maxWalk names at a time.
+	for names := f.path; len(names) > 0; {
+		n := len(names)
+		if n > maxWalk {
+			n = maxWalk
+		}
+
+		qids, err := c.Walk(ctx, fid, fid, names[:n]...)
+		if err == nil && len(qids) != n {
+			err = ErrNotfound
+		}
+		if err != nil {
+			c.Clunk(ctx, fid)
+			return err
+		}
+
+		qid = qids[n-1]
+		names = names[n:]
+	}
+
+	if qid.Type != f.qid.Type || qid.Path != f.qid.Path {
+		c.Clunk(ctx, fid)
+		f.stale = true
+		return &StaleError{Fid: fid, Path: f.path, Want: f.qid, Got: qid}
+	}
+
+	if f.open {
+		if _, _, err := c.Open(ctx, fid, f.mode&^OTRUNC); err != nil {
+			c.Clunk(ctx, fid)
+			return err
+		}
+	}
+
+	f.gen = r.gen
+	return nil
+}
+
+// do calls fn with a client on which fid is established. If the connection
+// is lost, it reconnects and, if fn is idempotent, calls fn again, once. It
+// returns the connection used by the last call of fn.
+func (r *rsession) do(ctx context.Context, fid Fid, idempotent bool,
+	fn func(c *client) error) (int, error) {
+	for retried := false; ; retried = true {
+		c, gen, err := r.use(ctx, fid)
+		if err == nil {
+			err = fn(c)
+		}
+
+		if retried || !isConnError(err) {
+			return gen, err
+		}
+
+		if rerr := r.reconnect(ctx, gen); rerr != nil || !idempotent {
+			return gen, err
+		}
+	}
+}
+
+// isConnError reports whether err means that the connection is lost, rather
+// than being a failure of the call: the transport is closed, or the
+// connection failed to read or write. Reads report the end of a file
+// otherwise than by io.EOF, see rsession.Read.
+func isConnError(err error) bool {
+	var nerr net.Error
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, ErrClosed), errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.ErrClosedPipe):
+		return true
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	}
+	return errors.As(err, &nerr)
+}
+
+// update calls fn on the record of fid, if it was established on gen.
+func (r *rsession) update(fid Fid, gen int, fn func(f *rfid)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f, ok := r.fids[fid]; ok && f.gen == gen {
+		fn(f)
+	}
+}
+
+// forget drops the record of fid. It reports whether fid must still be
+// clunked on the server, that is if it is established on the current
+// connection or unknown.
+func (r *rsession) forget(fid Fid) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, ok := r.fids[fid]
+	delete(r.fids, fid)
+	return !ok || (!f.stale && f.gen == r.gen)
+}
+
+func (r *rsession) Version() (int, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.client.Version()
+}
+
+// Versions reports the version and msize of the current connection.
+func (r *rsession) Versions() VersionInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.client.Versions()
+}
+
+// Stop closes the connection. Later calls fail with ErrClosed.
+func (r *rsession) Stop(err error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stopped = true
+	r.conn.Close()
+	return err
+}
+
+func (r *rsession) Auth(ctx context.Context, afid Fid, uname, aname string) (qid Qid, err error) {
+	_, err = r.do(ctx, NOFID, true, func(c *client) (err error) {
+		qid, err = c.Auth(ctx, afid, uname, aname)
+		return err
+	})
+	return qid, err
+}
+
+func (r *rsession) Attach(ctx context.Context, fid, afid Fid, uname, aname string) (qid Qid, err error) {
+	gen, err := r.do(ctx, NOFID, true, func(c *client) (err error) {
+		qid, err = c.Attach(ctx, fid, afid, uname, aname)
+		return err
+	})
+	if err != nil {
+		return qid, err
+	}
+
+	r.mu.Lock()
+	r.fids[fid] = &rfid{uname: uname, aname: aname, qid: qid, gen: gen}
+	r.mu.Unlock()
+
+	return qid, nil
+}
+
+// Clunk forgets fid. Fids left over from a lost connection are gone with it,
+// so they are not clunked on the server.
+func (r *rsession) Clunk(ctx context.Context, fid Fid) error {
+	if !r.forget(fid) {
+		return nil
+	}
+
+	c, _, err := r.use(ctx, NOFID)
+	if err != nil {
+		return err
+	}
+	if err := c.Clunk(ctx, fid); err != nil && !isConnError(err) {
+		return err
+	}
+	return nil
+}
+
+func (r *rsession) Remove(ctx context.Context, fid Fid) error {
+	_, err := r.do(ctx, fid, false, func(c *client) error {
+		return c.Remove(ctx, fid)
+	})
+
+	// remove(5): the fid is clunked, even if the remove fails.
+	r.forget(fid)
+	return err
+}
+
+func (r *rsession) Walk(ctx context.Context, fid Fid, newfid Fid, names ...string) (qids []Qid, err error) {
+	gen, err := r.do(ctx, fid, true, func(c *client) (err error) {
+		qids, err = c.Walk(ctx, fid, newfid, names...)
+		return err
+	})
+	if err != nil || len(qids) != len(names) {
+		return qids, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, ok := r.fids[fid]
+	if !ok || f.gen != gen {
+		return qids, nil
+	}
+
+	next := &rfid{
+		uname: f.uname,
+		aname: f.aname,
+		path:  append([]string(nil), f.path...),
+		qid:   f.qid,
+		gen:   gen,
+	}
+	for _, name := range names {
+		if name != ".." {
+			next.path = append(next.path, name)
+		} else if len(next.path) > 0 {
+			// ".." at the attach point stays there.
+			next.path = next.path[:len(next.path)-1]
+		}
+	}
+	if len(qids) > 0 {
+		next.qid = qids[len(qids)-1]
+	}
+	r.fids[newfid] = next
+
+	return qids, nil
+}
+
+// Read returns io.EOF at the end of the file, which is kept from do, where
+// it means that the connection is lost.
+func (r *rsession) Read(ctx context.Context, fid Fid, p []byte, offset int64) (n int, err error) {
+	eof := false
+	_, err = r.do(ctx, fid, true, func(c *client) (err error) {
+		n, err = c.Read(ctx, fid, p, offset)
+		if err == io.EOF {
+			eof, err = true, nil
+		}
+		return err
+	})
+	if eof {
+		return n, io.EOF
+	}
+	return n, err
+}
+
+func (r *rsession) Write(ctx context.Context, fid Fid, p []byte, offset int64) (n int, err error) {
+	_, err = r.do(ctx, fid, false, func(c *client) (err error) {
+		n, err = c.Write(ctx, fid, p, offset)
+		return err
+	})
+	return n, err
+}
+
+func (r *rsession) Open(ctx context.Context, fid Fid, mode Flag) (qid Qid, iounit uint32, err error) {
+	gen, err := r.do(ctx, fid, true, func(c *client) (err error) {
+		qid, iounit, err = c.Open(ctx, fid, mode)
+		return err
+	})
+	if err != nil {
+		return qid, iounit, err
+	}
+
+	r.update(fid, gen, func(f *rfid) {
+		f.open, f.mode = true, mode
+	})
+	return qid, iounit, nil
+}
+
+func (r *rsession) Create(ctx context.Context, parent Fid, name string, perm uint32, mode Flag) (qid Qid, iounit uint32, err error) {
+	gen, err := r.do(ctx, parent, false, func(c *client) (err error) {
+		qid, iounit, err = c.Create(ctx, parent, name, perm, mode)
+		return err
+	})
+	if err != nil {
+		return qid, iounit, err
+	}
+
+	// The fid now refers to the new file.
+	r.update(parent, gen, func(f *rfid) {
+		f.path = append(f.path[:len(f.path):len(f.path)], name)
+		f.qid = qid
+		f.open, f.mode = true, mode
+	})
+	return qid, iounit, nil
+}
+
+func (r *rsession) Stat(ctx context.Context, fid Fid) (dir Dir, err error) {
+	_, err = r.do(ctx, fid, true, func(c *client) (err error) {
+		dir, err = c.Stat(ctx, fid)
+		return err
+	})
+	return dir, err
+}
+
+func (r *rsession) WStat(ctx context.Context, fid Fid, dir Dir) error {
+	gen, err := r.do(ctx, fid, false, func(c *client) error {
+		return c.WStat(ctx, fid, dir)
+	})
+	if err != nil || dir.Name == "" {
+		return err
+	}
+
+	// A rename changes the last name of the path.
+	r.update(fid, gen, func(f *rfid) {
+		if n := len(f.path); n > 0 {
+			f.path = append(f.path[:n-1:n-1], dir.Name)
+		}
+	})
+	return nil
+}
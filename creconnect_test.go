@@ -0,0 +1,107 @@
+package p9p
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// dropHandler loses its connection on the first request of each type it
+// is sent, after counting it as if it had been applied.
+type dropHandler struct {
+	mu    *sync.Mutex
+	seen  map[FcallType]int
+	conn  net.Conn
+	first bool // drop the requests
+}
+
+func (h dropHandler) Handle(ctx context.Context, msg Message) (Message, error) {
+	h.mu.Lock()
+	h.seen[msg.Type()]++
+	h.mu.Unlock()
+
+	if h.first {
+		h.conn.Close()
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	switch msg := msg.(type) {
+	case MessageTwrite:
+		return MessageRwrite{Count: uint32(len(msg.Data))}, nil
+	case MessageTstat:
+		return MessageRstat{}, nil
+	}
+	return nil, ErrNotsupported
+}
+
+func (h dropHandler) Stop(err error) error { return err }
+
+// Only the calls that may be repeated are retried after losing the
+// connection.
+func TestReconnectRetries(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	seen := make(map[FcallType]int)
+	dials := 0
+	dial := func(ctx context.Context) (net.Conn, error) {
+		cc, sc := net.Pipe()
+		// Every other connection drops its requests, starting with the
+		// second.
+		h := dropHandler{&mu, seen, sc, dials%2 == 1}
+		dials++
+		go ServeConn(ctx, sc, h)
+		return cc, nil
+	}
+
+	session, err := ReconnectingSession(ctx, dial)
+	if !assert.Nil(err) {
+		return
+	}
+	r := session.(*rsession)
+	r.conn.Close()
+	assert.Eventually(r.client.lost, time.Second, time.Millisecond)
+
+	// The write reaches the server, and is not repeated.
+	_, err = session.Write(ctx, 1, []byte("abc"), 0)
+	assert.True(isConnError(err), "%v", err)
+	mu.Lock()
+	assert.Equal(1, seen[Twrite])
+	mu.Unlock()
+
+	// The connection made after the failure is good.
+	n, err := session.Write(ctx, 1, []byte("abc"), 0)
+	assert.Nil(err)
+	assert.Equal(3, n)
+
+	// The stat is dropped by the next connection, and repeated on the one
+	// after it.
+	r.conn.Close()
+	assert.Eventually(r.client.lost, time.Second, time.Millisecond)
+	_, err = session.Stat(ctx, 1)
+	assert.Nil(err)
+	mu.Lock()
+	assert.Equal(2, seen[Twrite])
+	assert.Equal(2, seen[Tstat])
+	mu.Unlock()
+}
+
+func TestIsConnError(t *testing.T) {
+	assert := assert.New(t)
+	for _, err := range []error{ErrClosed, io.EOF, io.ErrClosedPipe,
+		&net.OpError{Op: "read", Err: errors.New("reset")}} {
+		assert.True(isConnError(err), "%v", err)
+	}
+	for _, err := range []error{nil, ErrNotfound, ErrUnexpectedMsg,
+		errors.New("tag pool depleted"), context.Canceled, ErrStale} {
+		assert.False(isConnError(err), "%v", err)
+	}
+}
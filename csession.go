@@ -1,6 +1,7 @@
 package p9p
 
 import (
+	"errors"
 	"io"
 	"net"
 
@@ -12,43 +13,111 @@ type client struct {
 	msize     int
 	ctx       context.Context
 	transport roundTripper
+	closed    <-chan struct{} // closed once the connection is lost
+}
+
+// ClientOption configures a client session.
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	onTagError  func(*TagError) error
+	middlewares []Middleware
+}
+
+// WithTagErrorHandler sets the function called when the server sends a
+// response matching no outstanding request, see TagError. If it returns an
+// error, the connection is closed and pending and future calls fail with
+// that error. Otherwise, the response is dropped. The default logs and
+// drops the response.
+//
+// The function is called from the goroutine reading responses, so it must
+// not block. It may be used to count such events.
+func WithTagErrorHandler(fn func(*TagError) error) ClientOption {
+	return func(o *clientOptions) {
+		o.onTagError = fn
+	}
+}
+
+// WithMiddleware sends the requests of the client through the middlewares,
+// see Chain. The Handler they wrap sends each message to the server and
+// returns its reply. Flushes are sent by the client directly.
+func WithMiddleware(mws ...Middleware) ClientOption {
+	return func(o *clientOptions) {
+		o.middlewares = append(o.middlewares, mws...)
+	}
 }
 
 // CSession returns a session using the connection. The Context ctx provides
 // a context for out of band messages, such as flushes, that may be sent by the
 // session. The session can effectively shutdown with this context.
-func CSession(ctx context.Context, conn net.Conn) (Session, error) {
+func CSession(ctx context.Context, conn net.Conn, opts ...ClientOption) (Session, error) {
+	return newClient(ctx, conn, DefaultVersion, opts)
+}
+
+// newClient negotiates version over conn and returns a client for the
+// version accepted by the server.
+func newClient(ctx context.Context, conn net.Conn, version string, opts []ClientOption) (*client, error) {
+	var options clientOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	ch := newChannel(conn, codec9p{}, DefaultMSize) // sets msize, effectively.
 
 	// negotiate the protocol version
-	version, err := clientnegotiate(ctx, ch, DefaultVersion)
+	version, err := clientnegotiate(ctx, ch, version)
 	if err != nil {
 		return nil, err
 	}
 
+	t := newTransport(ctx, ch, options.onTagError)
+	var rt roundTripper = t
+	if len(options.middlewares) > 0 {
+		rt = handlerTransport{Chain(transportHandler{rt}, options.middlewares...)}
+	}
+
 	return &client{
 		version:   version,
 		msize:     ch.MSize(),
 		ctx:       ctx,
-		transport: newTransport(ctx, ch),
+		transport: rt,
+		closed:    t.closed,
 	}, nil
 }
 
+// lost reports whether the connection of c has been closed.
+func (c *client) lost() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
 var _ Session = &client{}
 
 func (c *client) Version() (int, string) {
 	return c.msize, c.version
 }
 
+// Versions reports the version and msize negotiated with the server, so that
+// a proxy serving this session offers no more than its origin.
+func (c *client) Versions() VersionInfo {
+	return VersionInfo{Versions: []string{c.version}, MaxMSize: c.msize}
+}
+
 func (c *client) Stop(err error) error {
 	return err
 }
 
 func (c *client) Auth(ctx context.Context, afid Fid, uname, aname string) (Qid, error) {
+	// Without a numeric uid, rather than uid 0, which is root.
 	m := MessageTauth{
-		Afid:  afid,
-		Uname: uname,
-		Aname: aname,
+		Afid:   afid,
+		Uname:  uname,
+		Aname:  aname,
+		Nuname: NONUNAME,
 	}
 
 	resp, err := c.transport.send(ctx, m)
@@ -65,11 +134,13 @@ func (c *client) Auth(ctx context.Context, afid Fid, uname, aname string) (Qid,
 }
 
 func (c *client) Attach(ctx context.Context, fid, afid Fid, uname, aname string) (Qid, error) {
+	// Without a numeric uid, rather than uid 0, which is root.
 	m := MessageTattach{
-		Fid:   fid,
-		Afid:  afid,
-		Uname: uname,
-		Aname: aname,
+		Fid:    fid,
+		Afid:   afid,
+		Uname:  uname,
+		Aname:  aname,
+		Nuname: NONUNAME,
 	}
 
 	resp, err := c.transport.send(ctx, m)
@@ -118,8 +189,15 @@ func (c *client) Remove(ctx context.Context, fid Fid) error {
 }
 
 func (c *client) Walk(ctx context.Context, fid Fid, newfid Fid, names ...string) ([]Qid, error) {
-	if len(names) > 16 {
-		return nil, ErrWalkLimit
+	if len(names) > maxWalk {
+		if fid == newfid {
+			return nil, ErrWalkLimit
+		}
+		qids, err := walkChained(ctx, c, fid, newfid, names)
+		if err != nil {
+			return nil, err
+		}
+		return qids, nil
 	}
 
 	resp, err := c.transport.send(ctx, MessageTwalk{
@@ -139,6 +217,44 @@ func (c *client) Walk(ctx context.Context, fid Fid, newfid Fid, names ...string)
 	return rwalk.Qids, nil
 }
 
+// walkChained walks names from fid to newfid in as many Twalks as needed,
+// each of at most maxWalk names. The first Twalk goes from fid to newfid,
+// the next ones walk newfid in place. As with a single Twalk, a walk that
+// stops short returns the Qids of the names walked and leaves newfid
+// unaffected: newfid is clunked if an earlier Twalk had moved it. An error
+// is only returned if the first name fails, or the session does, along
+// with the Qids of the names walked before. fid and newfid must differ.
+func walkChained(ctx context.Context, session Session, fid, newfid Fid, names []string) ([]Qid, error) {
+	var qids []Qid
+	from := fid
+
+	for first := true; first || len(names) > 0; first = false {
+		n := len(names)
+		if n > maxWalk {
+			n = maxWalk
+		}
+
+		next, err := session.Walk(ctx, from, newfid, names[:n]...)
+		qids = append(qids, next...)
+		if err != nil || len(next) != n {
+			if from == newfid {
+				session.Clunk(ctx, newfid)
+			}
+
+			var rerr MessageRerror
+			if err != nil && (len(qids) == 0 || !errors.As(err, &rerr)) {
+				return qids, err
+			}
+			return qids, nil
+		}
+
+		from = newfid
+		names = names[n:]
+	}
+
+	return qids, nil
+}
+
 func (c *client) Read(ctx context.Context, fid Fid, p []byte, offset int64) (n int, err error) {
 	resp, err := c.transport.send(ctx, MessageTread{
 		Fid:    fid,
@@ -0,0 +1,319 @@
+package p9p
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// clientL is a client session that has negotiated 9P2000.L.
+type clientL struct {
+	*client
+}
+
+var _ SessionL = clientL{}
+
+// CSessionL returns a session using the connection, like CSession, but
+// negotiates 9P2000.L. An error is returned if the server does not speak it.
+func CSessionL(ctx context.Context, conn net.Conn, opts ...ClientOption) (SessionL, error) {
+	c, err := newClient(ctx, conn, Version9P2000L, opts)
+	if err != nil {
+		return nil, err
+	}
+	if c.version != Version9P2000L {
+		return nil, fmt.Errorf("unsupported server version: %v", c.version)
+	}
+
+	return clientL{c}, nil
+}
+
+func (c clientL) LOpen(ctx context.Context, fid Fid, flags uint32) (Qid, uint32, error) {
+	resp, err := c.transport.send(ctx, MessageTlopen{
+		Fid:   fid,
+		Flags: flags,
+	})
+	if err != nil {
+		return Qid{}, 0, err
+	}
+
+	rlopen, ok := resp.(MessageRlopen)
+	if !ok {
+		return Qid{}, 0, ErrUnexpectedMsg
+	}
+
+	return rlopen.Qid, rlopen.IOUnit, nil
+}
+
+func (c clientL) LCreate(ctx context.Context, parent Fid, name string, flags, mode, gid uint32) (Qid, uint32, error) {
+	resp, err := c.transport.send(ctx, MessageTlcreate{
+		Fid:   parent,
+		Name:  name,
+		Flags: flags,
+		Mode:  mode,
+		Gid:   gid,
+	})
+	if err != nil {
+		return Qid{}, 0, err
+	}
+
+	rlcreate, ok := resp.(MessageRlcreate)
+	if !ok {
+		return Qid{}, 0, ErrUnexpectedMsg
+	}
+
+	return rlcreate.Qid, rlcreate.IOUnit, nil
+}
+
+func (c clientL) GetAttr(ctx context.Context, fid Fid, mask uint64) (Attr, error) {
+	resp, err := c.transport.send(ctx, MessageTgetattr{
+		Fid:         fid,
+		RequestMask: mask,
+	})
+	if err != nil {
+		return Attr{}, err
+	}
+
+	rgetattr, ok := resp.(MessageRgetattr)
+	if !ok {
+		return Attr{}, ErrUnexpectedMsg
+	}
+
+	return rgetattr.Attr, nil
+}
+
+func (c clientL) SetAttr(ctx context.Context, fid Fid, attr SetAttr) error {
+	resp, err := c.transport.send(ctx, MessageTsetattr{
+		Fid:  fid,
+		Attr: attr,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, ok := resp.(MessageRsetattr); !ok {
+		return ErrUnexpectedMsg
+	}
+
+	return nil
+}
+
+func (c clientL) Readdir(ctx context.Context, fid Fid, offset uint64, count uint32) ([]ReaddirEntry, error) {
+	resp, err := c.transport.send(ctx, MessageTreaddir{
+		Fid:    fid,
+		Offset: offset,
+		Count:  count,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rreaddir, ok := resp.(MessageRreaddir)
+	if !ok {
+		return nil, ErrUnexpectedMsg
+	}
+
+	return decodeReaddir(rreaddir.Data)
+}
+
+func (c clientL) Mkdir(ctx context.Context, dfid Fid, name string, mode, gid uint32) (Qid, error) {
+	resp, err := c.transport.send(ctx, MessageTmkdir{
+		Dfid: dfid,
+		Name: name,
+		Mode: mode,
+		Gid:  gid,
+	})
+	if err != nil {
+		return Qid{}, err
+	}
+
+	rmkdir, ok := resp.(MessageRmkdir)
+	if !ok {
+		return Qid{}, ErrUnexpectedMsg
+	}
+
+	return rmkdir.Qid, nil
+}
+
+func (c clientL) Symlink(ctx context.Context, dfid Fid, name, target string, gid uint32) (Qid, error) {
+	resp, err := c.transport.send(ctx, MessageTsymlink{
+		Fid:    dfid,
+		Name:   name,
+		Target: target,
+		Gid:    gid,
+	})
+	if err != nil {
+		return Qid{}, err
+	}
+
+	rsymlink, ok := resp.(MessageRsymlink)
+	if !ok {
+		return Qid{}, ErrUnexpectedMsg
+	}
+
+	return rsymlink.Qid, nil
+}
+
+func (c clientL) Readlink(ctx context.Context, fid Fid) (string, error) {
+	resp, err := c.transport.send(ctx, MessageTreadlink{Fid: fid})
+	if err != nil {
+		return "", err
+	}
+
+	rreadlink, ok := resp.(MessageRreadlink)
+	if !ok {
+		return "", ErrUnexpectedMsg
+	}
+
+	return rreadlink.Target, nil
+}
+
+func (c clientL) Rename(ctx context.Context, fid, dfid Fid, name string) error {
+	resp, err := c.transport.send(ctx, MessageTrename{
+		Fid:  fid,
+		Dfid: dfid,
+		Name: name,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, ok := resp.(MessageRrename); !ok {
+		return ErrUnexpectedMsg
+	}
+
+	return nil
+}
+
+func (c clientL) Renameat(ctx context.Context, olddfid Fid, oldname string, newdfid Fid, newname string) error {
+	resp, err := c.transport.send(ctx, MessageTrenameat{
+		OldDfid: olddfid,
+		OldName: oldname,
+		NewDfid: newdfid,
+		NewName: newname,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, ok := resp.(MessageRrenameat); !ok {
+		return ErrUnexpectedMsg
+	}
+
+	return nil
+}
+
+func (c clientL) Unlinkat(ctx context.Context, dfid Fid, name string, flags uint32) error {
+	resp, err := c.transport.send(ctx, MessageTunlinkat{
+		Dfid:  dfid,
+		Name:  name,
+		Flags: flags,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, ok := resp.(MessageRunlinkat); !ok {
+		return ErrUnexpectedMsg
+	}
+
+	return nil
+}
+
+func (c clientL) Fsync(ctx context.Context, fid Fid, datasync bool) error {
+	m := MessageTfsync{Fid: fid}
+	if datasync {
+		m.Datasync = 1
+	}
+
+	resp, err := c.transport.send(ctx, m)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := resp.(MessageRfsync); !ok {
+		return ErrUnexpectedMsg
+	}
+
+	return nil
+}
+
+func (c clientL) StatFS(ctx context.Context, fid Fid) (StatFS, error) {
+	resp, err := c.transport.send(ctx, MessageTstatfs{Fid: fid})
+	if err != nil {
+		return StatFS{}, err
+	}
+
+	rstatfs, ok := resp.(MessageRstatfs)
+	if !ok {
+		return StatFS{}, ErrUnexpectedMsg
+	}
+
+	return rstatfs.Stat, nil
+}
+
+func (c clientL) XattrWalk(ctx context.Context, fid, newfid Fid, name string) (uint64, error) {
+	resp, err := c.transport.send(ctx, MessageTxattrwalk{
+		Fid:    fid,
+		Newfid: newfid,
+		Name:   name,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	rxattrwalk, ok := resp.(MessageRxattrwalk)
+	if !ok {
+		return 0, ErrUnexpectedMsg
+	}
+
+	return rxattrwalk.Size, nil
+}
+
+func (c clientL) Lock(ctx context.Context, fid Fid, lock Lock) (uint8, error) {
+	resp, err := c.transport.send(ctx, MessageTlock{
+		Fid:      fid,
+		LockType: lock.Type,
+		Flags:    lock.Flags,
+		Start:    lock.Start,
+		Length:   lock.Length,
+		ProcID:   lock.ProcID,
+		ClientID: lock.ClientID,
+	})
+	if err != nil {
+		return LockError, err
+	}
+
+	rlock, ok := resp.(MessageRlock)
+	if !ok {
+		return LockError, ErrUnexpectedMsg
+	}
+
+	return rlock.Status, nil
+}
+
+func (c clientL) GetLock(ctx context.Context, fid Fid, lock Lock) (Lock, error) {
+	resp, err := c.transport.send(ctx, MessageTgetlock{
+		Fid:      fid,
+		LockType: lock.Type,
+		Start:    lock.Start,
+		Length:   lock.Length,
+		ProcID:   lock.ProcID,
+		ClientID: lock.ClientID,
+	})
+	if err != nil {
+		return Lock{}, err
+	}
+
+	rgetlock, ok := resp.(MessageRgetlock)
+	if !ok {
+		return Lock{}, ErrUnexpectedMsg
+	}
+
+	return Lock{
+		Type:     rgetlock.LockType,
+		Start:    rgetlock.Start,
+		Length:   rgetlock.Length,
+		ProcID:   rgetlock.ProcID,
+		ClientID: rgetlock.ClientID,
+	}, nil
+}
@@ -57,10 +57,23 @@ but a long timeout for reading data.
 
 # Multiversion Support
 
-Currently, there is not multiversion support. The hooks and functionality are
-in place to add multi-version support. Generally, the correct space to do this
-is in the codec. Types, such as Dir, simply need to be extended to support the
-possibility of extra fields.
+Servers negotiate between 9P2000 and the 9P2000.u extension. The version is
+handled in the codec: types, such as Dir, Tattach and Rerror, carry the
+extra fields of 9P2000.u, which are only put on the wire when that dialect
+was negotiated. The negotiated version and msize are available to server
+code through GetVersion and GetMSize.
+
+Handlers and sessions declare the versions and msize they support by
+implementing Versioner. Otherwise, a session is assumed to support only what
+Session.Version returns. Client sessions report what their server
+negotiated, so that a proxy never offers more than its origin.
+
+9P2000.L is offered to sessions implementing SessionL, which includes those
+returned by SFileSys, so that the Linux v9fs client can mount them with
+version=9p2000.L. Its extra messages are dispatched to the SessionL methods,
+and Rerror is translated to Rlerror by the codec. A Dirent can serve these
+natively by implementing the optional interfaces in filesys.go, such as
+AttrGetter or Renamer, as done by ufs. Clients use CSessionL.
 
 The real question to ask here is what is the role of the version number in the
 9p protocol. It really comes down to the level of support required. Do we just
@@ -7,6 +7,7 @@ import (
 	"io"
 	"reflect"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -23,23 +24,58 @@ type Codec interface {
 	Size(v interface{}) int
 }
 
-// NewCodec returns a new, standard 9P2000 codec, ready for use.
-// TODO(frobnitzem): enforce no extensions (e.g. 9P2000.u)
-// at protocol level
+// NewCodec returns a new, standard 9P2000 codec, ready for use. Fields only
+// defined by protocol extensions (e.g. 9P2000.u) are never put on the wire.
 func NewCodec() Codec {
 	return codec9p{}
 }
 
-type codec9p struct{}
+// NewCodecVersion returns the codec used to speak the given protocol
+// version, as negotiated through Tversion/Rversion.
+func NewCodecVersion(version string) (Codec, error) {
+	switch version {
+	case Version9P2000:
+		return codec9p{}, nil
+	case Version9P2000u:
+		return codec9p{dialect: dialect9p2000u}, nil
+	case Version9P2000L:
+		return codec9p{dialect: dialect9p2000L}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported version: %q", version)
+}
+
+// dialect selects the variant of the wire format spoken by a codec. Struct
+// fields tagged with `9p:"u"` are only encoded by the extended dialects.
+//
+// 9P2000.L replaces Rerror with Rlerror, carrying only an errno. The codec
+// translates between the two, so that the rest of the package only ever
+// sees MessageRerror.
+type dialect uint8
+
+const (
+	dialect9p2000 dialect = iota
+	dialect9p2000u
+	dialect9p2000L
+)
+
+// extended reports whether fields tagged for 9P2000.u are on the wire.
+func (d dialect) extended() bool {
+	return d != dialect9p2000
+}
+
+type codec9p struct {
+	dialect dialect
+}
 
 func (c codec9p) Unmarshal(data []byte, v interface{}) error {
-	dec := &decoder{bytes.NewReader(data)}
+	dec := &decoder{rd: bytes.NewReader(data), dialect: c.dialect}
 	return dec.decode(v)
 }
 
 func (c codec9p) Marshal(v interface{}) ([]byte, error) {
 	var b bytes.Buffer
-	enc := &encoder{&b}
+	enc := &encoder{wr: &b, dialect: c.dialect}
 
 	if err := enc.encode(v); err != nil {
 		return nil, err
@@ -49,7 +85,7 @@ func (c codec9p) Marshal(v interface{}) ([]byte, error) {
 }
 
 func (c codec9p) Size(v interface{}) int {
-	return int(size9p(v))
+	return int(c.dialect.size(v))
 }
 
 // DecodeDir decodes a directory entry from rd using the provided codec.
@@ -84,7 +120,8 @@ func EncodeDir(codec Codec, wr io.Writer, d *Dir) error {
 }
 
 type encoder struct {
-	wr io.Writer
+	wr      io.Writer
+	dialect dialect
 }
 
 func (e *encoder) encode(vs ...interface{}) error {
@@ -172,12 +209,12 @@ func (e *encoder) encode(vs ...interface{}) error {
 				return err
 			}
 		case Dir:
-			elements, err := fields9p(v)
+			elements, err := fields9p(v, e.dialect)
 			if err != nil {
 				return err
 			}
 
-			if err := e.encode(uint16(size9p(elements...))); err != nil {
+			if err := e.encode(uint16(e.dialect.size(elements...))); err != nil {
 				return err
 			}
 
@@ -201,7 +238,23 @@ func (e *encoder) encode(vs ...interface{}) error {
 			if err := e.encode(*v); err != nil {
 				return err
 			}
+		case Attr, *Attr, SetAttr, *SetAttr, StatFS, *StatFS:
+			elements, err := fields9p(v, e.dialect)
+			if err != nil {
+				return err
+			}
+
+			if err := e.encode(elements...); err != nil {
+				return err
+			}
 		case Fcall:
+			if rerror, ok := v.Message.(MessageRerror); ok && e.dialect == dialect9p2000L {
+				if err := e.encode(Rlerror, v.Tag, lerrno(rerror)); err != nil {
+					return err
+				}
+				continue
+			}
+
 			if err := e.encode(v.Type, v.Tag, v.Message); err != nil {
 				return err
 			}
@@ -210,7 +263,7 @@ func (e *encoder) encode(vs ...interface{}) error {
 				return err
 			}
 		case Message:
-			elements, err := fields9p(v)
+			elements, err := fields9p(v, e.dialect)
 			if err != nil {
 				return err
 			}
@@ -221,7 +274,7 @@ func (e *encoder) encode(vs ...interface{}) error {
 				// http://man.cat-v.org/plan_9/5/stat to make sense of this.
 				// The field has been included here but we need to make sure
 				// to double emit it for Rstat
-				if err := e.encode(uint16(size9p(elements...))); err != nil {
+				if err := e.encode(uint16(e.dialect.size(elements...))); err != nil {
 					return err
 				}
 			case MessageTwstat, *MessageTwstat:
@@ -231,7 +284,7 @@ func (e *encoder) encode(vs ...interface{}) error {
 				}
 				elements = elements[1:]
 				// Write size
-				if err := e.encode(uint16(size9p(elements...))); err != nil {
+				if err := e.encode(uint16(e.dialect.size(elements...))); err != nil {
 					return err
 				}
 			}
@@ -246,7 +299,8 @@ func (e *encoder) encode(vs ...interface{}) error {
 }
 
 type decoder struct {
-	rd io.Reader
+	rd      io.Reader
+	dialect dialect
 }
 
 // read9p extracts values from rd and unmarshals them to the targets of vs.
@@ -347,12 +401,12 @@ func (d *decoder) decode(vs ...interface{}) error {
 				return err
 			}
 
-			elements, err := fields9p(v)
+			elements, err := fields9p(v, d.dialect)
 			if err != nil {
 				return err
 			}
 
-			dec := &decoder{bytes.NewReader(b)}
+			dec := &decoder{rd: bytes.NewReader(b), dialect: d.dialect}
 
 			if err := dec.decode(elements...); err != nil {
 				return err
@@ -369,11 +423,34 @@ func (d *decoder) decode(vs ...interface{}) error {
 				}
 				*v = append(*v, element)
 			}
+		case *Attr, *SetAttr, *StatFS:
+			elements, err := fields9p(v, d.dialect)
+			if err != nil {
+				return err
+			}
+
+			if err := d.decode(elements...); err != nil {
+				return err
+			}
 		case *Fcall:
 			if err := d.decode(&v.Type, &v.Tag); err != nil {
 				return err
 			}
 
+			if v.Type == Rlerror && d.dialect == dialect9p2000L {
+				var ecode uint32
+				if err := d.decode(&ecode); err != nil {
+					return err
+				}
+
+				v.Type = Rerror
+				v.Message = MessageRerror{
+					Ename: syscall.Errno(ecode).Error(),
+					Errno: ecode,
+				}
+				continue
+			}
+
 			message, err := newMessage(v.Type)
 			if err != nil {
 				return err
@@ -390,7 +467,7 @@ func (d *decoder) decode(vs ...interface{}) error {
 
 			v.Message = rv.Elem().Interface().(Message)
 		case Message:
-			elements, err := fields9p(v)
+			elements, err := fields9p(v, d.dialect)
 			if err != nil {
 				return err
 			}
@@ -431,6 +508,12 @@ func (d *decoder) decode(vs ...interface{}) error {
 // the value 0 will be used for the size. The error will be detected when
 // encoding.
 func size9p(vs ...interface{}) uint32 {
+	return dialect9p2000.size(vs...)
+}
+
+// size calculates the projected size of the values in vs when encoded with
+// the dialect d. See size9p.
+func (d dialect) size(vs ...interface{}) uint32 {
 	var s uint32
 	for _, v := range vs {
 		if v == nil {
@@ -444,41 +527,41 @@ func size9p(vs ...interface{}) uint32 {
 		case []byte:
 			s += uint32(binary.Size(uint32(0)) + len(v))
 		case *[]byte:
-			s += size9p(uint32(0), *v)
+			s += d.size(uint32(0), *v)
 		case string:
 			s += uint32(binary.Size(uint16(0)) + len(v))
 		case *string:
-			s += size9p(*v)
+			s += d.size(*v)
 		case []string:
-			s += size9p(uint16(0))
+			s += d.size(uint16(0))
 
 			for _, sv := range v {
-				s += size9p(sv)
+				s += d.size(sv)
 			}
 		case *[]string:
-			s += size9p(*v)
+			s += d.size(*v)
 		case time.Time, *time.Time:
 			// BUG(stevvooe): Y2038 is coming.
-			s += size9p(uint32(0))
+			s += d.size(uint32(0))
 		case Qid:
-			s += size9p(v.Type, v.Version, v.Path)
+			s += d.size(v.Type, v.Version, v.Path)
 		case *Qid:
-			s += size9p(*v)
+			s += d.size(*v)
 		case []Qid:
-			s += size9p(uint16(0))
+			s += d.size(uint16(0))
 			elements := make([]interface{}, len(v))
 			for i := range elements {
 				elements[i] = &v[i]
 			}
-			s += size9p(elements...)
+			s += d.size(elements...)
 		case *[]Qid:
-			s += size9p(*v)
+			s += d.size(*v)
 
 		case Dir:
 			// walk the fields of the message to get the total size. we just
 			// use the field order from the message struct. We may add tag
 			// ignoring if needed.
-			elements, err := fields9p(v)
+			elements, err := fields9p(v, d)
 			if err != nil {
 				// BUG(stevvooe): The options here are to return 0, panic or
 				// make this return an error. Ideally, we make it safe to
@@ -488,35 +571,45 @@ func size9p(vs ...interface{}) uint32 {
 				panic(err)
 			}
 
-			s += size9p(elements...) + size9p(uint16(0))
+			s += d.size(elements...) + d.size(uint16(0))
 		case *Dir:
-			s += size9p(*v)
+			s += d.size(*v)
 		case []Dir:
 			elements := make([]interface{}, len(v))
 			for i := range elements {
 				elements[i] = &v[i]
 			}
-			s += size9p(elements...)
+			s += d.size(elements...)
 		case *[]Dir:
-			s += size9p(*v)
+			s += d.size(*v)
+		case Attr, *Attr, SetAttr, *SetAttr, StatFS, *StatFS:
+			elements, err := fields9p(v, d)
+			if err != nil {
+				panic(err)
+			}
+			s += d.size(elements...)
 		case Fcall:
-			s += size9p(v.Type, v.Tag, v.Message)
+			if _, ok := v.Message.(MessageRerror); ok && d == dialect9p2000L {
+				s += d.size(v.Type, v.Tag, uint32(0)) // Rlerror
+				continue
+			}
+			s += d.size(v.Type, v.Tag, v.Message)
 		case *Fcall:
-			s += size9p(*v)
+			s += d.size(*v)
 		case Message:
 			// special case twstat and rstat for size fields. See bugs in
 			// http://man.cat-v.org/plan_9/5/stat to make sense of this.
 			switch v.(type) {
 			case *MessageRstat, MessageRstat:
-				s += size9p(uint16(0)) // for extra size field before dir
+				s += d.size(uint16(0)) // for extra size field before dir
 			case *MessageTwstat, MessageTwstat:
-				s += size9p(uint16(0)) // for extra size field before dir
+				s += d.size(uint16(0)) // for extra size field before dir
 			}
 
 			// walk the fields of the message to get the total size. we just
 			// use the field order from the message struct. We may add tag
 			// ignoring if needed.
-			elements, err := fields9p(v)
+			elements, err := fields9p(v, d)
 			if err != nil {
 				// BUG(stevvooe): The options here are to return 0, panic or
 				// make this return an error. Ideally, we make it safe to
@@ -526,7 +619,7 @@ func size9p(vs ...interface{}) uint32 {
 				panic(err)
 			}
 
-			s += size9p(elements...)
+			s += d.size(elements...)
 		}
 	}
 
@@ -537,7 +630,10 @@ func size9p(vs ...interface{}) uint32 {
 // writing. We are using a lot of reflection here for fairly static
 // serialization but we can replace this in the future with generated code if
 // performance is an issue.
-func fields9p(v interface{}) ([]interface{}, error) {
+//
+// Fields tagged with `9p:"u"` belong to the 9P2000.u extension and are only
+// listed for dialects that put them on the wire.
+func fields9p(v interface{}, d dialect) ([]interface{}, error) {
 	rv := reflect.Indirect(reflect.ValueOf(v))
 
 	if rv.Kind() != reflect.Struct {
@@ -553,6 +649,11 @@ func fields9p(v interface{}) ([]interface{}, error) {
 			continue
 		}
 
+		if !d.extended() && hasTag9p(rv.Type().Field(i), "u") {
+			// extension field, not part of the base protocol.
+			continue
+		}
+
 		if f.CanAddr() {
 			f = f.Addr()
 		}
@@ -563,6 +664,16 @@ func fields9p(v interface{}) ([]interface{}, error) {
 	return elements, nil
 }
 
+// hasTag9p reports whether the `9p` struct tag of field lists opt.
+func hasTag9p(field reflect.StructField, opt string) bool {
+	for _, o := range strings.Split(field.Tag.Get("9p"), ",") {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
 func string9p(v interface{}) string {
 	if v == nil {
 		return "nil"
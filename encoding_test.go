@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"errors"
 	"reflect"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestEncodeDecode(t *testing.T) {
@@ -481,3 +484,283 @@ func TestEncodeDecode(t *testing.T) {
 		})
 	}
 }
+
+func TestEncodeDecode9P2000u(t *testing.T) {
+	codec, err := NewCodecVersion(Version9P2000u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, testcase := range []struct {
+		description string
+		target      interface{}
+		marshaled   []byte
+	}{
+		{
+			description: "TattachFcall",
+			target: &Fcall{
+				Type: Tattach,
+				Tag:  2255,
+				Message: MessageTattach{
+					Fid:    1,
+					Afid:   NOFID,
+					Uname:  "u",
+					Aname:  "/",
+					Nuname: 1000,
+				},
+			},
+			marshaled: []byte{
+				0x68, 0xcf, 0x8,
+				0x1, 0x0, 0x0, 0x0, // fid
+				0xff, 0xff, 0xff, 0xff, // afid
+				0x1, 0x0, 0x75, // uname
+				0x1, 0x0, 0x2f, // aname
+				0xe8, 0x3, 0x0, 0x0}, // n_uname
+		},
+		{
+			description: "RerrorFcall",
+			target: &Fcall{
+				Type:    Rerror,
+				Tag:     5556,
+				Message: MessageRerror{Ename: "perm", Errno: 13},
+			},
+			marshaled: []byte{
+				0x6b, 0xb4, 0x15,
+				0x4, 0x0, 0x70, 0x65, 0x72, 0x6d, // ename
+				0xd, 0x0, 0x0, 0x0}, // errno
+		},
+		{
+			description: "RstatFcall",
+			target: &Fcall{
+				Type: Rstat,
+				Tag:  5556,
+				Message: MessageRstat{
+					Stat: Dir{
+						Qid:        Qid{Type: QTFILE, Path: 1},
+						Mode:       DMSYMLINK | 0777,
+						AccessTime: time.Date(2006, 01, 02, 03, 04, 05, 0, time.UTC),
+						ModTime:    time.Date(2006, 01, 02, 03, 04, 05, 0, time.UTC),
+						Name:       "l",
+						Extension:  "t",
+						NUID:       1,
+						NGID:       2,
+						NMUID:      NONUNAME,
+					},
+				},
+			},
+			marshaled: []byte{
+				0x7d, 0xb4, 0x15,
+				0x41, 0x0, // size of Rstat payload
+				0x3f, 0x0, // size of Dir
+				0x0, 0x0, // type
+				0x0, 0x0, 0x0, 0x0, // dev
+				0x0, 0x0, 0x0, 0x0, 0x0, // qid.type, qid.version
+				0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, // qid.path
+				0xff, 0x1, 0x0, 0x2, // mode
+				0x25, 0x98, 0xb8, 0x43, // atime
+				0x25, 0x98, 0xb8, 0x43, // mtime
+				0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, // length
+				0x1, 0x0, 0x6c, // name
+				0x0, 0x0, // uid
+				0x0, 0x0, // gid
+				0x0, 0x0, // muid
+				0x1, 0x0, 0x74, // extension
+				0x1, 0x0, 0x0, 0x0, // n_uid
+				0x2, 0x0, 0x0, 0x0, // n_gid
+				0xff, 0xff, 0xff, 0xff}, // n_muid
+		},
+	} {
+		t.Run(testcase.description, func(t *testing.T) {
+			p, err := codec.Marshal(testcase.target)
+			if err != nil {
+				t.Fatalf("error writing fcall: %v", err)
+			}
+
+			if !bytes.Equal(p, testcase.marshaled) {
+				t.Fatalf("unexpected bytes for fcall: \n%#v != \n%#v", p, testcase.marshaled)
+			}
+
+			if codec.Size(testcase.target) != len(testcase.marshaled) {
+				t.Fatalf("size not correct: %v != %v", codec.Size(testcase.target), len(testcase.marshaled))
+			}
+
+			v := new(Fcall)
+			if err := codec.Unmarshal(p, v); err != nil {
+				t.Fatalf("error reading: %v", err)
+			}
+
+			if !reflect.DeepEqual(v, testcase.target) {
+				t.Fatalf("not equal: %v != %v", v, testcase.target)
+			}
+
+			// The base codec must not leak the extension fields.
+			if NewCodec().Size(testcase.target) >= len(testcase.marshaled) {
+				t.Fatalf("9P2000 codec encodes 9P2000.u fields")
+			}
+		})
+	}
+}
+
+func TestEncodeDecode9P2000L(t *testing.T) {
+	codec, err := NewCodecVersion(Version9P2000L)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, testcase := range []struct {
+		description string
+		target      interface{}
+		marshaled   []byte
+	}{
+		{
+			description: "TlopenFcall",
+			target: &Fcall{
+				Type: Tlopen,
+				Tag:  2255,
+				Message: MessageTlopen{
+					Fid:   1,
+					Flags: LORDWR | LOTRUNC,
+				},
+			},
+			marshaled: []byte{
+				0xc, 0xcf, 0x8,
+				0x1, 0x0, 0x0, 0x0, // fid
+				0x2, 0x2, 0x0, 0x0}, // flags
+		},
+		{
+			description: "RlerrorFcall",
+			target: &Fcall{
+				Type: Rerror,
+				Tag:  5556,
+				Message: MessageRerror{
+					Ename: syscall.ENOENT.Error(),
+					Errno: uint32(syscall.ENOENT),
+				},
+			},
+			marshaled: []byte{
+				0x7, 0xb4, 0x15,
+				0x2, 0x0, 0x0, 0x0}, // ecode
+		},
+		{
+			description: "TreaddirFcall",
+			target: &Fcall{
+				Type: Treaddir,
+				Tag:  5556,
+				Message: MessageTreaddir{
+					Fid:    3,
+					Offset: 2,
+					Count:  1000,
+				},
+			},
+			marshaled: []byte{
+				0x28, 0xb4, 0x15,
+				0x3, 0x0, 0x0, 0x0, // fid
+				0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, // offset
+				0xe8, 0x3, 0x0, 0x0}, // count
+		},
+		{
+			description: "TsetattrFcall",
+			target: &Fcall{
+				Type: Tsetattr,
+				Tag:  5556,
+				Message: MessageTsetattr{
+					Fid: 3,
+					Attr: SetAttr{
+						Valid: SetAttrSize,
+						Size:  7,
+					},
+				},
+			},
+			marshaled: []byte{
+				0x1a, 0xb4, 0x15,
+				0x3, 0x0, 0x0, 0x0, // fid
+				0x8, 0x0, 0x0, 0x0, // valid
+				0x0, 0x0, 0x0, 0x0, // mode
+				0x0, 0x0, 0x0, 0x0, // uid
+				0x0, 0x0, 0x0, 0x0, // gid
+				0x7, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, // size
+				0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, // atime_sec
+				0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, // atime_nsec
+				0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, // mtime_sec
+				0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}, // mtime_nsec
+		},
+	} {
+		t.Run(testcase.description, func(t *testing.T) {
+			p, err := codec.Marshal(testcase.target)
+			if err != nil {
+				t.Fatalf("error writing fcall: %v", err)
+			}
+
+			if !bytes.Equal(p, testcase.marshaled) {
+				t.Fatalf("unexpected bytes for fcall: \n%#v != \n%#v", p, testcase.marshaled)
+			}
+
+			if codec.Size(testcase.target) != len(testcase.marshaled) {
+				t.Fatalf("size not correct: %v != %v", codec.Size(testcase.target), len(testcase.marshaled))
+			}
+
+			v := new(Fcall)
+			if err := codec.Unmarshal(p, v); err != nil {
+				t.Fatalf("error reading: %v", err)
+			}
+
+			if !reflect.DeepEqual(v, testcase.target) {
+				t.Fatalf("not equal: %v != %v", v, testcase.target)
+			}
+		})
+	}
+}
+
+func TestEncodeDecode9P2000LRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	codec, err := NewCodecVersion(Version9P2000L)
+	assert.Nil(err)
+
+	entries := []ReaddirEntry{
+		{Qid: Qid{Type: QTDIR, Path: 1}, Offset: 1, Type: dtDir, Name: "dir"},
+		{Qid: Qid{Path: 2}, Offset: 2, Type: dtReg, Name: "file"},
+	}
+	data, err := encodeReaddir(entries)
+	assert.Nil(err)
+	assert.Equal(entries[0].Size()+entries[1].Size(), len(data))
+
+	for _, msg := range []Message{
+		MessageRgetattr{Attr: Attr{
+			Valid:    AttrBasic,
+			Qid:      Qid{Path: 7},
+			Mode:     SIFREG | 0644,
+			NLink:    1,
+			Size:     12,
+			MTimeSec: 1136171045,
+		}},
+		MessageRstatfs{Stat: StatFS{Type: V9FSMagic, BSize: 4096, NameLen: 255}},
+		MessageRreaddir{Data: data},
+		MessageTlock{Fid: 1, LockType: LockTypeWrlck, Length: 10, ClientID: "host"},
+		MessageTrenameat{OldDfid: 1, OldName: "a", NewDfid: 2, NewName: "b"},
+	} {
+		fcall := newFcall(1, msg)
+		p, err := codec.Marshal(fcall)
+		assert.Nil(err)
+		assert.Equal(codec.Size(fcall), len(p))
+
+		v := new(Fcall)
+		assert.Nil(codec.Unmarshal(p, v))
+		assert.Equal(fcall, v)
+	}
+
+	decoded, err := decodeReaddir(data)
+	assert.Nil(err)
+	assert.Equal(entries, decoded)
+
+	// Errors without an errno are mapped through the error table.
+	p, err := codec.Marshal(newErrorFcall(1, ErrNotfound))
+	assert.Nil(err)
+	v := new(Fcall)
+	assert.Nil(codec.Unmarshal(p, v))
+	assert.Equal(uint32(syscall.ENOENT), v.Message.(MessageRerror).Errno)
+
+	p, err = codec.Marshal(newErrorFcall(1, MessageRerror{Ename: "open /x: file exists"}))
+	assert.Nil(err)
+	assert.Nil(codec.Unmarshal(p, v))
+	assert.Equal(uint32(syscall.EEXIST), v.Message.(MessageRerror).Errno)
+}
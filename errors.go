@@ -3,11 +3,18 @@ package p9p
 import (
 	"errors"
 	"fmt"
+	"strings"
+	"syscall"
 )
 
 // MessageRerror provides both a Go error type and message type.
+//
+// Errno is only carried on the wire by 9P2000.u and 9P2000.L. Errors compare
+// equal under errors.Is when their Ename matches, regardless of Errno, and
+// match the syscall.Errno given by Errno.
 type MessageRerror struct {
 	Ename string
+	Errno uint32 `9p:"u"`
 }
 
 // 9p wire errors returned by Session interface methods
@@ -40,7 +47,11 @@ var (
 	ErrUnknownMsg    = new9pError("unknown message")    // returned when encountering unknown message type
 	ErrUnexpectedMsg = new9pError("unexpected message") // returned when an unexpected message is encountered
 	ErrWalkLimit     = new9pError("too many wnames in walk")
+	ErrNotsupported  = new9pError("operation not supported")
 	ErrClosed        = errors.New("closed")
+	ErrStale         = errors.New("stale fid") // see StaleError
+	ErrNofids        = errors.New("no fids available")
+	ErrServerClosed  = errors.New("server closed") // see Server
 )
 
 // new9pError returns a new 9p error ready for the wire.
@@ -57,3 +68,94 @@ func (MessageRerror) Type() FcallType {
 func (e MessageRerror) Error() string {
 	return fmt.Sprintf("9p: %v", e.Ename)
 }
+
+// Is reports whether target is a 9p error with the same Ename, or the
+// syscall.Errno carried by e. Errors such as fs.ErrNotExist are matched
+// through the errno that e stands for, see lerrno.
+func (e MessageRerror) Is(target error) bool {
+	switch t := target.(type) {
+	case syscall.Errno:
+		return e.Errno != 0 && e.Errno == uint32(t)
+	case MessageRerror:
+		return e.Ename == t.Ename
+	case *MessageRerror:
+		return t != nil && e.Ename == t.Ename
+	}
+
+	// Match fs.ErrNotExist and the like, as os errors do.
+	return syscall.Errno(lerrno(e)).Is(target)
+}
+
+// errnoOf extracts a system error number from err, for use as the 9P2000.u
+// errno of an Rerror. Zero is returned if err does not wrap a syscall.Errno,
+// which tells the client to interpret the Ename instead.
+func errnoOf(err error) uint32 {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return uint32(errno)
+	}
+	return 0
+}
+
+// errnos gives the errno reported to 9P2000.L clients for the errors of this
+// package.
+var errnos = map[string]syscall.Errno{
+	ErrBadattach.(MessageRerror).Ename:     syscall.ENOENT,
+	ErrBadoffset.(MessageRerror).Ename:     syscall.EINVAL,
+	ErrBadcount.(MessageRerror).Ename:      syscall.EINVAL,
+	ErrBotch.(MessageRerror).Ename:         syscall.EIO,
+	ErrCreatenondir.(MessageRerror).Ename:  syscall.ENOTDIR,
+	ErrDupfid.(MessageRerror).Ename:        syscall.EBADF,
+	ErrDuptag.(MessageRerror).Ename:        syscall.EINVAL,
+	ErrIsdir.(MessageRerror).Ename:         syscall.EISDIR,
+	ErrNocreate.(MessageRerror).Ename:      syscall.EPERM,
+	ErrNomem.(MessageRerror).Ename:         syscall.ENOMEM,
+	ErrNoremove.(MessageRerror).Ename:      syscall.EPERM,
+	ErrNostat.(MessageRerror).Ename:        syscall.EPERM,
+	ErrNotfound.(MessageRerror).Ename:      syscall.ENOENT,
+	ErrNoread.(MessageRerror).Ename:        syscall.EPERM,
+	ErrNowrite.(MessageRerror).Ename:       syscall.EPERM,
+	ErrNowstat.(MessageRerror).Ename:       syscall.EPERM,
+	ErrPerm.(MessageRerror).Ename:          syscall.EACCES,
+	ErrUnknownfid.(MessageRerror).Ename:    syscall.EBADF,
+	ErrBaddir.(MessageRerror).Ename:        syscall.EINVAL,
+	ErrWalknodir.(MessageRerror).Ename:     syscall.ENOTDIR,
+	ErrTimeout.(MessageRerror).Ename:       syscall.ETIMEDOUT,
+	ErrUnknownMsg.(MessageRerror).Ename:    syscall.ENOSYS,
+	ErrUnexpectedMsg.(MessageRerror).Ename: syscall.EIO,
+	ErrWalkLimit.(MessageRerror).Ename:     syscall.EINVAL,
+	ErrNotsupported.(MessageRerror).Ename:  syscall.EOPNOTSUPP,
+}
+
+// errnoNames maps the text of system errors back to their errno, so that
+// wrapped errors such as "open /x: no such file or directory" that lost
+// their syscall.Errno can still be reported faithfully.
+var errnoNames = func() map[string]syscall.Errno {
+	m := make(map[string]syscall.Errno)
+	for i := syscall.Errno(1); i < 256; i++ {
+		if s := i.Error(); !strings.HasPrefix(s, "errno ") {
+			m[s] = i
+		}
+	}
+	return m
+}()
+
+// lerrno returns the errno for an Rlerror. As opposed to 9P2000.u, there is
+// no error string to fall back on, so unknown errors become EIO.
+func lerrno(e MessageRerror) uint32 {
+	if e.Errno != 0 {
+		return e.Errno
+	}
+	if errno, ok := errnos[e.Ename]; ok {
+		return uint32(errno)
+	}
+
+	ename := e.Ename
+	if i := strings.LastIndex(ename, ": "); i >= 0 {
+		ename = ename[i+2:]
+	}
+	if errno, ok := errnoNames[ename]; ok {
+		return uint32(errno)
+	}
+	return uint32(syscall.EIO)
+}
@@ -38,6 +38,50 @@ const (
 	Tmax
 )
 
+// Definitions for Fcall's added by 9P2000.L. Only valid once that version
+// has been negotiated.
+const (
+	Rlerror      FcallType = 7
+	Tstatfs      FcallType = 8
+	Rstatfs      FcallType = 9
+	Tlopen       FcallType = 12
+	Rlopen       FcallType = 13
+	Tlcreate     FcallType = 14
+	Rlcreate     FcallType = 15
+	Tsymlink     FcallType = 16
+	Rsymlink     FcallType = 17
+	Tmknod       FcallType = 18
+	Rmknod       FcallType = 19
+	Trename      FcallType = 20
+	Rrename      FcallType = 21
+	Treadlink    FcallType = 22
+	Rreadlink    FcallType = 23
+	Tgetattr     FcallType = 24
+	Rgetattr     FcallType = 25
+	Tsetattr     FcallType = 26
+	Rsetattr     FcallType = 27
+	Txattrwalk   FcallType = 30
+	Rxattrwalk   FcallType = 31
+	Txattrcreate FcallType = 32
+	Rxattrcreate FcallType = 33
+	Treaddir     FcallType = 40
+	Rreaddir     FcallType = 41
+	Tfsync       FcallType = 50
+	Rfsync       FcallType = 51
+	Tlock        FcallType = 52
+	Rlock        FcallType = 53
+	Tgetlock     FcallType = 54
+	Rgetlock     FcallType = 55
+	Tlink        FcallType = 70
+	Rlink        FcallType = 71
+	Tmkdir       FcallType = 72
+	Rmkdir       FcallType = 73
+	Trenameat    FcallType = 74
+	Rrenameat    FcallType = 75
+	Tunlinkat    FcallType = 76
+	Runlinkat    FcallType = 77
+)
+
 func (fct FcallType) String() string {
 	switch fct {
 	case Tversion:
@@ -97,6 +141,84 @@ func (fct FcallType) String() string {
 		return "Twstat"
 	case Rwstat:
 		return "Rwstat"
+	case Rlerror:
+		return "Rlerror"
+	case Tstatfs:
+		return "Tstatfs"
+	case Rstatfs:
+		return "Rstatfs"
+	case Tlopen:
+		return "Tlopen"
+	case Rlopen:
+		return "Rlopen"
+	case Tlcreate:
+		return "Tlcreate"
+	case Rlcreate:
+		return "Rlcreate"
+	case Tsymlink:
+		return "Tsymlink"
+	case Rsymlink:
+		return "Rsymlink"
+	case Tmknod:
+		return "Tmknod"
+	case Rmknod:
+		return "Rmknod"
+	case Trename:
+		return "Trename"
+	case Rrename:
+		return "Rrename"
+	case Treadlink:
+		return "Treadlink"
+	case Rreadlink:
+		return "Rreadlink"
+	case Tgetattr:
+		return "Tgetattr"
+	case Rgetattr:
+		return "Rgetattr"
+	case Tsetattr:
+		return "Tsetattr"
+	case Rsetattr:
+		return "Rsetattr"
+	case Txattrwalk:
+		return "Txattrwalk"
+	case Rxattrwalk:
+		return "Rxattrwalk"
+	case Txattrcreate:
+		return "Txattrcreate"
+	case Rxattrcreate:
+		return "Rxattrcreate"
+	case Treaddir:
+		return "Treaddir"
+	case Rreaddir:
+		return "Rreaddir"
+	case Tfsync:
+		return "Tfsync"
+	case Rfsync:
+		return "Rfsync"
+	case Tlock:
+		return "Tlock"
+	case Rlock:
+		return "Rlock"
+	case Tgetlock:
+		return "Tgetlock"
+	case Rgetlock:
+		return "Rgetlock"
+	case Tlink:
+		return "Tlink"
+	case Rlink:
+		return "Rlink"
+	case Tmkdir:
+		return "Tmkdir"
+	case Rmkdir:
+		return "Rmkdir"
+	case Trenameat:
+		return "Trenameat"
+	case Rrenameat:
+		return "Rrenameat"
+	case Tunlinkat:
+		return "Tunlinkat"
+	case Runlinkat:
+		return "Runlinkat"
 	default:
 		return "Tunknown"
 	}
@@ -127,7 +249,7 @@ func newErrorFcall(tag Tag, err error) *Fcall {
 	case *MessageRerror:
 		msg = *v
 	default:
-		msg = MessageRerror{Ename: v.Error()}
+		msg = MessageRerror{Ename: v.Error(), Errno: errnoOf(v)}
 	}
 
 	return &Fcall{
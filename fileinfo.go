@@ -0,0 +1,60 @@
+package p9p
+
+import (
+	"io/fs"
+	"time"
+)
+
+// modeBits pairs the mode bits of a Dir with those of an fs.FileMode.
+var modeBits = []struct {
+	dir  uint32
+	file fs.FileMode
+}{
+	{DMDIR, fs.ModeDir},
+	{DMAPPEND, fs.ModeAppend},
+	{DMEXCL, fs.ModeExclusive},
+	{DMTMP, fs.ModeTemporary},
+	{DMSYMLINK, fs.ModeSymlink},
+	{DMDEVICE, fs.ModeDevice},
+	{DMNAMEDPIPE, fs.ModeNamedPipe},
+	{DMSOCKET, fs.ModeSocket},
+	{DMSETUID, fs.ModeSetuid},
+	{DMSETGID, fs.ModeSetgid},
+}
+
+// fileMode converts the Mode of a Dir to an fs.FileMode.
+func fileMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode & 0777)
+	for _, b := range modeBits {
+		if mode&b.dir != 0 {
+			m |= b.file
+		}
+	}
+	return m
+}
+
+// dirMode converts an fs.FileMode to the Mode of a Dir, or to the perm of a
+// Tcreate.
+func dirMode(m fs.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	for _, b := range modeBits {
+		if m&b.file != 0 {
+			mode |= b.dir
+		}
+	}
+	return mode
+}
+
+// dirInfo presents a Dir as an fs.FileInfo. Sys returns the Dir.
+type dirInfo struct {
+	Dir
+}
+
+var _ fs.FileInfo = dirInfo{}
+
+func (d dirInfo) Name() string       { return d.Dir.Name }
+func (d dirInfo) Size() int64        { return int64(d.Length) }
+func (d dirInfo) Mode() fs.FileMode  { return fileMode(d.Dir.Mode) }
+func (d dirInfo) ModTime() time.Time { return d.Dir.ModTime }
+func (d dirInfo) IsDir() bool        { return d.Dir.Mode&DMDIR != 0 }
+func (d dirInfo) Sys() interface{}   { return d.Dir }
@@ -82,3 +82,45 @@ type Dirent interface {
 func IsDir(d Dirent) bool {
 	return d.Qid().Type&QTDIR != 0
 }
+
+// The following interfaces may be implemented by a Dirent to serve the
+// 9P2000.L operations natively. SFileSys falls back to the basic Dirent
+// methods (or a harmless default) when they are missing.
+
+// AttrGetter returns the Linux attributes of a Dirent.
+// Without it, attributes are derived from Stat.
+type AttrGetter interface {
+	GetAttr(ctx context.Context, mask uint64) (Attr, error)
+}
+
+// AttrSetter applies a Tsetattr.
+// Without it, mode and size changes are applied through WStat.
+type AttrSetter interface {
+	SetAttr(ctx context.Context, attr SetAttr) error
+}
+
+// Symlinker creates a symbolic link named name inside a directory.
+type Symlinker interface {
+	Symlink(ctx context.Context, name, target string, gid uint32) (Qid, error)
+}
+
+// Readlinker returns the target of a symbolic link.
+type Readlinker interface {
+	Readlink(ctx context.Context) (string, error)
+}
+
+// Renamer moves the entry oldname of a directory to newname inside newdir.
+// Without it, renames within a directory are done through WStat.
+type Renamer interface {
+	Rename(ctx context.Context, oldname string, newdir Dirent, newname string) error
+}
+
+// Syncer flushes the contents of an open File (or Dirent) to stable storage.
+type Syncer interface {
+	Sync(ctx context.Context, datasync bool) error
+}
+
+// StatFSer describes the file system holding a Dirent.
+type StatFSer interface {
+	StatFS(ctx context.Context) (StatFS, error)
+}
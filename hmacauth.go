@@ -0,0 +1,216 @@
+package p9p
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The HMAC auth protocol proves that the client knows the secret it shares
+// with the server for its uname. Reading the afid returns a challenge of
+// HMACChallengeSize random bytes. The client answers by writing
+// HMAC-SHA256, keyed by its secret, of the challenge, uname, a zero byte
+// and aname. A wrong answer fails the write with ErrPerm, and the afid can
+// not be used for any attach. A right one lets the afid attach as uname to
+// aname.
+const HMACChallengeSize = 32
+
+// Secrets maps user names to the secrets they share with the server, for
+// HMACAuth.
+type Secrets map[string][]byte
+
+// ReadSecrets reads a secrets file. Each line holds a user name and its
+// secret, separated by white space. Blank lines and lines beginning with
+// '#' are ignored. As it holds secrets, the file should only be readable by
+// its owner.
+func ReadSecrets(name string) (Secrets, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	secrets := make(Secrets)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want a user and a secret", name, n)
+		}
+		secrets[fields[0]] = []byte(fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// HMACAuth wraps fsys to require the clients to authenticate by the HMAC
+// auth protocol, with the secrets of their uname. Only afids having
+// completed the protocol for the uname and aname of the attach are
+// accepted, and fsys sees attaches without an AuthFile.
+func HMACAuth(fsys FileSys, secrets Secrets) FileSys {
+	return hmacFS{fsys, secrets}
+}
+
+type hmacFS struct {
+	FileSys
+	secrets Secrets
+}
+
+func (fs hmacFS) RequireAuth(ctx context.Context) bool {
+	return true
+}
+
+func (fs hmacFS) Auth(ctx context.Context, uname,
+	aname string) (AuthFile, error) {
+	af := &hmacAuthFile{uname: uname, aname: aname}
+	af.key, af.known = fs.secrets[uname]
+	if _, err := rand.Read(af.challenge[:]); err != nil {
+		return nil, err
+	}
+	return af, nil
+}
+
+func (fs hmacFS) Attach(ctx context.Context, uname, aname string,
+	af AuthFile) (Dirent, error) {
+	haf, ok := af.(*hmacAuthFile)
+	if !ok || !haf.Success() || haf.uname != uname || haf.aname != aname {
+		return nil, ErrPerm
+	}
+	return fs.FileSys.Attach(ctx, uname, aname, nil)
+}
+
+// hmacAuthFile is the server side of the HMAC auth protocol. It waits for
+// the answer to its challenge, which then succeeds or fails for good.
+type hmacAuthFile struct {
+	mu           sync.Mutex
+	uname, aname string
+	key          []byte
+	known        bool // key is the secret of uname
+	challenge    [HMACChallengeSize]byte
+	answer       [sha256.Size]byte
+	written      [sha256.Size]bool // the bytes of answer written so far
+	state        hmacState
+}
+
+type hmacState int
+
+const (
+	hmacWaiting hmacState = iota
+	hmacSucceeded
+	hmacFailed
+)
+
+// Read returns the challenge.
+func (af *hmacAuthFile) Read(ctx context.Context, p []byte,
+	offset int64) (int, error) {
+	if offset < 0 {
+		return 0, ErrBadoffset
+	}
+	if offset >= HMACChallengeSize {
+		return 0, nil
+	}
+	return copy(p, af.challenge[offset:]), nil
+}
+
+// Write takes the answer to the challenge, which may be written in parts,
+// in any order. It is checked once all of its bytes are written.
+func (af *hmacAuthFile) Write(ctx context.Context, p []byte,
+	offset int64) (int, error) {
+	af.mu.Lock()
+	defer af.mu.Unlock()
+
+	if af.state != hmacWaiting {
+		return 0, ErrPerm
+	}
+	if offset < 0 || offset > sha256.Size {
+		return 0, ErrBadoffset
+	}
+	if int64(len(p)) > sha256.Size-offset {
+		return 0, ErrBadcount
+	}
+	copy(af.answer[offset:], p)
+	for i := range p {
+		af.written[offset+int64(i)] = true
+	}
+	for _, ok := range af.written {
+		if !ok {
+			return len(p), nil
+		}
+	}
+
+	want := hmacAnswer(af.key, af.challenge[:], af.uname, af.aname)
+	if !af.known || !hmac.Equal(af.answer[:], want) {
+		af.state = hmacFailed
+		return 0, ErrPerm
+	}
+	af.state = hmacSucceeded
+	return len(p), nil
+}
+
+func (af *hmacAuthFile) Success() bool {
+	af.mu.Lock()
+	defer af.mu.Unlock()
+	return af.state == hmacSucceeded
+}
+
+func (af *hmacAuthFile) Close(ctx context.Context) error {
+	return nil
+}
+
+func (af *hmacAuthFile) IOUnit() int {
+	return 0
+}
+
+// hmacAnswer returns the answer to challenge for uname and aname, see
+// HMACChallengeSize.
+func hmacAnswer(key, challenge []byte, uname, aname string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(challenge)
+	mac.Write([]byte(uname))
+	mac.Write([]byte{0})
+	mac.Write([]byte(aname))
+	return mac.Sum(nil)
+}
+
+// HMACAuthenticate runs the client side of the HMAC auth protocol on fsys,
+// typically obtained from CFileSys, proving that uname knows secret. The
+// AuthFile returned is passed to the Attach of fsys with the same uname
+// and aname, and should be closed after it.
+func HMACAuthenticate(ctx context.Context, fsys FileSys, uname, aname string,
+	secret []byte) (AuthFile, error) {
+	af, err := fsys.Auth(ctx, uname, aname)
+	err = EnsureNonNil(af, err)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := make([]byte, HMACChallengeSize)
+	n, err := af.Read(ctx, challenge, 0)
+	if err == nil && n != len(challenge) {
+		err = MessageRerror{Ename: "short auth challenge"}
+	}
+	if err == nil {
+		_, err = af.Write(ctx, hmacAnswer(secret, challenge, uname, aname), 0)
+	}
+	if err != nil {
+		af.Close(ctx)
+		return nil, err
+	}
+
+	if caf, ok := af.(*aFile); ok {
+		caf.success = true
+	}
+	return af, nil
+}
@@ -0,0 +1,106 @@
+package p9p
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHMACAuth(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	name := filepath.Join(t.TempDir(), "secrets")
+	err := os.WriteFile(name, []byte("# user secret\nglenda s3cret\n\nrob pike\n"), 0600)
+	if !assert.Nil(err) {
+		return
+	}
+	secrets, err := ReadSecrets(name)
+	if !assert.Nil(err) {
+		return
+	}
+	assert.Equal(Secrets{"glenda": []byte("s3cret"), "rob": []byte("pike")}, secrets)
+
+	fs := &infoFS{calls: make(map[string]ctxInfo)}
+	cc, sc := net.Pipe()
+	go ServeConn(ctx, sc, SSession(SFileSys(HMACAuth(fs, secrets))))
+	session, err := CSession(ctx, cc)
+	if !assert.Nil(err) {
+		return
+	}
+	cfs := CFileSys(session)
+
+	// Attaching requires an afid.
+	_, err = cfs.Attach(ctx, "glenda", "main", nil)
+	assert.Equal(ErrPerm, err)
+
+	// Wrong secrets, and unknown users, fail.
+	_, err = HMACAuthenticate(ctx, cfs, "glenda", "main", []byte("pike"))
+	assert.Equal(ErrPerm, err)
+	_, err = HMACAuthenticate(ctx, cfs, "eve", "main", []byte(""))
+	assert.Equal(ErrPerm, err)
+
+	af, err := HMACAuthenticate(ctx, cfs, "glenda", "main", []byte("s3cret"))
+	if !assert.Nil(err) {
+		return
+	}
+	assert.True(af.Success())
+
+	// The afid only attaches as the user and aname it was made for.
+	_, err = cfs.Attach(ctx, "rob", "main", af)
+	assert.Equal(ErrPerm, err)
+	_, err = cfs.Attach(ctx, "glenda", "other", af)
+	assert.Equal(ErrPerm, err)
+
+	root, err := cfs.Attach(ctx, "glenda", "main", af)
+	if assert.Nil(err) {
+		assert.Nil(root.Clunk(ctx))
+	}
+	assert.Nil(af.Close(ctx))
+
+	// Once clunked, the afid is gone.
+	_, err = cfs.Attach(ctx, "glenda", "main", af)
+	assert.Equal(ErrUnknownfid, err)
+}
+
+func TestHMACAuthWriteOffset(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	secrets := Secrets{"glenda": []byte("s3cret")}
+
+	af, err := HMACAuth(nil, secrets).Auth(ctx, "glenda", "main")
+	if !assert.Nil(err) {
+		return
+	}
+	challenge := make([]byte, HMACChallengeSize)
+	_, err = af.Read(ctx, challenge, 0)
+	assert.Nil(err)
+	answer := hmacAnswer(secrets["glenda"], challenge, "glenda", "main")
+
+	// Nothing may be written beyond the answer.
+	_, err = af.Write(ctx, answer, 1)
+	assert.Equal(ErrBadcount, err)
+	_, err = af.Write(ctx, nil, int64(len(answer))+1)
+	assert.Equal(ErrBadoffset, err)
+	_, err = af.Write(ctx, nil, -1)
+	assert.Equal(ErrBadoffset, err)
+
+	// Rewritten bytes replace the earlier ones, and the parts may come in
+	// any order.
+	half := len(answer) / 2
+	n, err := af.Write(ctx, make([]byte, half/2), 0)
+	assert.Equal(half/2, n)
+	assert.Nil(err)
+	_, err = af.Write(ctx, answer[half:], int64(half))
+	assert.Nil(err)
+	assert.False(af.Success())
+	_, err = af.Write(ctx, answer[:half], 0)
+	assert.Nil(err)
+	assert.True(af.Success())
+}
@@ -0,0 +1,67 @@
+package p9p
+
+import (
+	"context"
+	"io/fs"
+)
+
+// clientFS presents the files of a Client as an fs.FS.
+type clientFS struct {
+	c *Client
+}
+
+var (
+	_ fs.ReadDirFS  = clientFS{}
+	_ fs.ReadFileFS = clientFS{}
+	_ fs.StatFS     = clientFS{}
+)
+
+// NewFS returns an fs.FS for the files below root, typically a Dirent from
+// CFileSys. It also implements fs.ReadDirFS, fs.ReadFileFS and fs.StatFS,
+// so that it can be handed to fs.WalkDir, http.FS or template.ParseFS.
+// All requests are made with ctx.
+//
+// Entries are described by a FileInfo whose Sys method returns their Dir.
+// Errors returned by the server match fs.ErrNotExist, fs.ErrPermission and
+// the like under errors.Is, according to their errno.
+func NewFS(ctx context.Context, root Dirent) fs.FS {
+	return NewDirentClient(ctx, root).FS()
+}
+
+// FS returns an fs.FS for the files of c, see NewFS.
+func (c *Client) FS() fs.FS {
+	return clientFS{c}
+}
+
+func (f clientFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	file, err := f.c.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (f clientFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	return f.c.ReadDir(name)
+}
+
+func (f clientFS) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrInvalid}
+	}
+	return f.c.ReadFile(name)
+}
+
+func (f clientFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	return f.c.Stat(name)
+}
@@ -0,0 +1,188 @@
+package iofs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"path"
+
+	p9p "github.com/frobnitzem/go-p9p"
+)
+
+// Internal path invariants:
+//
+//   - Path is valid for fs.ValidPath, the root being ".".
+type FileRef struct {
+	srv  *fServer
+	file fs.File
+	pos  int64 // offset of file, if it can neither ReadAt nor Seek
+	Path string
+	Info p9p.Dir
+}
+
+func (f *FileRef) IsDir() bool {
+	return f.Info.Mode&p9p.DMDIR > 0
+}
+
+func (ref *FileRef) Qid() p9p.Qid {
+	return ref.Info.Qid
+}
+
+type dirList struct {
+	dirs []p9p.Dir
+	done bool
+}
+
+func (d *dirList) Next(ctx context.Context) ([]p9p.Dir, error) {
+	if d.done {
+		return nil, nil
+	}
+	d.done = true
+	return d.dirs, nil
+}
+
+func (ref *FileRef) OpenDir(ctx context.Context) (p9p.ReadNext, error) {
+	if !ref.IsDir() {
+		return nil, p9p.MessageRerror{Ename: "not a directory"}
+	}
+
+	entries, err := fs.ReadDir(ref.srv.fsys, ref.Path)
+	if err != nil {
+		return nil, toError(err)
+	}
+	var dirs []p9p.Dir
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err == nil {
+			dirs = append(dirs, dirFromInfo(path.Join(ref.Path, entry.Name()), info))
+		}
+	}
+	return (&dirList{dirs, false}).Next, nil
+}
+
+func (ref *FileRef) Clunk(ctx context.Context) error {
+	if ref.file != nil {
+		return ref.file.Close()
+	}
+	return nil
+}
+
+func (ref *FileRef) Remove(ctx context.Context) error {
+	ref.Clunk(ctx)
+	return p9p.ErrNoremove
+}
+
+func (ref *FileRef) Walk(ctx context.Context, names ...string) ([]p9p.Qid, p9p.Dirent, error) {
+	if len(names) == 0 {
+		next, err := ref.srv.newRef(ref.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, next, nil
+	}
+
+	// Step through the names, to return the qid-s of a partial walk.
+	qids := make([]p9p.Qid, 0, len(names))
+	next := ref
+	for i, name := range names {
+		p := next.Path
+		if name == ".." {
+			p = path.Dir(p) // ".." at the root stays there.
+		} else {
+			p = path.Join(p, name)
+		}
+
+		var err error
+		next, err = ref.srv.newRef(p)
+		if err != nil {
+			if i == 0 {
+				return nil, nil, err
+			}
+			return qids, ref, nil
+		}
+		qids = append(qids, next.Qid())
+	}
+	return qids, next, nil
+}
+
+func (ref *FileRef) Create(ctx context.Context, name string,
+	perm uint32, mode p9p.Flag) (p9p.Dirent, p9p.File, error) {
+	return nil, nil, p9p.ErrNocreate
+}
+
+func (ref *FileRef) Stat(ctx context.Context) (p9p.Dir, error) {
+	return ref.Info, nil
+}
+
+func (ref *FileRef) WStat(ctx context.Context, dir p9p.Dir) error {
+	return p9p.ErrNowstat
+}
+
+func (ref *FileRef) Open(ctx context.Context, mode p9p.Flag) (p9p.File, error) {
+	if mode&3 == p9p.OWRITE || mode&3 == p9p.ORDWR || mode&(p9p.OTRUNC|p9p.ORCLOSE) != 0 {
+		return nil, p9p.ErrNowrite
+	}
+
+	file, err := ref.srv.fsys.Open(ref.Path)
+	if err != nil {
+		return nil, toError(err)
+	}
+	ref.file = file
+	ref.pos = 0
+	return ref, nil
+}
+
+// Read uses ReadAt, or Seek, when the file implements them. Otherwise, the
+// file is read sequentially, and re-opened to read backwards.
+func (ref *FileRef) Read(ctx context.Context, p []byte,
+	offset int64) (n int, err error) {
+	switch file := ref.file.(type) {
+	case io.ReaderAt:
+		n, err = file.ReadAt(p, offset)
+	case io.ReadSeeker:
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+		n, err = io.ReadFull(file, p)
+	default:
+		if err := ref.seek(offset); err != nil {
+			return 0, err
+		}
+		n, err = io.ReadFull(ref.file, p)
+		ref.pos += int64(n)
+	}
+
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return n, err
+	}
+	return n, nil
+}
+
+// seek moves the sequential offset of the file to offset.
+func (ref *FileRef) seek(offset int64) error {
+	if offset < ref.pos {
+		file, err := ref.srv.fsys.Open(ref.Path)
+		if err != nil {
+			return toError(err)
+		}
+		ref.file.Close()
+		ref.file = file
+		ref.pos = 0
+	}
+
+	n, err := io.CopyN(io.Discard, ref.file, offset-ref.pos)
+	ref.pos += n
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func (ref *FileRef) Write(ctx context.Context, p []byte,
+	offset int64) (n int, err error) {
+	return 0, p9p.ErrNowrite
+}
+
+func (ref *FileRef) IOUnit() int {
+	return 0
+}
@@ -0,0 +1,104 @@
+// Package iofs serves any io/fs.FS, such as an embed.FS, a zip.Reader,
+// os.DirFS or fstest.MapFS, as a read-only p9p.FileSys.
+package iofs
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"io/fs"
+
+	"github.com/frobnitzem/go-p9p"
+)
+
+type fServer struct {
+	fsys fs.FS
+}
+
+// NewServer returns a FileSys serving the files of fsys. All mutations fail
+// with ErrNowrite, ErrNocreate, ErrNoremove or ErrNowstat.
+//
+// Qid paths are a hash of the file path, so they are stable across walks
+// and server restarts.
+func NewServer(ctx context.Context, fsys fs.FS) p9p.FileSys {
+	return &fServer{fsys: fsys}
+}
+
+func (_ *fServer) RequireAuth(_ context.Context) bool {
+	return false
+}
+
+func (_ *fServer) Auth(ctx context.Context,
+	uname, aname string) (p9p.AuthFile, error) {
+	return nil, nil
+}
+
+func (srv *fServer) Attach(ctx context.Context, uname, aname string,
+	af p9p.AuthFile) (p9p.Dirent, error) {
+	return srv.newRef(".")
+}
+
+// newRef returns a FileRef for p, a path valid for fs.FS.
+func (srv *fServer) newRef(p string) (*FileRef, error) {
+	info, err := fs.Stat(srv.fsys, p)
+	if err != nil {
+		return nil, toError(err)
+	}
+	return &FileRef{srv: srv, Path: p, Info: dirFromInfo(p, info)}, nil
+}
+
+// qidPath returns the Qid path of the file at p.
+func qidPath(p string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(p))
+	return h.Sum64()
+}
+
+func dirFromInfo(p string, info fs.FileInfo) p9p.Dir {
+	dir := p9p.Dir{
+		Qid: p9p.Qid{
+			Path:    qidPath(p),
+			Version: uint32(info.ModTime().UnixNano() / 1000000),
+		},
+		Name: info.Name(),
+		// Advertise the files as read-only.
+		Mode:       uint32(info.Mode().Perm() &^ 0222),
+		Length:     uint64(info.Size()),
+		AccessTime: info.ModTime(),
+		ModTime:    info.ModTime(),
+		UID:        "none",
+		GID:        "none",
+		MUID:       "none",
+
+		// Only sent to 9P2000.u clients.
+		NUID:  p9p.NONUNAME,
+		NGID:  p9p.NONUNAME,
+		NMUID: p9p.NONUNAME,
+	}
+	if p == "." {
+		dir.Name = "/"
+	}
+
+	switch {
+	case info.IsDir():
+		dir.Qid.Type |= p9p.QTDIR
+		dir.Mode |= p9p.DMDIR
+		dir.Length = 0
+	case info.Mode()&fs.ModeSymlink != 0:
+		dir.Qid.Type |= p9p.QTSYMLINK
+		dir.Mode |= p9p.DMSYMLINK
+	}
+
+	return dir
+}
+
+// toError maps the errors of io/fs to their 9p counterparts.
+func toError(err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return p9p.ErrNotfound
+	case errors.Is(err, fs.ErrPermission):
+		return p9p.ErrPerm
+	}
+	return err
+}
@@ -0,0 +1,150 @@
+package iofs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/frobnitzem/go-p9p"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// seqFS hides ReadAt and Seek from the regular files of an fs.FS.
+type seqFS struct {
+	fs.FS
+}
+
+func (s seqFS) Open(name string) (fs.File, error) {
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := f.(fs.ReadDirFile); ok {
+		return f, nil
+	}
+	return struct{ fs.File }{f}, nil
+}
+
+// fstest.TestFS reads the files a byte at a time, one round trip each, so
+// they are kept small.
+var testFiles = fstest.MapFS{
+	"hello.txt":     {Data: []byte("hello, world"), Mode: 0644},
+	"dir/a":         {Data: []byte("aaaa"), Mode: 0600},
+	"dir/sub/b.txt": {Data: make([]byte, 512), Mode: 0644},
+}
+
+/** Serve an fstest.MapFS, and check it through the client io/fs adapter.
+ */
+func TestServer(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fsys fs.FS
+	}{
+		{"ReaderAt", testFiles},
+		{"Sequential", seqFS{testFiles}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testServer(t, tc.fsys)
+		})
+	}
+}
+
+func testServer(t *testing.T, fsys fs.FS) {
+	var wg sync.WaitGroup
+	assert := assert.New(t)
+
+	ctx := context.Background()
+	sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+
+	reqC, repC := net.Pipe()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		session := p9p.SFileSys(NewServer(sctx, fsys))
+		p9p.ServeConn(sctx, repC, p9p.SSession(session))
+	}()
+
+	session, err := p9p.CSession(ctx, reqC)
+	assert.Nil(err)
+	if err != nil {
+		cancel()
+		wg.Wait()
+		return
+	}
+
+	client, err := p9p.NewClient(ctx, session, "user1", "/")
+	assert.Nil(err)
+
+	// Qid paths are stable.
+	fid0, fid1, fid2 := p9p.Fid(100), p9p.Fid(101), p9p.Fid(102)
+	_, err = session.Attach(ctx, fid0, p9p.NOFID, "user1", "/")
+	assert.Nil(err)
+	qids1, err := session.Walk(ctx, fid0, fid1, "dir", "sub", "b.txt")
+	assert.Nil(err)
+	_, err = session.Walk(ctx, fid0, fid2, "dir")
+	assert.Nil(err)
+	qids2, err := session.Walk(ctx, fid2, fid2, "sub", "b.txt")
+	assert.Nil(err)
+	if assert.Equal(3, len(qids1)) && assert.Equal(2, len(qids2)) {
+		assert.Equal(qids1[2], qids2[1])
+		assert.NotEqual(qids1[1], qids2[1])
+		assert.True(qids1[0].Type&p9p.QTDIR != 0)
+	}
+	assert.Nil(session.Clunk(ctx, fid1))
+	qids1, err = session.Walk(ctx, fid0, fid1, "dir", "nothere")
+	assert.Nil(err)
+	assert.Equal(1, len(qids1))
+
+	// Reads, out of order.
+	_, _, err = session.Open(ctx, fid2, p9p.OREAD)
+	assert.Nil(err)
+	p := make([]byte, 10)
+	n, err := session.Read(ctx, fid2, p, 256)
+	assert.Nil(err)
+	assert.Equal(10, n)
+	n, err = session.Read(ctx, fid2, p, 10)
+	assert.Nil(err)
+	assert.Equal(10, n)
+	_, err = session.Read(ctx, fid2, p, 512)
+	assert.Equal(io.EOF, err)
+	assert.Nil(session.Clunk(ctx, fid2))
+	assert.Nil(session.Clunk(ctx, fid0))
+
+	data, err := client.ReadFile("dir/sub/b.txt")
+	assert.Nil(err)
+	assert.Equal(testFiles["dir/sub/b.txt"].Data, data)
+
+	// Mutations fail.
+	_, err = client.OpenFile("hello.txt", os.O_RDWR, 0)
+	assert.NotNil(err)
+	assert.NotNil(client.WriteFile("new.txt", nil, 0644))
+	assert.NotNil(client.Remove("hello.txt"))
+	assert.NotNil(client.Rename("hello.txt", "bye.txt"))
+	assert.NotNil(client.Mkdir("newdir", 0755))
+
+	_, err = client.Stat("nothere")
+	assert.True(errors.Is(err, fs.ErrNotExist), "%v", err)
+	info, err := client.Stat("dir/a")
+	assert.Nil(err)
+	assert.Equal(fs.FileMode(0400), info.Mode())
+
+	// The tree survives the round trip.
+	fsys2 := client.FS()
+	assert.Nil(fstest.TestFS(fsys2, "hello.txt", "dir/a"))
+	got, err := fs.ReadFile(fsys2, "hello.txt")
+	assert.Nil(err)
+	assert.Equal("hello, world", string(got))
+
+	assert.Nil(client.Close())
+	cancel()
+	wg.Wait()
+}
@@ -0,0 +1,113 @@
+package p9p
+
+import "context"
+
+// Limiter bounds the number of requests in flight across the connections
+// sharing it, see WithLimiter.
+type Limiter struct {
+	slots chan struct{}
+}
+
+// NewLimiter returns a Limiter allowing n requests in flight at once.
+func NewLimiter(n int) *Limiter {
+	if n < 1 {
+		n = 1
+	}
+	return &Limiter{slots: make(chan struct{}, n)}
+}
+
+// ServeOption configures ServeConn.
+type ServeOption func(*serveOptions)
+
+type serveOptions struct {
+	maxInflight int
+	limiter     *Limiter
+	shutdown    <-chan struct{} // see Server.Shutdown
+}
+
+// WithMaxInflight limits the requests handled at once on the connection to
+// n. Once n requests are in flight, the next ones wait for one of them to
+// complete, so that a client flooding the server is slowed down rather than
+// served by ever more goroutines. The requests waiting are held in memory,
+// at most one per tag.
+//
+// Flushes and versions do not count against the limit, and are served
+// while requests wait.
+func WithMaxInflight(n int) ServeOption {
+	return func(o *serveOptions) {
+		o.maxInflight = n
+	}
+}
+
+// WithLimiter also limits the requests handled at once by l, which may be
+// shared with other connections. Requests wait as with WithMaxInflight.
+func WithLimiter(l *Limiter) ServeOption {
+	return func(o *serveOptions) {
+		o.limiter = l
+	}
+}
+
+// withShutdown drains the connection once shutdown is closed: new requests
+// are refused, and the connection is closed with ErrServerClosed as soon as
+// no request is outstanding. See Server.Shutdown.
+func withShutdown(shutdown <-chan struct{}) ServeOption {
+	return func(o *serveOptions) {
+		o.shutdown = shutdown
+	}
+}
+
+// counted reports whether req takes a slot of the in-flight limits.
+func counted(req *Fcall) bool {
+	switch req.Message.(type) {
+	case MessageTflush, MessageTversion:
+		return false
+	}
+	return true
+}
+
+// acquire waits for a slot for req, from the connection and from its
+// Limiter.
+func (c *conn) acquire(ctx context.Context, req *Fcall) error {
+	if !counted(req) {
+		return nil
+	}
+
+	if c.slots != nil {
+		select {
+		case c.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.closed:
+			return c.err
+		}
+	}
+	if c.limiter != nil {
+		select {
+		case c.limiter.slots <- struct{}{}:
+		case <-ctx.Done():
+			c.releaseConn()
+			return ctx.Err()
+		case <-c.closed:
+			c.releaseConn()
+			return c.err
+		}
+	}
+	return nil
+}
+
+// release frees the slots taken by acquire for req.
+func (c *conn) release(req *Fcall) {
+	if !counted(req) {
+		return
+	}
+	if c.limiter != nil {
+		<-c.limiter.slots
+	}
+	c.releaseConn()
+}
+
+func (c *conn) releaseConn() {
+	if c.slots != nil {
+		<-c.slots
+	}
+}
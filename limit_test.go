@@ -0,0 +1,112 @@
+package p9p
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A request read, and counted against the Limiter, but not taken by serve
+// before the connection ends gives its slot back.
+func TestLimiterRelease(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	l := NewLimiter(2)
+	for _, stop := range []string{"cancel", "close"} {
+		cctx, ccancel := context.WithCancel(ctx)
+		cc, sc := net.Pipe()
+		c := &conn{
+			ctx:     cctx,
+			ch:      newChannel(sc, codec9p{}, DefaultMSize),
+			closed:  make(chan struct{}),
+			limiter: l,
+		}
+
+		requests := make(chan *Fcall) // never taken
+		read := make(chan struct{})
+		go func() {
+			defer close(read)
+			c.read(requests, make(chan *Fcall))
+		}()
+
+		client := newChannel(cc, codec9p{}, DefaultMSize)
+		err := client.WriteFcall(ctx, newFcall(1, MessageTstat{Fid: 1}))
+		assert.Nil(err, stop)
+		assert.Eventually(func() bool { return len(l.slots) == 1 },
+			time.Second, time.Millisecond, stop)
+
+		if stop == "cancel" {
+			ccancel()
+		} else {
+			c.CloseWithError(errors.New("closed"))
+		}
+		<-read
+		assert.Equal(0, len(l.slots), stop)
+
+		ccancel()
+		cc.Close()
+		sc.Close()
+	}
+}
+
+// blockHandler blocks stats until they are flushed, and clunks at once.
+type blockHandler struct{}
+
+func (blockHandler) Handle(ctx context.Context, msg Message) (Message, error) {
+	switch msg.(type) {
+	case MessageTstat:
+		<-ctx.Done()
+		return nil, ctx.Err()
+	case MessageTclunk:
+		return MessageRclunk{}, nil
+	}
+	return nil, ErrNotsupported
+}
+
+func (blockHandler) Stop(err error) error { return err }
+
+// Flushes are read and answered while requests wait for a slot.
+func TestMaxInflightFlush(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	go ServeConn(ctx, sc, blockHandler{}, WithMaxInflight(1))
+
+	client := newChannel(cc, codec9p{}, DefaultMSize)
+	resp := new(Fcall)
+	assert.Nil(client.WriteFcall(ctx, newFcall(NOTAG,
+		MessageTversion{MSize: DefaultMSize, Version: DefaultVersion})))
+	assert.Nil(client.ReadFcall(ctx, resp))
+
+	// 1 takes the slot and blocks, 2 waits for it.
+	for _, fc := range []*Fcall{
+		newFcall(1, MessageTstat{Fid: 1}),
+		newFcall(2, MessageTstat{Fid: 2}),
+		newFcall(3, MessageTflush{Oldtag: 1}),
+	} {
+		assert.Nil(client.WriteFcall(ctx, fc))
+	}
+	if assert.Nil(client.ReadFcall(ctx, resp)) {
+		assert.Equal(newFcall(3, MessageRflush{}), resp)
+	}
+
+	// 2 has the slot by now, or still waits for it. Either way its flush
+	// is answered, and then the slot is free again.
+	assert.Nil(client.WriteFcall(ctx, newFcall(4, MessageTflush{Oldtag: 2})))
+	if assert.Nil(client.ReadFcall(ctx, resp)) {
+		assert.Equal(newFcall(4, MessageRflush{}), resp)
+	}
+	assert.Nil(client.WriteFcall(ctx, newFcall(5, MessageTclunk{Fid: 1})))
+	if assert.Nil(client.ReadFcall(ctx, resp)) {
+		assert.Equal(newFcall(5, MessageRclunk{}), resp)
+	}
+}
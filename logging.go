@@ -15,6 +15,9 @@ var _ Session = &logging{}
 
 // Wrap a Session, producing log messages to os.Stdout
 // whenever Auth, Attach, Remove, and Stop are called.
+//
+// Deprecated: use the Logging middleware, which logs structured records
+// through log/slog.
 func NewLogger(prefix string, session Session) Session {
 	return &logging{
 		session: session,
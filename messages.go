@@ -65,6 +65,82 @@ func newMessage(typ FcallType) (Message, error) {
 		return MessageTwstat{}, nil
 	case Rwstat:
 		return MessageRwstat{}, nil
+	case Tstatfs:
+		return MessageTstatfs{}, nil
+	case Rstatfs:
+		return MessageRstatfs{}, nil
+	case Tlopen:
+		return MessageTlopen{}, nil
+	case Rlopen:
+		return MessageRlopen{}, nil
+	case Tlcreate:
+		return MessageTlcreate{}, nil
+	case Rlcreate:
+		return MessageRlcreate{}, nil
+	case Tsymlink:
+		return MessageTsymlink{}, nil
+	case Rsymlink:
+		return MessageRsymlink{}, nil
+	case Tmknod:
+		return MessageTmknod{}, nil
+	case Rmknod:
+		return MessageRmknod{}, nil
+	case Trename:
+		return MessageTrename{}, nil
+	case Rrename:
+		return MessageRrename{}, nil
+	case Treadlink:
+		return MessageTreadlink{}, nil
+	case Rreadlink:
+		return MessageRreadlink{}, nil
+	case Tgetattr:
+		return MessageTgetattr{}, nil
+	case Rgetattr:
+		return MessageRgetattr{}, nil
+	case Tsetattr:
+		return MessageTsetattr{}, nil
+	case Rsetattr:
+		return MessageRsetattr{}, nil
+	case Txattrwalk:
+		return MessageTxattrwalk{}, nil
+	case Rxattrwalk:
+		return MessageRxattrwalk{}, nil
+	case Txattrcreate:
+		return MessageTxattrcreate{}, nil
+	case Rxattrcreate:
+		return MessageRxattrcreate{}, nil
+	case Treaddir:
+		return MessageTreaddir{}, nil
+	case Rreaddir:
+		return MessageRreaddir{}, nil
+	case Tfsync:
+		return MessageTfsync{}, nil
+	case Rfsync:
+		return MessageRfsync{}, nil
+	case Tlock:
+		return MessageTlock{}, nil
+	case Rlock:
+		return MessageRlock{}, nil
+	case Tgetlock:
+		return MessageTgetlock{}, nil
+	case Rgetlock:
+		return MessageRgetlock{}, nil
+	case Tlink:
+		return MessageTlink{}, nil
+	case Rlink:
+		return MessageRlink{}, nil
+	case Tmkdir:
+		return MessageTmkdir{}, nil
+	case Rmkdir:
+		return MessageRmkdir{}, nil
+	case Trenameat:
+		return MessageTrenameat{}, nil
+	case Rrenameat:
+		return MessageRrenameat{}, nil
+	case Tunlinkat:
+		return MessageTunlinkat{}, nil
+	case Runlinkat:
+		return MessageRunlinkat{}, nil
 	}
 
 	return nil, fmt.Errorf("unknown message type")
@@ -83,9 +159,10 @@ type MessageRversion struct {
 }
 
 type MessageTauth struct {
-	Afid  Fid
-	Uname string
-	Aname string
+	Afid   Fid
+	Uname  string
+	Aname  string
+	Nuname uint32 `9p:"u"` // 9P2000.u numeric user id
 }
 
 type MessageRauth struct {
@@ -99,10 +176,11 @@ type MessageTflush struct {
 type MessageRflush struct{}
 
 type MessageTattach struct {
-	Fid   Fid
-	Afid  Fid
-	Uname string
-	Aname string
+	Fid    Fid
+	Afid   Fid
+	Uname  string
+	Aname  string
+	Nuname uint32 `9p:"u"` // 9P2000.u numeric user id
 }
 
 type MessageRattach struct {
@@ -130,10 +208,11 @@ type MessageRopen struct {
 }
 
 type MessageTcreate struct {
-	Fid  Fid
-	Name string
-	Perm uint32
-	Mode Flag
+	Fid       Fid
+	Name      string
+	Perm      uint32
+	Mode      Flag
+	Extension string `9p:"u"` // 9P2000.u special file description
 }
 
 type MessageRcreate struct {
@@ -188,6 +267,200 @@ type MessageTwstat struct {
 
 type MessageRwstat struct{}
 
+// 9P2000.L messages. See
+// https://github.com/chaos/diod/blob/master/protocol.md for their use.
+
+type MessageTstatfs struct {
+	Fid Fid
+}
+
+type MessageRstatfs struct {
+	Stat StatFS
+}
+
+type MessageTlopen struct {
+	Fid   Fid
+	Flags uint32 // Linux open(2) flags
+}
+
+type MessageRlopen struct {
+	Qid    Qid
+	IOUnit uint32
+}
+
+type MessageTlcreate struct {
+	Fid   Fid
+	Name  string
+	Flags uint32 // Linux open(2) flags
+	Mode  uint32
+	Gid   uint32
+}
+
+type MessageRlcreate struct {
+	Qid    Qid
+	IOUnit uint32
+}
+
+type MessageTsymlink struct {
+	Fid    Fid
+	Name   string
+	Target string
+	Gid    uint32
+}
+
+type MessageRsymlink struct {
+	Qid Qid
+}
+
+type MessageTmknod struct {
+	Dfid  Fid
+	Name  string
+	Mode  uint32
+	Major uint32
+	Minor uint32
+	Gid   uint32
+}
+
+type MessageRmknod struct {
+	Qid Qid
+}
+
+type MessageTrename struct {
+	Fid  Fid
+	Dfid Fid
+	Name string
+}
+
+type MessageRrename struct{}
+
+type MessageTreadlink struct {
+	Fid Fid
+}
+
+type MessageRreadlink struct {
+	Target string
+}
+
+type MessageTgetattr struct {
+	Fid         Fid
+	RequestMask uint64
+}
+
+type MessageRgetattr struct {
+	Attr Attr
+}
+
+type MessageTsetattr struct {
+	Fid  Fid
+	Attr SetAttr
+}
+
+type MessageRsetattr struct{}
+
+type MessageTxattrwalk struct {
+	Fid    Fid
+	Newfid Fid
+	Name   string
+}
+
+type MessageRxattrwalk struct {
+	Size uint64
+}
+
+type MessageTxattrcreate struct {
+	Fid   Fid
+	Name  string
+	Size  uint64
+	Flags uint32
+}
+
+type MessageRxattrcreate struct{}
+
+type MessageTreaddir struct {
+	Fid    Fid
+	Offset uint64
+	Count  uint32
+}
+
+// MessageRreaddir holds a sequence of encoded ReaddirEntry records.
+type MessageRreaddir struct {
+	Data []byte
+}
+
+type MessageTfsync struct {
+	Fid      Fid
+	Datasync uint32
+}
+
+type MessageRfsync struct{}
+
+type MessageTlock struct {
+	Fid      Fid
+	LockType uint8
+	Flags    uint32
+	Start    uint64
+	Length   uint64
+	ProcID   uint32
+	ClientID string
+}
+
+type MessageRlock struct {
+	Status uint8
+}
+
+type MessageTgetlock struct {
+	Fid      Fid
+	LockType uint8
+	Start    uint64
+	Length   uint64
+	ProcID   uint32
+	ClientID string
+}
+
+type MessageRgetlock struct {
+	LockType uint8
+	Start    uint64
+	Length   uint64
+	ProcID   uint32
+	ClientID string
+}
+
+type MessageTlink struct {
+	Dfid Fid
+	Fid  Fid
+	Name string
+}
+
+type MessageRlink struct{}
+
+type MessageTmkdir struct {
+	Dfid Fid
+	Name string
+	Mode uint32
+	Gid  uint32
+}
+
+type MessageRmkdir struct {
+	Qid Qid
+}
+
+type MessageTrenameat struct {
+	OldDfid Fid
+	OldName string
+	NewDfid Fid
+	NewName string
+}
+
+type MessageRrenameat struct{}
+
+type MessageTunlinkat struct {
+	Dfid  Fid
+	Name  string
+	Flags uint32
+}
+
+type MessageRunlinkat struct{}
+
 func (MessageTversion) Type() FcallType { return Tversion }
 func (MessageRversion) Type() FcallType { return Rversion }
 func (MessageTauth) Type() FcallType    { return Tauth }
@@ -214,3 +487,110 @@ func (MessageTstat) Type() FcallType    { return Tstat }
 func (MessageRstat) Type() FcallType    { return Rstat }
 func (MessageTwstat) Type() FcallType   { return Twstat }
 func (MessageRwstat) Type() FcallType   { return Rwstat }
+
+func (MessageTstatfs) Type() FcallType      { return Tstatfs }
+func (MessageRstatfs) Type() FcallType      { return Rstatfs }
+func (MessageTlopen) Type() FcallType       { return Tlopen }
+func (MessageRlopen) Type() FcallType       { return Rlopen }
+func (MessageTlcreate) Type() FcallType     { return Tlcreate }
+func (MessageRlcreate) Type() FcallType     { return Rlcreate }
+func (MessageTsymlink) Type() FcallType     { return Tsymlink }
+func (MessageRsymlink) Type() FcallType     { return Rsymlink }
+func (MessageTmknod) Type() FcallType       { return Tmknod }
+func (MessageRmknod) Type() FcallType       { return Rmknod }
+func (MessageTrename) Type() FcallType      { return Trename }
+func (MessageRrename) Type() FcallType      { return Rrename }
+func (MessageTreadlink) Type() FcallType    { return Treadlink }
+func (MessageRreadlink) Type() FcallType    { return Rreadlink }
+func (MessageTgetattr) Type() FcallType     { return Tgetattr }
+func (MessageRgetattr) Type() FcallType     { return Rgetattr }
+func (MessageTsetattr) Type() FcallType     { return Tsetattr }
+func (MessageRsetattr) Type() FcallType     { return Rsetattr }
+func (MessageTxattrwalk) Type() FcallType   { return Txattrwalk }
+func (MessageRxattrwalk) Type() FcallType   { return Rxattrwalk }
+func (MessageTxattrcreate) Type() FcallType { return Txattrcreate }
+func (MessageRxattrcreate) Type() FcallType { return Rxattrcreate }
+func (MessageTreaddir) Type() FcallType     { return Treaddir }
+func (MessageRreaddir) Type() FcallType     { return Rreaddir }
+func (MessageTfsync) Type() FcallType       { return Tfsync }
+func (MessageRfsync) Type() FcallType       { return Rfsync }
+func (MessageTlock) Type() FcallType        { return Tlock }
+func (MessageRlock) Type() FcallType        { return Rlock }
+func (MessageTgetlock) Type() FcallType     { return Tgetlock }
+func (MessageRgetlock) Type() FcallType     { return Rgetlock }
+func (MessageTlink) Type() FcallType        { return Tlink }
+func (MessageRlink) Type() FcallType        { return Rlink }
+func (MessageTmkdir) Type() FcallType       { return Tmkdir }
+func (MessageRmkdir) Type() FcallType       { return Rmkdir }
+func (MessageTrenameat) Type() FcallType    { return Trenameat }
+func (MessageRrenameat) Type() FcallType    { return Rrenameat }
+func (MessageTunlinkat) Type() FcallType    { return Tunlinkat }
+func (MessageRunlinkat) Type() FcallType    { return Runlinkat }
+
+// msgFid returns the fid a request operates on, if any. For requests on a
+// directory and a name, this is the directory.
+func msgFid(msg Message) (Fid, bool) {
+	switch msg := msg.(type) {
+	case MessageTauth:
+		return msg.Afid, true
+	case MessageTattach:
+		return msg.Fid, true
+	case MessageTwalk:
+		return msg.Fid, true
+	case MessageTopen:
+		return msg.Fid, true
+	case MessageTcreate:
+		return msg.Fid, true
+	case MessageTread:
+		return msg.Fid, true
+	case MessageTwrite:
+		return msg.Fid, true
+	case MessageTclunk:
+		return msg.Fid, true
+	case MessageTremove:
+		return msg.Fid, true
+	case MessageTstat:
+		return msg.Fid, true
+	case MessageTwstat:
+		return msg.Fid, true
+	case MessageTstatfs:
+		return msg.Fid, true
+	case MessageTlopen:
+		return msg.Fid, true
+	case MessageTlcreate:
+		return msg.Fid, true
+	case MessageTsymlink:
+		return msg.Fid, true
+	case MessageTmknod:
+		return msg.Dfid, true
+	case MessageTrename:
+		return msg.Fid, true
+	case MessageTreadlink:
+		return msg.Fid, true
+	case MessageTgetattr:
+		return msg.Fid, true
+	case MessageTsetattr:
+		return msg.Fid, true
+	case MessageTxattrwalk:
+		return msg.Fid, true
+	case MessageTxattrcreate:
+		return msg.Fid, true
+	case MessageTreaddir:
+		return msg.Fid, true
+	case MessageTfsync:
+		return msg.Fid, true
+	case MessageTlock:
+		return msg.Fid, true
+	case MessageTgetlock:
+		return msg.Fid, true
+	case MessageTlink:
+		return msg.Fid, true
+	case MessageTmkdir:
+		return msg.Dfid, true
+	case MessageTrenameat:
+		return msg.OldDfid, true
+	case MessageTunlinkat:
+		return msg.Dfid, true
+	}
+	return NOFID, false
+}
@@ -0,0 +1,336 @@
+package p9p
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the latency
+// histograms of Metrics.
+var latencyBuckets = []float64{
+	.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10,
+}
+
+// maxEnames bounds the number of distinct error strings counted by Metrics.
+// Servers may put paths in their errors, so the others are counted under
+// "other".
+const maxEnames = 64
+
+// Metrics counts the requests passing its Middleware, and writes the counts
+// in the Prometheus text exposition format. It may instrument a server,
+// through Chain, or a client, through WithMiddleware.
+//
+// Requests, errors and latencies are counted by message type, and errors
+// also by Ename. Metrics also counts the bytes read and written, the
+// connections served and the fids in use. Connections and their fids are
+// counted from the start of a Handler until it is stopped, see Starter, so
+// only on the server side.
+type Metrics struct {
+	mu           sync.Mutex
+	types        map[FcallType]*typeStats
+	enames       map[string]uint64
+	bytesRead    uint64
+	bytesWritten uint64
+	conns        int64
+	fids         int64
+}
+
+type typeStats struct {
+	requests uint64
+	errors   uint64
+	buckets  []uint64 // by latencyBuckets, not cumulative
+	sum      float64  // seconds
+}
+
+// NewMetrics returns an empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		types:  make(map[FcallType]*typeStats),
+		enames: make(map[string]uint64),
+	}
+}
+
+// Middleware returns a Middleware counting into m.
+func (m *Metrics) Middleware() Middleware {
+	return func(next Handler) Handler {
+		h := &metricsHandler{m: m}
+		h.wrappedHandler = wrappedHandler{next, h.handle}
+		return h
+	}
+}
+
+// metricsHandler counts the messages of a connection, and the fids it
+// holds.
+type metricsHandler struct {
+	wrappedHandler
+	m *Metrics
+
+	mu      sync.Mutex
+	fids    int64
+	started bool // served by ServeConn, and not yet stopped
+}
+
+func (h *metricsHandler) handle(ctx context.Context, msg Message) (Message, error) {
+	start := time.Now()
+	resp, err := h.next.Handle(ctx, msg)
+	elapsed := time.Since(start)
+
+	var delta int64
+	h.mu.Lock()
+	if h.started {
+		delta = fidDelta(msg, resp, err)
+		h.fids += delta
+	}
+	h.mu.Unlock()
+
+	h.m.record(msg, resp, err, elapsed, delta)
+	return resp, err
+}
+
+// fidDelta returns the change in the number of fids in use caused by the
+// request msg.
+func fidDelta(msg, resp Message, err error) int64 {
+	if err != nil {
+		switch msg.(type) {
+		case MessageTclunk, MessageTremove:
+			// The fid is gone, unless it was unknown.
+			if !errors.Is(err, ErrUnknownfid) {
+				return -1
+			}
+		}
+		return 0
+	}
+
+	switch msg := msg.(type) {
+	case MessageTauth:
+		if msg.Afid != NOFID {
+			return 1
+		}
+	case MessageTattach, MessageTxattrwalk:
+		return 1
+	case MessageTwalk:
+		rwalk, ok := resp.(MessageRwalk)
+		if msg.Newfid != msg.Fid && ok && len(rwalk.Qids) == len(msg.Wnames) {
+			return 1
+		}
+	case MessageTclunk, MessageTremove:
+		return -1
+	}
+	return 0
+}
+
+// Reset forgets the fids of the connection, which are clunked by a new
+// Tversion.
+func (h *metricsHandler) Reset(ctx context.Context) error {
+	h.dropFids()
+	return h.wrappedHandler.Reset(ctx)
+}
+
+// Start counts the connection, until Stop.
+func (h *metricsHandler) Start(ctx context.Context) {
+	h.mu.Lock()
+	h.started = true
+	h.mu.Unlock()
+
+	h.m.mu.Lock()
+	h.m.conns++
+	h.m.mu.Unlock()
+	h.wrappedHandler.Start(ctx)
+}
+
+func (h *metricsHandler) Stop(err error) error {
+	h.dropFids()
+
+	h.mu.Lock()
+	started := h.started
+	h.started = false
+	h.mu.Unlock()
+	if started {
+		h.m.mu.Lock()
+		h.m.conns--
+		h.m.mu.Unlock()
+	}
+	return h.wrappedHandler.Stop(err)
+}
+
+func (h *metricsHandler) dropFids() {
+	h.mu.Lock()
+	n := h.fids
+	h.fids = 0
+	h.mu.Unlock()
+
+	h.m.mu.Lock()
+	h.m.fids -= n
+	h.m.mu.Unlock()
+}
+
+func (m *Metrics) record(msg, resp Message, err error,
+	elapsed time.Duration, fids int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ts, ok := m.types[msg.Type()]
+	if !ok {
+		ts = &typeStats{buckets: make([]uint64, len(latencyBuckets))}
+		m.types[msg.Type()] = ts
+	}
+	ts.requests++
+	seconds := elapsed.Seconds()
+	ts.sum += seconds
+	for i, le := range latencyBuckets {
+		if seconds <= le {
+			ts.buckets[i]++
+			break
+		}
+	}
+
+	m.fids += fids
+	if err != nil {
+		ts.errors++
+		ename := err.Error()
+		var rerr MessageRerror
+		if errors.As(err, &rerr) {
+			ename = rerr.Ename
+		}
+		if _, ok := m.enames[ename]; !ok && len(m.enames) >= maxEnames {
+			ename = "other"
+		}
+		m.enames[ename]++
+		return
+	}
+
+	switch resp := resp.(type) {
+	case MessageRread:
+		m.bytesRead += uint64(len(resp.Data))
+	case MessageRwrite:
+		m.bytesWritten += uint64(resp.Count)
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// metricsSnapshot is a copy of the counts of Metrics, so that they are
+// written out without holding its lock.
+type metricsSnapshot struct {
+	types        map[FcallType]typeStats
+	enames       map[string]uint64
+	bytesRead    uint64
+	bytesWritten uint64
+	conns        int64
+	fids         int64
+}
+
+func (m *Metrics) snapshot() metricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := metricsSnapshot{
+		types:        make(map[FcallType]typeStats, len(m.types)),
+		enames:       make(map[string]uint64, len(m.enames)),
+		bytesRead:    m.bytesRead,
+		bytesWritten: m.bytesWritten,
+		conns:        m.conns,
+		fids:         m.fids,
+	}
+	for t, ts := range m.types {
+		c := *ts
+		c.buckets = append([]uint64(nil), ts.buckets...)
+		s.types[t] = c
+	}
+	for e, n := range m.enames {
+		s.enames[e] = n
+	}
+	return s
+}
+
+// WriteTo writes the metrics to w in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	b := bufio.NewWriter(cw)
+
+	s := m.snapshot()
+	types := make([]FcallType, 0, len(s.types))
+	for t := range s.types {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	enames := make([]string, 0, len(s.enames))
+	for e := range s.enames {
+		enames = append(enames, e)
+	}
+	sort.Strings(enames)
+
+	header := func(name, kind, help string) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	header("p9p_requests_total", "counter", "Requests handled, by message type.")
+	for _, t := range types {
+		fmt.Fprintf(b, "p9p_requests_total{type=%q} %d\n", t.String(), s.types[t].requests)
+	}
+	header("p9p_request_errors_total", "counter", "Requests failed, by message type.")
+	for _, t := range types {
+		fmt.Fprintf(b, "p9p_request_errors_total{type=%q} %d\n", t.String(), s.types[t].errors)
+	}
+	header("p9p_errors_total", "counter", "Errors returned, by ename.")
+	for _, e := range enames {
+		fmt.Fprintf(b, "p9p_errors_total{ename=\"%s\"} %d\n", escapeLabel(e), s.enames[e])
+	}
+
+	header("p9p_request_duration_seconds", "histogram", "Latency of requests, by message type.")
+	for _, t := range types {
+		ts := s.types[t]
+		var cum uint64
+		for i, le := range latencyBuckets {
+			cum += ts.buckets[i]
+			fmt.Fprintf(b, "p9p_request_duration_seconds_bucket{type=%q,le=\"%s\"} %d\n",
+				t.String(), strconv.FormatFloat(le, 'g', -1, 64), cum)
+		}
+		fmt.Fprintf(b, "p9p_request_duration_seconds_bucket{type=%q,le=\"+Inf\"} %d\n",
+			t.String(), ts.requests)
+		fmt.Fprintf(b, "p9p_request_duration_seconds_sum{type=%q} %s\n",
+			t.String(), strconv.FormatFloat(ts.sum, 'g', -1, 64))
+		fmt.Fprintf(b, "p9p_request_duration_seconds_count{type=%q} %d\n",
+			t.String(), ts.requests)
+	}
+
+	header("p9p_read_bytes_total", "counter", "Bytes returned by reads.")
+	fmt.Fprintf(b, "p9p_read_bytes_total %d\n", s.bytesRead)
+	header("p9p_written_bytes_total", "counter", "Bytes accepted by writes.")
+	fmt.Fprintf(b, "p9p_written_bytes_total %d\n", s.bytesWritten)
+	header("p9p_connections", "gauge", "Connections being served.")
+	fmt.Fprintf(b, "p9p_connections %d\n", s.conns)
+	header("p9p_fids", "gauge", "Fids in use.")
+	fmt.Fprintf(b, "p9p_fids %d\n", s.fids)
+	err := b.Flush()
+	return cw.n, err
+}
+
+// escapeLabel escapes a label value of the text exposition format.
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
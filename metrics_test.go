@@ -0,0 +1,128 @@
+package p9p
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// echoHandler succeeds at everything but Tstat, reading 5 bytes and writing
+// all it is given.
+type echoHandler struct{}
+
+func (echoHandler) Handle(ctx context.Context, msg Message) (Message, error) {
+	switch msg := msg.(type) {
+	case MessageTattach:
+		return MessageRattach{}, nil
+	case MessageTwalk:
+		return MessageRwalk{Qids: make([]Qid, len(msg.Wnames))}, nil
+	case MessageTread:
+		return MessageRread{Data: []byte("hello")}, nil
+	case MessageTwrite:
+		return MessageRwrite{Count: uint32(len(msg.Data))}, nil
+	case MessageTclunk:
+		return MessageRclunk{}, nil
+	}
+	return nil, ErrNotfound
+}
+
+func (echoHandler) Stop(err error) error {
+	return err
+}
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	m := NewMetrics()
+	cc, sc := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		ServeConn(ctx, sc, Chain(echoHandler{}, m.Middleware()))
+		close(done)
+	}()
+
+	session, err := CSession(ctx, cc)
+	if !assert.Nil(err) {
+		return
+	}
+	_, err = session.Attach(ctx, 0, NOFID, "user", "")
+	assert.Nil(err)
+	_, err = session.Walk(ctx, 0, 1, "a", "b")
+	assert.Nil(err)
+	_, err = session.Read(ctx, 1, make([]byte, 10), 0)
+	assert.Nil(err)
+	_, err = session.Write(ctx, 1, []byte("abc"), 0)
+	assert.Nil(err)
+	_, err = session.Stat(ctx, 1)
+	assert.NotNil(err)
+	assert.Nil(session.Clunk(ctx, 1))
+
+	var buf bytes.Buffer
+	n, err := m.WriteTo(&buf)
+	assert.Nil(err)
+	assert.Equal(int64(buf.Len()), n)
+	out := buf.String()
+	for _, line := range []string{
+		`p9p_requests_total{type="Twalk"} 1`,
+		`p9p_request_errors_total{type="Tstat"} 1`,
+		`p9p_request_errors_total{type="Tread"} 0`,
+		`p9p_errors_total{ename="file not found"} 1`,
+		`p9p_request_duration_seconds_bucket{type="Tread",le="+Inf"} 1`,
+		`p9p_request_duration_seconds_count{type="Tclunk"} 1`,
+		`# TYPE p9p_request_duration_seconds histogram`,
+		`p9p_read_bytes_total 5`,
+		`p9p_written_bytes_total 3`,
+		`p9p_connections 1`,
+		`p9p_fids 1`,
+	} {
+		assert.Contains(out, line+"\n")
+	}
+
+	// The connection and its fids are gone once it is closed.
+	cc.Close()
+	<-done
+	buf.Reset()
+	m.WriteTo(&buf)
+	assert.True(strings.Contains(buf.String(), "p9p_connections 0\n"))
+	assert.True(strings.Contains(buf.String(), "p9p_fids 0\n"))
+
+	// So is a connection failing to negotiate a version.
+	cc, sc = net.Pipe()
+	cc.Close()
+	ServeConn(ctx, sc, Chain(echoHandler{}, m.Middleware()))
+	buf.Reset()
+	m.WriteTo(&buf)
+	assert.True(strings.Contains(buf.String(), "p9p_connections 0\n"))
+}
+
+func TestMetricsClient(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// Clients count requests, but are never started, and so hold no
+	// connection nor fids.
+	m := NewMetrics()
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	go ServeConn(ctx, sc, echoHandler{})
+	session, err := CSession(ctx, cc, WithMiddleware(m.Middleware()))
+	if !assert.Nil(err) {
+		return
+	}
+	_, err = session.Attach(ctx, 0, NOFID, "glenda", "")
+	assert.Nil(err)
+
+	var buf bytes.Buffer
+	m.WriteTo(&buf)
+	assert.Contains(buf.String(), "p9p_requests_total{type=\"Tattach\"} 1\n")
+	assert.Contains(buf.String(), "p9p_connections 0\n")
+	assert.Contains(buf.String(), "p9p_fids 0\n")
+}
@@ -0,0 +1,191 @@
+package p9p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime"
+	"time"
+)
+
+// Middleware wraps a Handler, intercepting the messages sent to it. On the
+// server side, see ServeConn, a Handler receives T-messages and returns
+// R-messages. A client session sends its T-messages through the
+// middlewares given by WithMiddleware.
+type Middleware func(next Handler) Handler
+
+// Chain wraps h with the middlewares, so that mws[0] is the first to see a
+// message.
+func Chain(h Handler, mws ...Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// HandlerFunc handles a message, usually by passing it on to a Handler.
+type HandlerFunc func(ctx context.Context, msg Message) (Message, error)
+
+// WrapHandler returns a Handler handling messages with fn, and forwarding
+// Start, Stop, Reset and Versions to next. Middlewares return it so that the
+// Handler they wrap keeps its optional interfaces, see Resetter and
+// Versioner.
+func WrapHandler(next Handler, fn HandlerFunc) Handler {
+	return wrappedHandler{next, fn}
+}
+
+type wrappedHandler struct {
+	next   Handler
+	handle HandlerFunc
+}
+
+func (w wrappedHandler) Handle(ctx context.Context, msg Message) (Message, error) {
+	return w.handle(ctx, msg)
+}
+
+func (w wrappedHandler) Stop(err error) error {
+	return w.next.Stop(err)
+}
+
+func (w wrappedHandler) Start(ctx context.Context) {
+	if s, ok := w.next.(Starter); ok {
+		s.Start(ctx)
+	}
+}
+
+func (w wrappedHandler) Reset(ctx context.Context) error {
+	if r, ok := w.next.(Resetter); ok {
+		return r.Reset(ctx)
+	}
+	return nil
+}
+
+func (w wrappedHandler) Versions() VersionInfo {
+	return handlerVersions(w.next)
+}
+
+// Recover returns a Middleware turning a panic while handling a message
+// into an Rerror. The panic is logged with its stack.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return WrapHandler(next, func(ctx context.Context,
+			msg Message) (resp Message, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					buf := make([]byte, 64<<10)
+					buf = buf[:runtime.Stack(buf, false)]
+					log.Printf("p9p: panic handling %v: %v\n%s", msg.Type(), r, buf)
+					resp, err = nil, MessageRerror{Ename: fmt.Sprintf("internal error: %v", r)}
+				}
+			}()
+			return next.Handle(ctx, msg)
+		})
+	}
+}
+
+// Timeout returns a Middleware cancelling the context of each message after
+// d. A message whose handling is cut short by the timeout fails with
+// ErrTimeout. Handlers must watch their context for this to take effect.
+func Timeout(d time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return WrapHandler(next, func(ctx context.Context,
+			msg Message) (Message, error) {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+
+			resp, err := next.Handle(ctx, msg)
+			if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, ErrTimeout
+			}
+			return resp, err
+		})
+	}
+}
+
+// AccessFunc decides whether msg may be handled, returning nil if so.
+type AccessFunc func(ctx context.Context, msg Message) error
+
+// AccessControl returns a Middleware checking each message against the rule
+// for its type. A message failing its rule is answered with the error
+// returned, and is not passed on. Messages of types without a rule pass.
+func AccessControl(rules map[FcallType]AccessFunc) Middleware {
+	return func(next Handler) Handler {
+		return WrapHandler(next, func(ctx context.Context,
+			msg Message) (Message, error) {
+			if allow, ok := rules[msg.Type()]; ok {
+				if err := allow(ctx, msg); err != nil {
+					return nil, err
+				}
+			}
+			return next.Handle(ctx, msg)
+		})
+	}
+}
+
+// DenyTypes returns a Middleware refusing the messages of the types given
+// with ErrPerm. For instance, DenyTypes(Twrite, Tcreate, Tremove, Twstat)
+// makes a server read-only.
+func DenyTypes(types ...FcallType) Middleware {
+	deny := func(ctx context.Context, msg Message) error {
+		return ErrPerm
+	}
+	rules := make(map[FcallType]AccessFunc, len(types))
+	for _, t := range types {
+		rules[t] = deny
+	}
+	return AccessControl(rules)
+}
+
+// Hooks are called around each message passing a Hook middleware. Either
+// may be nil.
+type Hooks struct {
+	// Request is called with each message, before it is handled.
+	Request func(ctx context.Context, req Message)
+
+	// Response is called with the outcome of handling req, and the time
+	// taken.
+	Response func(ctx context.Context, req, resp Message, err error,
+		elapsed time.Duration)
+}
+
+// Hook returns a Middleware calling hooks around each message.
+func Hook(hooks Hooks) Middleware {
+	return func(next Handler) Handler {
+		return WrapHandler(next, func(ctx context.Context,
+			msg Message) (Message, error) {
+			if hooks.Request != nil {
+				hooks.Request(ctx, msg)
+			}
+			start := time.Now()
+			resp, err := next.Handle(ctx, msg)
+			if hooks.Response != nil {
+				hooks.Response(ctx, msg, resp, err, time.Since(start))
+			}
+			return resp, err
+		})
+	}
+}
+
+// transportHandler presents the roundTripper of a client as a Handler, so
+// that middlewares can wrap it. See WithMiddleware.
+type transportHandler struct {
+	rt roundTripper
+}
+
+func (t transportHandler) Handle(ctx context.Context, msg Message) (Message, error) {
+	return t.rt.send(ctx, msg)
+}
+
+func (t transportHandler) Stop(err error) error {
+	return err
+}
+
+// handlerTransport is a roundTripper sending messages through a Handler.
+type handlerTransport struct {
+	h Handler
+}
+
+func (t handlerTransport) send(ctx context.Context, msg Message) (Message, error) {
+	return t.h.Handle(ctx, msg)
+}
@@ -0,0 +1,90 @@
+package p9p
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// trapHandler answers Tstat, panics on Tclunk, and blocks on anything else
+// until its request is cancelled.
+type trapHandler struct {
+	resetHandler
+}
+
+func (h *trapHandler) Handle(ctx context.Context, msg Message) (Message, error) {
+	switch msg.(type) {
+	case MessageTstat:
+		return MessageRstat{}, nil
+	case MessageTclunk:
+		panic("trapped")
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestMiddleware(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	var seen []FcallType // by the server, after access control
+	var failed int       // seen by the client
+
+	h := &trapHandler{}
+	handler := Chain(h,
+		Recover(),
+		DenyTypes(Tremove),
+		Timeout(50*time.Millisecond),
+		Hook(Hooks{
+			Request: func(ctx context.Context, req Message) {
+				mu.Lock()
+				seen = append(seen, req.Type())
+				mu.Unlock()
+			},
+		}))
+
+	// The Handler wrapped keeps its optional interfaces.
+	if r, ok := handler.(Resetter); assert.True(ok) {
+		assert.Nil(r.Reset(ctx))
+		assert.Equal(1, h.resets)
+	}
+
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	go ServeConn(ctx, sc, handler)
+
+	session, err := CSession(ctx, cc, WithMiddleware(Hook(Hooks{
+		Response: func(ctx context.Context, req, resp Message, err error,
+			elapsed time.Duration) {
+			if err != nil {
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+		},
+	})))
+	if !assert.Nil(err) {
+		return
+	}
+
+	_, err = session.Stat(ctx, 0)
+	assert.Nil(err)
+	err = session.Clunk(ctx, 0)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "trapped")
+	}
+	assert.Equal(ErrPerm, session.Remove(ctx, 0))
+	_, err = session.Read(ctx, 0, make([]byte, 8), 0)
+	assert.Equal(ErrTimeout, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal([]FcallType{Tstat, Tclunk, Tread}, seen)
+	assert.Equal(3, failed)
+}
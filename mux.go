@@ -0,0 +1,153 @@
+package p9p
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mux is a FileSys routing each attach to one of several FileSys, by the
+// aname of the attach. This lets a single listener export many trees.
+//
+// A pattern ending in "/" matches every aname beginning with it, and the
+// longest such pattern wins. Other patterns match their aname exactly, and
+// take precedence over the prefix patterns. Anames matching no pattern go
+// to the default FileSys, or fail with ErrBadattach if there is none.
+//
+// The aname is passed unchanged to the FileSys routed to.
+type Mux struct {
+	mu       sync.RWMutex
+	exact    map[string]FileSys
+	prefixes []muxEntry // longest first
+	def      FileSys
+}
+
+type muxEntry struct {
+	prefix string
+	fsys   FileSys
+}
+
+// muxAuth remembers the route an AuthFile came from, so that it is not
+// used to attach to another.
+type muxAuth struct {
+	AuthFile
+	route string
+}
+
+var _ FileSys = &Mux{}
+
+// NewMux returns an empty Mux.
+func NewMux() *Mux {
+	return &Mux{exact: make(map[string]FileSys)}
+}
+
+// Handle routes the anames matching pattern to fsys. Registering a pattern
+// twice panics.
+func (m *Mux) Handle(pattern string, fsys FileSys) {
+	if fsys == nil {
+		panic("p9p: nil FileSys for aname " + pattern)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !strings.HasSuffix(pattern, "/") {
+		if _, ok := m.exact[pattern]; ok {
+			panic("p9p: multiple registrations for aname " + pattern)
+		}
+		m.exact[pattern] = fsys
+		return
+	}
+
+	for _, e := range m.prefixes {
+		if e.prefix == pattern {
+			panic("p9p: multiple registrations for aname " + pattern)
+		}
+	}
+	m.prefixes = append(m.prefixes, muxEntry{pattern, fsys})
+	sort.SliceStable(m.prefixes, func(i, j int) bool {
+		return len(m.prefixes[i].prefix) > len(m.prefixes[j].prefix)
+	})
+}
+
+// HandleDefault routes the anames matching no pattern to fsys.
+func (m *Mux) HandleDefault(fsys FileSys) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.def = fsys
+}
+
+// Route returns the FileSys serving aname, or nil if there is none.
+func (m *Mux) Route(aname string) FileSys {
+	fsys, _ := m.route(aname)
+	return fsys
+}
+
+// route returns the FileSys serving aname, and a key naming its route.
+func (m *Mux) route(aname string) (FileSys, string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if fsys, ok := m.exact[aname]; ok {
+		return fsys, "=" + aname
+	}
+	for _, e := range m.prefixes {
+		if strings.HasPrefix(aname, e.prefix) {
+			return e.fsys, e.prefix
+		}
+	}
+	return m.def, ""
+}
+
+// RequireAuth is true if any of the routes requires it. The routes not
+// requiring auth accept attaches without an AuthFile.
+func (m *Mux) RequireAuth(ctx context.Context) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, fsys := range m.exact {
+		if fsys.RequireAuth(ctx) {
+			return true
+		}
+	}
+	for _, e := range m.prefixes {
+		if e.fsys.RequireAuth(ctx) {
+			return true
+		}
+	}
+	return m.def != nil && m.def.RequireAuth(ctx)
+}
+
+func (m *Mux) Auth(ctx context.Context, uname, aname string) (AuthFile, error) {
+	fsys, route := m.route(aname)
+	if fsys == nil {
+		return nil, ErrBadattach
+	}
+	if !fsys.RequireAuth(ctx) {
+		return nil, MessageRerror{Ename: "no auth"}
+	}
+
+	af, err := fsys.Auth(ctx, uname, aname)
+	if err != nil {
+		return nil, err
+	}
+	return muxAuth{af, route}, nil
+}
+
+func (m *Mux) Attach(ctx context.Context, uname, aname string,
+	af AuthFile) (Dirent, error) {
+	fsys, route := m.route(aname)
+	if fsys == nil {
+		return nil, ErrBadattach
+	}
+
+	if af != nil {
+		ma, ok := af.(muxAuth)
+		if !ok || ma.route != route {
+			return nil, ErrPerm
+		}
+		af = ma.AuthFile
+	}
+	return fsys.Attach(ctx, uname, aname, af)
+}
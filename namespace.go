@@ -0,0 +1,355 @@
+package p9p
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+)
+
+// BindFlag says where Namespace.Bind places a tree in the union at a path.
+type BindFlag int
+
+const (
+	MREPL   BindFlag = 0x0000 // replace the union
+	MBEFORE BindFlag = 0x0001 // add the tree at the front of the union
+	MAFTER  BindFlag = 0x0002 // add the tree at the back of the union
+	MCREATE BindFlag = 0x0004 // allow creation in the tree
+)
+
+// Namespace is a FileSys composing several FileSys into one tree, after
+// the bind(2) of Plan 9.
+//
+// Each path of the namespace holding binds is a union of trees, searched in
+// order. A walk from a union directory takes the first member holding the
+// name, and OpenDir lists the entries of all members, the first member to
+// hold a name winning. Create goes to the first member bound with MCREATE.
+// The tree found below a path before any bind, such as the root FileSys at
+// "/", is a union member like the others, and always allows creation.
+//
+// Auth is delegated to the root FileSys. The bound trees are attached under
+// the uname, aname and AuthFile of the attach, as is the root again when
+// walking "..".
+type Namespace struct {
+	root FileSys
+
+	mu     sync.RWMutex
+	mounts map[string][]nsBind // by clean, slash-rooted path
+}
+
+// nsBind is a member of the union at a path. The fsys of the tree found
+// below the path before any bind is nil.
+type nsBind struct {
+	fsys   FileSys
+	create bool
+}
+
+var _ FileSys = &Namespace{}
+
+// NewNamespace returns a Namespace of the root FileSys.
+func NewNamespace(root FileSys) *Namespace {
+	return &Namespace{
+		root:   root,
+		mounts: make(map[string][]nsBind),
+	}
+}
+
+// Bind adds the root of fsys to the union at the path old, in the place
+// given by flag. The path old should exist when walked to, unless the union
+// holds other members. Binds apply to the attaches following them.
+func (ns *Namespace) Bind(fsys FileSys, old string, flag BindFlag) error {
+	if fsys == nil {
+		return MessageRerror{Ename: "bind of nil FileSys"}
+	}
+	if flag&MBEFORE != 0 && flag&MAFTER != 0 {
+		return MessageRerror{Ename: "bad bind flag"}
+	}
+	old = path.Clean("/" + old)
+	b := nsBind{fsys: fsys, create: flag&MCREATE != 0}
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	union, ok := ns.mounts[old]
+	if !ok {
+		union = []nsBind{{create: true}}
+	}
+	switch {
+	case flag&MBEFORE != 0:
+		union = append([]nsBind{b}, union...)
+	case flag&MAFTER != 0:
+		union = append(union[:len(union):len(union)], b)
+	default:
+		union = []nsBind{b}
+	}
+	ns.mounts[old] = union
+	return nil
+}
+
+// union returns the binds at p, if any.
+func (ns *Namespace) union(p string) []nsBind {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	return ns.mounts[p]
+}
+
+func (ns *Namespace) RequireAuth(ctx context.Context) bool {
+	return ns.root.RequireAuth(ctx)
+}
+
+func (ns *Namespace) Auth(ctx context.Context, uname, aname string) (AuthFile, error) {
+	return ns.root.Auth(ctx, uname, aname)
+}
+
+func (ns *Namespace) Attach(ctx context.Context, uname, aname string,
+	af AuthFile) (Dirent, error) {
+	root, err := ns.root.Attach(ctx, uname, aname, af)
+	if err != nil {
+		return nil, err
+	}
+	top := &nsEnt{ns: ns, uname: uname, aname: aname, af: af}
+	return top.resolve(ctx, "/", []nsMember{{root, true}})
+}
+
+// nsMember is a Dirent of a union, and whether it allows creation.
+type nsMember struct {
+	ent    Dirent
+	create bool
+}
+
+// nsEnt is a file of a Namespace. Files outside of union directories have
+// a single member.
+type nsEnt struct {
+	ns           *Namespace
+	uname, aname string
+	af           AuthFile // of the attach, for attaching again
+	path         string   // clean and slash-rooted
+	members      []nsMember
+}
+
+// at returns a file at p of the attach of ent, with no members.
+func (ent *nsEnt) at(p string) *nsEnt {
+	return &nsEnt{ns: ent.ns, uname: ent.uname, aname: ent.aname, af: ent.af,
+		path: p}
+}
+
+// resolve returns the file at p, given the members found below p before
+// any bind. It takes ownership of them.
+func (ent *nsEnt) resolve(ctx context.Context, p string,
+	under []nsMember) (*nsEnt, error) {
+	next := ent.at(p)
+
+	union := ent.ns.union(p)
+	if union == nil {
+		next.members, under = under, nil
+	}
+	for _, b := range union {
+		if b.fsys == nil {
+			next.members = append(next.members, under...)
+			under = nil
+			continue
+		}
+		d, err := b.fsys.Attach(ctx, ent.uname, ent.aname, ent.af)
+		if err != nil {
+			next.Clunk(ctx)
+			clunkAll(ctx, under)
+			return nil, err
+		}
+		next.members = append(next.members, nsMember{d, b.create})
+	}
+	clunkAll(ctx, under) // replaced
+
+	if len(next.members) == 0 {
+		return nil, ErrNotfound
+	}
+	return next, nil
+}
+
+// step walks ent to name, which is not "..".
+func (ent *nsEnt) step(ctx context.Context, name string) (*nsEnt, error) {
+	var under []nsMember
+	for _, m := range ent.members {
+		if !IsDir(m.ent) {
+			continue
+		}
+		qids, d, err := m.ent.Walk(ctx, name)
+		if err == nil && d != nil && len(qids) == 1 {
+			under = []nsMember{{d, true}}
+			break
+		}
+	}
+	return ent.resolve(ctx, path.Join(ent.path, name), under)
+}
+
+// lookup walks from the root of the namespace to p.
+func (ent *nsEnt) lookup(ctx context.Context, p string) (*nsEnt, error) {
+	root, err := ent.ns.root.Attach(ctx, ent.uname, ent.aname, ent.af)
+	if err != nil {
+		return nil, err
+	}
+	cur, err := ent.resolve(ctx, "/", []nsMember{{root, true}})
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(p, "/") {
+		if name == "" {
+			continue
+		}
+		next, err := cur.step(ctx, name)
+		cur.Clunk(ctx)
+		if err != nil {
+			return nil, err
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+func clunkAll(ctx context.Context, members []nsMember) {
+	for _, m := range members {
+		m.ent.Clunk(ctx)
+	}
+}
+
+func (ent *nsEnt) Qid() Qid {
+	return ent.members[0].ent.Qid()
+}
+
+// OpenDir lists the members of the union in order, dropping the names
+// already listed.
+func (ent *nsEnt) OpenDir(ctx context.Context) (ReadNext, error) {
+	var readers []ReadNext
+	for _, m := range ent.members {
+		if !IsDir(m.ent) {
+			continue
+		}
+		next, err := m.ent.OpenDir(ctx)
+		err = EnsureNonNil(next, err)
+		if err != nil {
+			return nil, err
+		}
+		readers = append(readers, next)
+	}
+
+	seen := make(map[string]struct{})
+	return func(ctx context.Context) ([]Dir, error) {
+		for len(readers) > 0 {
+			dirs, err := readers[0](ctx)
+			if err != nil {
+				return nil, err
+			}
+			if len(dirs) == 0 {
+				readers = readers[1:]
+				continue
+			}
+
+			var ret []Dir
+			for _, d := range dirs {
+				if _, ok := seen[d.Name]; !ok {
+					seen[d.Name] = struct{}{}
+					ret = append(ret, d)
+				}
+			}
+			if len(ret) > 0 {
+				return ret, nil
+			}
+		}
+		return nil, nil
+	}, nil
+}
+
+func (ent *nsEnt) Walk(ctx context.Context, names ...string) ([]Qid, Dirent, error) {
+	if len(names) == 0 {
+		next := ent.at(ent.path)
+		for _, m := range ent.members {
+			_, d, err := m.ent.Walk(ctx)
+			err = EnsureNonNil(d, err)
+			if err != nil {
+				next.Clunk(ctx)
+				return nil, nil, err
+			}
+			next.members = append(next.members, nsMember{d, m.create})
+		}
+		return nil, next, nil
+	}
+
+	qids := make([]Qid, 0, len(names))
+	cur := ent
+	for i, name := range names {
+		var next *nsEnt
+		var err error
+		if name == ".." {
+			next, err = cur.lookup(ctx, path.Dir(cur.path))
+		} else {
+			next, err = cur.step(ctx, name)
+		}
+		if cur != ent {
+			cur.Clunk(ctx)
+		}
+		if err != nil {
+			if i == 0 {
+				return nil, nil, err
+			}
+			return qids, ent, nil
+		}
+		cur = next
+		qids = append(qids, cur.Qid())
+	}
+	return qids, cur, nil
+}
+
+// Create makes the file in the first member allowing it.
+func (ent *nsEnt) Create(ctx context.Context, name string,
+	perm uint32, mode Flag) (Dirent, File, error) {
+	for i, m := range ent.members {
+		if !m.create || !IsDir(m.ent) {
+			continue
+		}
+		d, file, err := m.ent.Create(ctx, name, perm, mode)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// The parent is done with, as with a walk to the new file.
+		clunkAll(ctx, ent.members[:i])
+		clunkAll(ctx, ent.members[i+1:])
+		next := ent.at(path.Join(ent.path, name))
+		next.members = []nsMember{{d, true}}
+		return next, file, nil
+	}
+	return nil, nil, ErrNocreate
+}
+
+func (ent *nsEnt) Open(ctx context.Context, mode Flag) (File, error) {
+	return ent.members[0].ent.Open(ctx, mode)
+}
+
+// Remove removes the first member of the union.
+func (ent *nsEnt) Remove(ctx context.Context) error {
+	clunkAll(ctx, ent.members[1:])
+	return ent.members[0].ent.Remove(ctx)
+}
+
+func (ent *nsEnt) Clunk(ctx context.Context) error {
+	var err error
+	for _, m := range ent.members {
+		if cerr := m.ent.Clunk(ctx); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Stat returns the Dir of the first member, named after the path of the
+// file in the namespace, since bound trees are named "/".
+func (ent *nsEnt) Stat(ctx context.Context) (Dir, error) {
+	dir, err := ent.members[0].ent.Stat(ctx)
+	if err == nil {
+		dir.Name = path.Base(ent.path)
+	}
+	return dir, err
+}
+
+func (ent *nsEnt) WStat(ctx context.Context, dir Dir) error {
+	return ent.members[0].ent.WStat(ctx, dir)
+}
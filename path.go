@@ -108,13 +108,13 @@ func ToWalk(ent Dirent, p string) (isAbs bool, steps []string, err error) {
 
 	if isAbs {
 		if bsp != 0 {
-			return true, nil, MessageRerror{"invalid path: " + p}
+			return true, nil, MessageRerror{Ename: "invalid path: " + p}
 		}
 		return true, steps, nil
 	}
 
 	if bsp < 0 {
-		return false, nil, MessageRerror{"invalid path: " + p}
+		return false, nil, MessageRerror{Ename: "invalid path: " + p}
 	}
 
 	return false, steps, nil
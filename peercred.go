@@ -0,0 +1,111 @@
+package p9p
+
+import (
+	"context"
+	"os/user"
+	"strconv"
+)
+
+// PeerCred holds the credentials of the process at the other end of a unix
+// socket, as reported by the kernel when it connected.
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+
+	// The names of UID and GID, looked up once by ServeConn.
+	user, group string
+}
+
+// User returns the name of the user of the peer, or its uid in decimal if
+// it has no name.
+func (c PeerCred) User() string {
+	if c.user != "" {
+		return c.user
+	}
+	id := strconv.FormatUint(uint64(c.UID), 10)
+	if u, err := user.LookupId(id); err == nil {
+		return u.Username
+	}
+	return id
+}
+
+// Group returns the name of the group of the peer, or its gid in decimal if
+// it has no name.
+func (c PeerCred) Group() string {
+	if c.group != "" {
+		return c.group
+	}
+	id := strconv.FormatUint(uint64(c.GID), 10)
+	if g, err := user.LookupGroupId(id); err == nil {
+		return g.Name
+	}
+	return id
+}
+
+// withNames returns c with the names of its user and group looked up, so
+// that User and Group need not look them up again for every request.
+func (c PeerCred) withNames() PeerCred {
+	c.user, c.group = c.User(), c.Group()
+	return c
+}
+
+// PeerCredAuth wraps fsys to authenticate attaches by the credentials of
+// the client, see GetPeerCred, rather than by an auth protocol. Clients
+// whose credentials are unknown may not attach.
+//
+// The uname of an attach must be the name of the user of the client, or
+// the attach fails with ErrPerm. If rewrite is set, any uname is accepted
+// and replaced by that name instead. The gid of the client is not checked,
+// though fsys may find its name by the Group of GetPeerCred.
+//
+// SFileSys uses the name so checked as the user of the fid, see
+// UserMapper.
+func PeerCredAuth(fsys FileSys, rewrite bool) FileSys {
+	return peerCredFS{fsys, rewrite}
+}
+
+// UserMapper may be implemented by a FileSys deciding the user of the
+// auths and attaches made to it. SFileSys calls MapUser with the uname
+// given by the client, and uses the name returned in its place.
+type UserMapper interface {
+	MapUser(ctx context.Context, uname, aname string) (string, error)
+}
+
+type peerCredFS struct {
+	FileSys
+	rewrite bool
+}
+
+var _ UserMapper = peerCredFS{}
+
+func (fs peerCredFS) MapUser(ctx context.Context, uname,
+	aname string) (string, error) {
+	cred, ok := GetPeerCred(ctx)
+	if !ok {
+		return "", ErrPerm
+	}
+	name := cred.User()
+	if uname != name && !fs.rewrite {
+		return "", ErrPerm
+	}
+	return name, nil
+}
+
+func (fs peerCredFS) Auth(ctx context.Context, uname,
+	aname string) (AuthFile, error) {
+	uname, err := fs.MapUser(ctx, uname, aname)
+	if err != nil {
+		return nil, err
+	}
+	return fs.FileSys.Auth(ctx, uname, aname)
+}
+
+func (fs peerCredFS) Attach(ctx context.Context, uname, aname string,
+	af AuthFile) (Dirent, error) {
+	uname, err := fs.MapUser(ctx, uname, aname)
+	if err != nil {
+		return nil, err
+	}
+	return fs.FileSys.Attach(ctx, uname, aname, af)
+}
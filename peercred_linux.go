@@ -0,0 +1,31 @@
+//go:build linux
+// +build linux
+
+package p9p
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCred reads the credentials of the peer of a unix socket.
+func peerCred(cn net.Conn) (PeerCred, bool) {
+	uc, ok := cn.(*net.UnixConn)
+	if !ok {
+		return PeerCred{}, false
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return PeerCred{}, false
+	}
+
+	var ucred *syscall.Ucred
+	cerr := raw.Control(func(fd uintptr) {
+		ucred, err = syscall.GetsockoptUcred(int(fd),
+			syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if cerr != nil || err != nil {
+		return PeerCred{}, false
+	}
+	return PeerCred{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}, true
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package p9p
+
+import "net"
+
+// peerCred reports the credentials of a peer as unknown, SO_PEERCRED being
+// specific to Linux.
+func peerCred(cn net.Conn) (PeerCred, bool) {
+	return PeerCred{}, false
+}
@@ -0,0 +1,90 @@
+package p9p
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerCredAuth(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_PEERCRED is only read on linux")
+	}
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "sock"))
+	if !assert.Nil(err) {
+		return
+	}
+	defer l.Close()
+
+	for _, rewrite := range []bool{false, true} {
+		fs := &infoFS{calls: make(map[string]ctxInfo)}
+		cfs := &credFS{FileSys: fs}
+		handler := SSession(SFileSys(PeerCredAuth(cfs, rewrite)))
+		go func() {
+			sc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer sc.Close()
+			ServeConn(ctx, sc, handler)
+		}()
+
+		cc, err := net.Dial("unix", l.Addr().String())
+		if !assert.Nil(err) {
+			return
+		}
+		session, err := CSession(ctx, cc)
+		if !assert.Nil(err) {
+			return
+		}
+
+		name := PeerCred{UID: uint32(syscall.Getuid())}.User()
+		_, err = session.Attach(ctx, 0, NOFID, "glenda", "")
+		if rewrite {
+			assert.Nil(err)
+			assert.Equal(name, fs.calls["attach"].user)
+		} else {
+			assert.Equal(ErrPerm, err)
+		}
+		_, err = session.Attach(ctx, 1, NOFID, name, "")
+		assert.Nil(err)
+		cc.Close()
+
+		// The names were looked up when the client connected.
+		assert.Equal(uint32(syscall.Getgid()), cfs.cred.GID)
+		assert.Equal(name, cfs.cred.user)
+		assert.Equal(PeerCred{GID: cfs.cred.GID}.Group(), cfs.cred.group)
+	}
+
+	// Without credentials, nobody may attach.
+	cc, sc := net.Pipe()
+	go ServeConn(ctx, sc, SSession(SFileSys(PeerCredAuth(&infoFS{}, true))))
+	session, err := CSession(ctx, cc)
+	if !assert.Nil(err) {
+		return
+	}
+	_, err = session.Attach(ctx, 0, NOFID, "glenda", "")
+	assert.Equal(ErrPerm, err)
+}
+
+// credFS records the credentials of the client of its last attach.
+type credFS struct {
+	FileSys
+	cred PeerCred
+}
+
+func (fs *credFS) Attach(ctx context.Context, uname, aname string,
+	af AuthFile) (Dirent, error) {
+	fs.cred, _ = GetPeerCred(ctx)
+	return fs.FileSys.Attach(ctx, uname, aname, af)
+}
@@ -0,0 +1,263 @@
+package p9p
+
+import (
+	"context"
+	"time"
+)
+
+// MemberFunc reports whether the user uname is a member of group, for the
+// permission checks of WithPermissions.
+type MemberFunc func(ctx context.Context, uname, group string) bool
+
+// WithPermissions makes the session check the permissions of files itself,
+// rather than leaving it to the FileSys, following the owner, group and
+// other bits of their Dir.Mode as Plan 9 does. The user of a fid is the
+// uname given when attaching it.
+//
+// Walking from a directory requires execute permission on it. Opening
+// requires read, write or execute permission according to the mode, and
+// OTRUNC requires write permission. Creating, removing (including by
+// ORCLOSE) and renaming files require write permission on their directory.
+// Changing the mode, times, owner or group of a file is reserved to its
+// owner, and changing its length requires write permission.
+//
+// member decides group membership. If nil, users are only members of the
+// group named after them.
+func WithPermissions(member MemberFunc) SessionOption {
+	return func(sess *session) {
+		sess.checkPerms = true
+		sess.member = member
+	}
+}
+
+// allowed reports whether uname has all the permissions perm, made of
+// DMREAD, DMWRITE and DMEXEC, on the file described by dir. As in Plan 9,
+// the permissions of other, owner and group add up.
+func (sess *session) allowed(ctx context.Context, uname string,
+	dir Dir, perm uint32) bool {
+	m := dir.Mode & 7
+	if perm&m == perm {
+		return true
+	}
+	if dir.UID == uname {
+		m |= dir.Mode >> 6 & 7
+		if perm&m == perm {
+			return true
+		}
+	}
+	if sess.inGroup(ctx, uname, dir.GID) {
+		m |= dir.Mode >> 3 & 7
+		if perm&m == perm {
+			return true
+		}
+	}
+	return false
+}
+
+func (sess *session) inGroup(ctx context.Context, uname, group string) bool {
+	if group == "" {
+		return false
+	}
+	if sess.member == nil {
+		return uname == group
+	}
+	return sess.member(ctx, uname, group)
+}
+
+// access returns ErrPerm unless uname has the permissions perm on ent.
+func (sess *session) access(ctx context.Context, uname string,
+	ent Dirent, perm uint32) error {
+	if !sess.checkPerms {
+		return nil
+	}
+	dir, err := ent.Stat(ctx)
+	if err != nil {
+		return err
+	}
+	if !sess.allowed(ctx, uname, dir, perm) {
+		return ErrPerm
+	}
+	return nil
+}
+
+// parentAccess is access on the directory containing ref.Ent. Directories
+// find it by walking "..", and files keep it in ref.parent.
+func (sess *session) parentAccess(ctx context.Context, ref *SFid,
+	perm uint32) error {
+	if !sess.checkPerms {
+		return nil
+	}
+	if !IsDir(ref.Ent) {
+		if ref.parent == nil {
+			return ErrPerm
+		}
+		return sess.access(ctx, ref.uname, ref.parent, perm)
+	}
+
+	_, parent, err := ref.Ent.Walk(ctx, "..")
+	err = EnsureNonNil(parent, err)
+	if err != nil {
+		return err
+	}
+	defer parent.Clunk(ctx)
+	return sess.access(ctx, ref.uname, parent, perm)
+}
+
+// openPerm returns the permissions needed to open a file with mode.
+func openPerm(mode Flag) uint32 {
+	var perm uint32
+	switch mode & OEXEC {
+	case OREAD:
+		perm = DMREAD
+	case OWRITE:
+		perm = DMWRITE
+	case ORDWR:
+		perm = DMREAD | DMWRITE
+	case OEXEC:
+		perm = DMEXEC
+	}
+	if mode&OTRUNC != 0 {
+		perm |= DMWRITE
+	}
+	return perm
+}
+
+// checkOpen checks that the user of ref may open it with mode.
+func (sess *session) checkOpen(ctx context.Context, ref *SFid,
+	mode Flag) error {
+	if err := sess.access(ctx, ref.uname, ref.Ent, openPerm(mode)); err != nil {
+		return err
+	}
+	if mode&ORCLOSE != 0 {
+		return sess.parentAccess(ctx, ref, DMWRITE)
+	}
+	return nil
+}
+
+// checkWStat checks that the user of ref may make the changes in dir, see
+// stat(5).
+func (sess *session) checkWStat(ctx context.Context, ref *SFid,
+	dir Dir) error {
+	if !sess.checkPerms {
+		return nil
+	}
+	old, err := ref.Ent.Stat(ctx)
+	if err != nil {
+		return err
+	}
+
+	owner := old.UID == ref.uname
+	switch {
+	case dir.UID != "" && dir.UID != old.UID && !owner:
+		return ErrPerm
+	case dir.GID != "" && dir.GID != old.GID &&
+		!(owner && sess.inGroup(ctx, ref.uname, dir.GID)):
+		return ErrPerm
+	case (dir.Mode != ^uint32(0) || modTimeSet(dir.ModTime)) && !owner:
+		return ErrPerm
+	case dir.Length != ^uint64(0) && !sess.allowed(ctx, ref.uname, old, DMWRITE):
+		return ErrPerm
+	}
+	if dir.Name != "" && dir.Name != old.Name {
+		return sess.parentAccess(ctx, ref, DMWRITE)
+	}
+	return nil
+}
+
+// modTimeSet reports whether t asks WStat to change a time, rather than
+// being zero or the null value, ~0 seconds.
+func modTimeSet(t time.Time) bool {
+	return !t.IsZero() && t.Unix() != int64(^uint32(0))
+}
+
+// checkSetAttr checks that the user of ref may make the changes in attr.
+// As with utimensat(2), setting times to the current time only requires
+// write permission.
+func (sess *session) checkSetAttr(ctx context.Context, ref *SFid,
+	attr SetAttr) error {
+	if !sess.checkPerms {
+		return nil
+	}
+	old, err := ref.Ent.Stat(ctx)
+	if err != nil {
+		return err
+	}
+
+	ownerOnly := SetAttrMode | SetAttrUID | SetAttrGID |
+		SetAttrATimeSet | SetAttrMTimeSet
+	if attr.Valid&ownerOnly != 0 && old.UID != ref.uname {
+		return ErrPerm
+	}
+	writer := SetAttrSize | SetAttrATime | SetAttrMTime | SetAttrCTime
+	if attr.Valid&writer != 0 && old.UID != ref.uname &&
+		!sess.allowed(ctx, ref.uname, old, DMWRITE) {
+		return ErrPerm
+	}
+	return nil
+}
+
+// walk is Dirent.Walk on ref.Ent. When checking permissions, it walks one
+// name at a time, checking for execute permission on each directory. It
+// then also returns the directory containing ent, unless ent is a
+// directory itself, see SFid.parent.
+func (sess *session) walk(ctx context.Context, ref *SFid,
+	names []string) (qids []Qid, ent, parent Dirent, err error) {
+	if !sess.checkPerms {
+		qids, ent, err = ref.Ent.Walk(ctx, names...)
+		return qids, ent, nil, err
+	}
+
+	// After n steps, dir is owned by walk if n > 0, and parent if n > 1.
+	// Dirents may not be comparable, so ref.Ent is only known by n.
+	dir := ref.Ent
+	release := func(n int) {
+		if n > 0 {
+			dir.Clunk(ctx)
+		}
+		if n > 1 {
+			parent.Clunk(ctx)
+		}
+	}
+	for n, name := range names {
+		var q []Qid
+		var next Dirent
+		err = ErrWalknodir
+		if IsDir(dir) {
+			err = sess.access(ctx, ref.uname, dir, DMEXEC)
+		}
+		if err == nil {
+			q, next, err = dir.Walk(ctx, name)
+		}
+		if err != nil || len(q) != 1 || next == nil {
+			release(n)
+			// Only an error on the first name is reported.
+			if n > 0 {
+				err = nil
+			}
+			return qids, ref.Ent, nil, err
+		}
+		if n > 1 {
+			parent.Clunk(ctx)
+		}
+		parent, dir = dir, next
+		qids = append(qids, q[0])
+	}
+
+	n := len(names)
+	switch {
+	case IsDir(dir):
+		if n > 1 {
+			parent.Clunk(ctx)
+		}
+		parent = nil
+	case n == 1:
+		// ref.Ent stays with ref, so keep a clone of it.
+		_, parent, err = ref.Ent.Walk(ctx)
+		err = EnsureNonNil(parent, err)
+		if err != nil {
+			dir.Clunk(ctx)
+			return nil, nil, nil, err
+		}
+	}
+	return qids, dir, parent, nil
+}
@@ -0,0 +1,168 @@
+package p9p
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// DefaultWindow is the number of requests kept in flight by a PipelinedFile
+// when none is given.
+const DefaultWindow = 8
+
+// PipelinedFile adapts an open File to io.ReaderAt and io.WriterAt. Buffers
+// larger than the IOUnit of the File are split into IOUnit sized chunks,
+// which are read or written in parallel, with up to a window of requests in
+// flight at once. Over a client session, the requests are multiplexed on the
+// connection, so that a large copy is not one round trip at a time.
+//
+// Short reads and writes of a chunk are completed by further requests for
+// the remainder. As required by io.ReaderAt and io.WriterAt, a count less
+// than the buffer length comes with an error, which is io.EOF when a read
+// reaches the end of the file.
+type PipelinedFile struct {
+	ctx    context.Context
+	file   File
+	window int
+}
+
+var (
+	_ io.ReaderAt = &PipelinedFile{}
+	_ io.WriterAt = &PipelinedFile{}
+)
+
+// NewPipelinedFile returns a PipelinedFile for file, keeping up to window
+// requests in flight, or DefaultWindow if window is less than 1. All
+// requests are made with ctx.
+func NewPipelinedFile(ctx context.Context, file File, window int) *PipelinedFile {
+	if window < 1 {
+		window = DefaultWindow
+	}
+
+	return &PipelinedFile{
+		ctx:    ctx,
+		file:   file,
+		window: window,
+	}
+}
+
+// writeUnitter is implemented by Files whose writes carry less data than
+// their IOUnit, see fileRef.writeUnit.
+type writeUnitter interface {
+	writeUnit() int
+}
+
+func (pf *PipelinedFile) ReadAt(p []byte, offset int64) (int, error) {
+	return pf.pipeline(p, offset, pf.file.IOUnit(), pf.read)
+}
+
+func (pf *PipelinedFile) WriteAt(p []byte, offset int64) (int, error) {
+	unit := pf.file.IOUnit()
+	if w, ok := pf.file.(writeUnitter); ok {
+		unit = w.writeUnit()
+	}
+	return pf.pipeline(p, offset, unit, pf.write)
+}
+
+// read fills p with a single request, unless the reply is short.
+func (pf *PipelinedFile) read(p []byte, offset int64) (int, error) {
+	var n int
+	for n < len(p) {
+		m, err := pf.file.Read(pf.ctx, p[n:], offset+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// write writes p with a single request, unless the reply is short.
+func (pf *PipelinedFile) write(p []byte, offset int64) (int, error) {
+	var n int
+	for n < len(p) {
+		m, err := pf.file.Write(pf.ctx, p[n:], offset+int64(n))
+		n += m
+		if err == io.ErrShortWrite && m > 0 {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
+}
+
+// pipeline splits p into chunks of at most iounit bytes and calls op on
+// each, with up to pf.window calls running at once. The chunks after one
+// that comes back short are not started. The count returned covers the
+// chunks completed in a row from the start of p, and the error is the one
+// of the first short chunk.
+func (pf *PipelinedFile) pipeline(p []byte, offset int64, iounit int, op func([]byte, int64) (int, error)) (int, error) {
+	if iounit < 1 || len(p) <= iounit {
+		return op(p, offset)
+	}
+
+	nchunks := (len(p) + iounit - 1) / iounit
+	counts := make([]int, nchunks)
+	errs := make([]error, nchunks)
+	chunk := func(i int) []byte {
+		lo, hi := i*iounit, (i+1)*iounit
+		if hi > len(p) {
+			hi = len(p)
+		}
+		return p[lo:hi]
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		short = nchunks // the first chunk known to be short
+		slots = make(chan struct{}, pf.window)
+	)
+
+	for i := 0; i < nchunks; i++ {
+		slots <- struct{}{}
+
+		mu.Lock()
+		stop := i > short
+		mu.Unlock()
+		if stop {
+			break
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			buf := chunk(i)
+			counts[i], errs[i] = op(buf, offset+int64(i*iounit))
+			if counts[i] < len(buf) {
+				mu.Lock()
+				if i < short {
+					short = i
+				}
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var n int
+	for i := 0; i < nchunks; i++ {
+		n += counts[i]
+		if counts[i] < len(chunk(i)) {
+			return n, errs[i]
+		}
+	}
+	return n, nil
+}
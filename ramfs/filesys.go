@@ -56,6 +56,10 @@ func newDir(path uint64, fname string, uname string, mode uint32) p9p.Dir {
 		UID: uname,
 		GID: "users",
 		MUID: uname,
+		// Only sent to 9P2000.u clients, names have no numeric ids here.
+		NUID: p9p.NONUNAME,
+		NGID: p9p.NONUNAME,
+		NMUID: p9p.NONUNAME,
 	}
 
 	if dir.Mode & p9p.DMDIR > 0 {
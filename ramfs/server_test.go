@@ -1,8 +1,10 @@
 package ramfs
 
 import (
+	"errors"
 	"net"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -133,6 +135,235 @@ func TestServer(t *testing.T) {
 	wg.Wait()
 }
 
+/** Permissions are enforced by the session, for users attached on the same
+ *  connection.
+ */
+func TestPermissions(t *testing.T) {
+	var wg sync.WaitGroup
+	assert := assert.New(t)
+
+	ctx := context.Background()
+	sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+
+	// All files are in the group "users", which eve is not part of.
+	member := func(ctx context.Context, uname, group string) bool {
+		return group == "users" && uname != "eve"
+	}
+
+	reqC, repC := net.Pipe()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		session := p9p.SFileSys(NewServer(sctx), p9p.WithPermissions(member))
+		p9p.ServeConn(sctx, repC, p9p.SSession(session))
+	}()
+
+	session, err := p9p.CSession(ctx, reqC)
+	assert.Nil(err)
+
+	glenda, rob, eve := p9p.Fid(0), p9p.Fid(10), p9p.Fid(20)
+	for fid, uname := range map[p9p.Fid]string{glenda: "glenda", rob: "rob", eve: "eve"} {
+		_, err = session.Attach(ctx, fid, p9p.NOFID, uname, "/")
+		assert.Nil(err)
+	}
+	create := func(fid p9p.Fid, name string, perm uint32, names ...string) error {
+		defer session.Clunk(ctx, fid+1)
+		if _, err := session.Walk(ctx, fid, fid+1, names...); err != nil {
+			return err
+		}
+		_, _, err := session.Create(ctx, fid+1, name, perm, p9p.ORDWR)
+		return err
+	}
+
+	// The root belongs to root, but its group may write to it.
+	assert.Equal(p9p.ErrPerm, create(eve, "permtest", p9p.DMDIR|0755))
+	assert.Nil(create(glenda, "permtest", p9p.DMDIR|0755))
+	assert.Nil(create(glenda, "secret", 0600, "permtest"))
+	assert.Nil(create(glenda, "pub", 0644, "permtest"))
+	assert.Nil(create(glenda, "closed", p9p.DMDIR|0700, "permtest"))
+	assert.Nil(create(glenda, "x", 0644, "permtest", "closed"))
+
+	// Others may read pub, but neither write nor truncate it.
+	_, err = session.Walk(ctx, rob, rob+1, "permtest", "secret")
+	assert.Nil(err)
+	_, _, err = session.Open(ctx, rob+1, p9p.OREAD)
+	assert.Equal(p9p.ErrPerm, err)
+	assert.Nil(session.Clunk(ctx, rob+1))
+
+	_, err = session.Walk(ctx, rob, rob+1, "permtest", "pub")
+	assert.Nil(err)
+	_, _, err = session.Open(ctx, rob+1, p9p.OWRITE)
+	assert.Equal(p9p.ErrPerm, err)
+	_, _, err = session.Open(ctx, rob+1, p9p.OREAD|p9p.OTRUNC)
+	assert.Equal(p9p.ErrPerm, err)
+	_, _, err = session.Open(ctx, rob+1, p9p.OEXEC)
+	assert.Equal(p9p.ErrPerm, err)
+	_, _, err = session.Open(ctx, rob+1, p9p.OREAD)
+	assert.Nil(err)
+	assert.Nil(session.Clunk(ctx, rob+1))
+
+	// Only the owner may change the mode, and removing needs write
+	// permission on the directory. A failed remove still clunks.
+	_, err = session.Walk(ctx, rob, rob+1, "permtest", "pub")
+	assert.Nil(err)
+	assert.Equal(p9p.ErrPerm, session.WStat(ctx, rob+1,
+		p9p.Dir{Mode: 0666, Length: ^uint64(0)}))
+	assert.Equal(p9p.ErrPerm, session.Remove(ctx, rob+1))
+	_, err = session.Stat(ctx, rob+1)
+	assert.Equal(p9p.ErrUnknownfid, err)
+	assert.Equal(p9p.ErrPerm, create(rob, "new", 0644, "permtest"))
+
+	// Walking out of closed needs execute permission on it.
+	qids, err := session.Walk(ctx, rob, rob+1, "permtest", "closed", "x")
+	assert.Nil(err)
+	assert.Equal(2, len(qids))
+	_, err = session.Walk(ctx, glenda, glenda+1, "permtest", "closed", "x")
+	assert.Nil(err)
+	assert.Nil(session.Clunk(ctx, glenda+1))
+
+	// The owner may do all of the above.
+	_, err = session.Walk(ctx, glenda, glenda+1, "permtest", "pub")
+	assert.Nil(err)
+	assert.Nil(session.WStat(ctx, glenda+1, p9p.Dir{Mode: 0666, Length: ^uint64(0)}))
+	_, _, err = session.Open(ctx, glenda+1, p9p.OWRITE|p9p.OTRUNC|p9p.ORCLOSE)
+	assert.Nil(err)
+	assert.Nil(session.Clunk(ctx, glenda+1))
+
+	for _, names := range [][]string{
+		{"permtest", "pub"},
+		{"permtest", "closed", "x"},
+		{"permtest", "closed"},
+		{"permtest", "secret"},
+		{"permtest"},
+	} {
+		_, err = session.Walk(ctx, glenda, glenda+1, names...)
+		assert.Nil(err)
+		assert.Nil(session.Remove(ctx, glenda+1))
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+/** Renaming needs write permission on the directory actually holding the
+ *  file, not only on the one the client names as its parent.
+ */
+func TestRenamePermission(t *testing.T) {
+	var wg sync.WaitGroup
+	assert := assert.New(t)
+
+	ctx := context.Background()
+	sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+
+	member := func(ctx context.Context, uname, group string) bool {
+		return group == "users"
+	}
+
+	reqC, repC := net.Pipe()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		session := p9p.SFileSys(NewServer(sctx), p9p.WithPermissions(member))
+		p9p.ServeConn(sctx, repC, p9p.SSession(session))
+	}()
+
+	session, err := p9p.CSessionL(ctx, reqC)
+	if !assert.Nil(err) {
+		cancel()
+		wg.Wait()
+		return
+	}
+
+	glenda, rob := p9p.Fid(0), p9p.Fid(10)
+	for fid, uname := range map[p9p.Fid]string{glenda: "glenda", rob: "rob"} {
+		_, err = session.Attach(ctx, fid, p9p.NOFID, uname, "/")
+		assert.Nil(err)
+	}
+	_, err = session.Mkdir(ctx, glenda, "mine", 0755, 0)
+	assert.Nil(err)
+	_, err = session.Mkdir(ctx, glenda, "open", 0777, 0)
+	assert.Nil(err)
+	_, err = session.Walk(ctx, glenda, glenda+1, "open")
+	assert.Nil(err)
+	assert.Nil(session.SetAttr(ctx, glenda+1, p9p.SetAttr{
+		Valid: p9p.SetAttrMode, Mode: 0777}))
+	assert.Nil(session.Clunk(ctx, glenda+1))
+	_, err = session.Walk(ctx, glenda, glenda+1, "mine")
+	assert.Nil(err)
+	_, _, err = session.LCreate(ctx, glenda+1, "f", p9p.LORDWR, 0666, 0)
+	assert.Nil(err)
+	assert.Nil(session.Clunk(ctx, glenda+1))
+
+	// rob may write open, but not mine, which holds f.
+	_, err = session.Walk(ctx, rob, rob+1, "mine", "f")
+	assert.Nil(err)
+	_, err = session.Walk(ctx, rob, rob+2, "open")
+	assert.Nil(err)
+	err = session.Rename(ctx, rob+1, rob+2, "g")
+	assert.True(errors.Is(err, syscall.EACCES), "%v", err)
+
+	cancel()
+	wg.Wait()
+}
+
+// LCreate honors LOEXCL, and SetAttr fails on what WStat cannot change.
+func TestLCreateSetAttr(t *testing.T) {
+	var wg sync.WaitGroup
+	assert := assert.New(t)
+
+	ctx := context.Background()
+	sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+
+	reqC, repC := net.Pipe()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		session := p9p.SFileSys(NewServer(sctx))
+		p9p.ServeConn(sctx, repC, p9p.SSession(session))
+	}()
+
+	session, err := p9p.CSessionL(ctx, reqC)
+	if !assert.Nil(err) {
+		cancel()
+		wg.Wait()
+		return
+	}
+
+	root, fid := p9p.Fid(0), p9p.Fid(1)
+	_, err = session.Attach(ctx, root, p9p.NOFID, "glenda", "/")
+	assert.Nil(err)
+	for i, want := range []error{nil, syscall.EEXIST} {
+		_, err = session.Walk(ctx, root, fid)
+		assert.Nil(err)
+		_, _, err = session.LCreate(ctx, fid, "excl",
+			p9p.LORDWR|p9p.LOEXCL, 0644, 0)
+		if want == nil {
+			assert.Nil(err)
+		} else {
+			assert.True(errors.Is(err, want), "%d: %v", i, err)
+		}
+		assert.Nil(session.Clunk(ctx, fid))
+	}
+
+	_, err = session.Walk(ctx, root, fid, "excl")
+	assert.Nil(err)
+	assert.Nil(session.SetAttr(ctx, fid, p9p.SetAttr{
+		Valid: p9p.SetAttrMode | p9p.SetAttrCTime, Mode: 0600}))
+	for _, valid := range []uint32{
+		p9p.SetAttrUID,
+		p9p.SetAttrGID,
+		p9p.SetAttrATime,
+		p9p.SetAttrMTime | p9p.SetAttrMTimeSet,
+	} {
+		err = session.SetAttr(ctx, fid, p9p.SetAttr{Valid: valid})
+		assert.True(errors.Is(err, syscall.EOPNOTSUPP), "%#x: %v", valid, err)
+	}
+	assert.Nil(session.Clunk(ctx, fid))
+
+	cancel()
+	wg.Wait()
+}
+
 /* TODO: capture mkdir/walk session testing walk to ..
 mkdir a/b
 cd a
@@ -150,3 +381,24 @@ walk:  [..] [a] 0 1 [qid(dir, v=0, p=2)]
 walk:  [..] [a] 0 1 [qid(dir, v=0, p=2)]
 walk:  [.. c] [a c] 1 1 [qid(dir, v=0, p=2) qid(dir, v=0, p=4)]
 */
+
+/** The files have no numeric ids, which 9P2000.u would take for root's.
+ */
+func TestNumericIds(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	root, err := NewServer(ctx).Attach(ctx, "glenda", "/", nil)
+	if !assert.Nil(err) {
+		return
+	}
+	defer root.Clunk(ctx)
+	dir, err := root.Stat(ctx)
+	assert.Nil(err)
+
+	for _, dir := range []p9p.Dir{dir, newDir(2, "f", "glenda", 0644)} {
+		assert.Equal(p9p.NONUNAME, dir.NUID)
+		assert.Equal(p9p.NONUNAME, dir.NGID)
+		assert.Equal(p9p.NONUNAME, dir.NMUID)
+	}
+}
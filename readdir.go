@@ -1,14 +1,141 @@
 package p9p
 
 import (
+	"bytes"
 	"io"
 
 	"context"
 )
 
-// ReaddirAll reads all the directory entries for the resource fid.
-func ReaddirAll(session Session, fid Fid) ([]Dir, error) {
-	panic("not implemented")
+// ReaddirAll reads all the directory entries for the resource fid. The
+// directory is read through newfid, a clone of fid that is clunked before
+// returning, so fid is left as it was.
+func ReaddirAll(ctx context.Context, session Session, fid, newfid Fid) ([]Dir, error) {
+	if _, err := session.Walk(ctx, fid, newfid); err != nil {
+		return nil, err
+	}
+	defer session.Clunk(ctx, newfid)
+
+	_, iounit, err := session.Open(ctx, newfid, OREAD)
+	if err != nil {
+		return nil, err
+	}
+
+	dr, err := NewDirReader(session, newfid, int(iounit))
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []Dir
+	for {
+		next, err := dr.ReadDirs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(next) == 0 {
+			return dirs, nil
+		}
+		dirs = append(dirs, next...)
+	}
+}
+
+// DirReader helps one to implement the client-side of directory reads. It
+// decodes the entries of a directory one Tread at a time, so that a large
+// directory is never held in memory at once.
+type DirReader struct {
+	session Session
+	fid     Fid
+	codec   Codec
+	buf     []byte
+	offset  int64
+	dirs    []Dir // decoded but not yet returned by Next
+	done    bool
+}
+
+// NewDirReader returns a DirReader for fid, a directory open for reading.
+// Entries are decoded with the codec of the session version. Each Tread asks
+// for iounit bytes, or for as much as fits in a message if iounit is 0.
+func NewDirReader(session Session, fid Fid, iounit int) (*DirReader, error) {
+	msize, version := session.Version()
+	codec, err := NewCodecVersion(version)
+	if err != nil {
+		return nil, err
+	}
+
+	if iounit < 1 {
+		// size of message max minus fcall io header (Rread)
+		iounit = msize - 11
+	}
+
+	return &DirReader{
+		session: session,
+		fid:     fid,
+		codec:   codec,
+		buf:     make([]byte, iounit),
+	}, nil
+}
+
+// ReadDirs returns the entries not yet returned, reading them from the
+// directory if none are left. It implements ReadNext, returning no entries
+// at the end of the directory.
+func (dr *DirReader) ReadDirs(ctx context.Context) ([]Dir, error) {
+	if len(dr.dirs) > 0 {
+		dirs := dr.dirs
+		dr.dirs = nil
+		return dirs, nil
+	}
+	return dr.read(ctx)
+}
+
+// Next returns the next entry. It implements ReadNext1, returning io.EOF at
+// the end of the directory.
+func (dr *DirReader) Next(ctx context.Context) (Dir, error) {
+	for len(dr.dirs) == 0 {
+		dirs, err := dr.read(ctx)
+		if err != nil {
+			return Dir{}, err
+		}
+		if len(dirs) == 0 {
+			return Dir{}, io.EOF
+		}
+		dr.dirs = dirs
+	}
+
+	d := dr.dirs[0]
+	dr.dirs = dr.dirs[1:]
+	return d, nil
+}
+
+// read decodes the entries returned by a single Tread.
+func (dr *DirReader) read(ctx context.Context) ([]Dir, error) {
+	if dr.done {
+		return nil, nil
+	}
+
+	n, err := dr.session.Read(ctx, dr.fid, dr.buf, dr.offset)
+	if err != nil {
+		if err == io.EOF {
+			dr.done = true
+			return nil, nil
+		}
+		return nil, err
+	}
+	dr.offset += int64(n)
+
+	rd := bytes.NewReader(dr.buf[:n])
+	var dirs []Dir
+	for rd.Len() > 0 {
+		var d Dir
+		if err := DecodeDir(dr.codec, rd, &d); err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, d)
+	}
+
+	if len(dirs) == 0 {
+		dr.done = true
+	}
+	return dirs, nil
 }
 
 // Readdir helps one to implement the server-side of Session.Read on
@@ -10,23 +10,35 @@ import (
 	"context"
 )
 
-// TODO(stevvooe): Add net/http.Server-like type here to manage connections.
-// Coupled with Handler mux, we can get a very http-like experience for 9p
-// servers.
+// serverVersions lists the protocol versions offered by ServeConn to
+// handlers that do not implement Versioner, in order of preference.
+var serverVersions = []string{Version9P2000u, Version9P2000}
+
+// handlerVersions returns the versions and msize bounds offered for handler.
+func handlerVersions(handler Handler) VersionInfo {
+	if v, ok := handler.(Versioner); ok {
+		return v.Versions()
+	}
+	return VersionInfo{Versions: serverVersions}
+}
 
 // ServeConn the 9p handler over the provided network connection.
 // When the connection encounters an error or disconnects, this
 // returns the value of handler.Stop(err).
-// TODO(frobnitzem): Ensure unexpected version messages are handled correctly.
-func ServeConn(ctx context.Context, cn net.Conn, handler Handler) error {
-
-	// TODO(stevvooe): It would be nice if the handler could declare the
-	// supported version. Before we had handler, we used the session to get
-	// the version (msize, version := session.Version()).
-	// Version and message size decisions should be proxied all the way
-	// back to the origin server with declarative, set intersection logic.
+//
+// A later Tversion from the client resets the connection, see
+// conn.reset. The requests handled at once may be limited, see
+// WithMaxInflight and WithLimiter.
+func ServeConn(ctx context.Context, cn net.Conn, handler Handler, opts ...ServeOption) error {
+	var options serveOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
 
-	ch := newChannel(cn, codec9p{}, DefaultMSize)
+	// The handler declares the versions and msize it supports, see
+	// Versioner. Sessions forward these from their origin.
+	supported := handlerVersions(handler)
+	ch := newChannel(cn, codec9p{}, supported.maxMSize())
 	negctx, cancel := context.WithTimeout(ctx, 1*time.Second)
 	defer cancel()
 
@@ -34,34 +46,71 @@ func ServeConn(ctx context.Context, cn net.Conn, handler Handler) error {
 	// do this outside of this function and then pass in a ready made channel.
 	// We are not really ready to export the channel type yet.
 
-	if err := servernegotiate(negctx, ch, DefaultVersion); err != nil {
+	version, err := servernegotiate(negctx, ch, supported)
+	if err != nil {
 		// TODO(stevvooe): Need better error handling and retry support here.
-		return fmt.Errorf("error negotiating version: %s", err)
+		return handler.Stop(fmt.Errorf("error negotiating version: %s", err))
 	}
 
-	ctx = withVersion(ctx, DefaultVersion)
+	ctx = withRemoteAddr(ctx, cn.RemoteAddr())
+	if cred, ok := peerCred(cn); ok {
+		ctx = withPeerCred(ctx, cred.withNames())
+	}
+	ctx = withMSize(withVersion(ctx, version), ch.MSize())
+	if s, ok := handler.(Starter); ok {
+		s.Start(ctx)
+	}
 
 	c := &conn{
-		ctx:     ctx,
-		ch:      ch,
-		handler: handler,
-		closed:  make(chan struct{}),
+		ctx:       ctx,
+		ch:        ch,
+		handler:   handler,
+		supported: supported,
+		resumed:   make(chan struct{}),
+		closed:    make(chan struct{}),
+		shutdown:  options.shutdown,
+		limiter:   options.limiter,
+	}
+	if options.maxInflight > 0 {
+		c.slots = make(chan struct{}, options.maxInflight)
 	}
 
-	err := c.serve()
+	err = c.serve()
 	return handler.Stop(err)
 }
 
 // conn plays role of session dispatch for handler in a server.
 type conn struct {
-	ctx     context.Context
-	session Session
-	ch      Channel
-	handler Handler
+	ctx       context.Context
+	session   Session
+	ch        Channel
+	handler   Handler
+	supported VersionInfo
+
+	wmu     sync.Mutex    // held while writing to ch
+	resumed chan struct{} // lets read continue after a Tversion
 
 	once   sync.Once
 	closed chan struct{}
 	err    error // terminal error for the conn
+
+	shutdown <-chan struct{} // closed to drain the conn, may be nil
+
+	slots   chan struct{} // requests in flight, if limited
+	limiter *Limiter      // shared limit, may be nil
+}
+
+// Resetter is implemented by Handlers and Sessions holding state that must be
+// dropped when the client sends a new Tversion, such as fids.
+type Resetter interface {
+	Reset(ctx context.Context) error
+}
+
+// Starter is implemented by Handlers wanting to know when ServeConn starts
+// serving them, once the version is negotiated. Stop follows. Handlers used
+// by clients, see WithMiddleware, are never started.
+type Starter interface {
+	Start(ctx context.Context)
 }
 
 // activeRequest includes information about the active request.
@@ -84,9 +133,17 @@ func (tags reqMap) remove(t Tag) bool {
 }
 
 // serve messages on the connection until an error is encountered.
-// cancels all server callbacks when exiting
-func (c *conn) serve() error {
+// cancels all server callbacks when exiting, and closes the conn so that
+// the reader and writer stop too.
+func (c *conn) serve() (err error) {
 	tags := reqMap{} // active requests
+	ctx := c.ctx     // parent of request contexts, updated by resets
+	versioned := true
+	shutdown := c.shutdown
+	draining := false
+
+	// inflight counts the handler goroutines, waited for by resets.
+	var inflight sync.WaitGroup
 
 	requests := make(chan *Fcall)  // sync, read-limited
 	responses := make(chan *Fcall) // sync, goroutine consumed
@@ -100,18 +157,47 @@ func (c *conn) serve() error {
 		for _, active := range tags {
 			active.cancel()
 		}
+		c.CloseWithError(err)
 	}()
 
+	// drained hands the writer a nil response once the outstanding
+	// requests are answered. The writer takes it after writing every
+	// response before it, so that closing the conn loses none of them.
+	drained := func() error {
+		select {
+		case responses <- nil:
+			return ErrServerClosed
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		case <-c.closed:
+			return c.err
+		}
+	}
+
 	// read loop
-	go c.read(requests)
+	go c.read(requests, responses)
 	go c.write(responses)
 
 	for {
 		select {
+		case <-shutdown:
+			shutdown = nil // stop selecting it
+			draining = true
+			if len(tags) == 0 {
+				return drained()
+			}
 		case req := <-requests:
-			if _, ok := tags[req.Tag]; ok {
+			_, dup := tags[req.Tag]
+			_, flush := req.Message.(MessageTflush)
+			if dup || (draining && !flush) {
+				// Only flushes are served while draining.
+				err := ErrDuptag
+				if !dup {
+					err = ErrServerClosed
+				}
+				c.release(req)
 				select {
-				case responses <- newErrorFcall(req.Tag, ErrDuptag):
+				case responses <- newErrorFcall(req.Tag, err):
 					// Send to responses, bypass tag management.
 				case <-c.ctx.Done():
 					return c.ctx.Err()
@@ -121,7 +207,44 @@ func (c *conn) serve() error {
 				continue
 			}
 
+			if _, ok := req.Message.(MessageTversion); !ok && !versioned {
+				// After an "unknown" version, only Tversion is valid.
+				c.release(req)
+				select {
+				case responses <- newErrorFcall(req.Tag, ErrUnexpectedMsg):
+				case <-c.ctx.Done():
+					return c.ctx.Err()
+				case <-c.closed:
+					return c.err
+				}
+				continue
+			}
+
 			switch msg := req.Message.(type) {
+			case MessageTversion:
+				// version(5): "If a client has an outstanding request
+				// when it sends a version message, the server aborts all
+				// outstanding I/O and clunks all fids."
+				for tag, active := range tags {
+					active.cancel()
+					delete(tags, tag)
+				}
+				inflight.Wait()
+
+				version, err := c.reset(msg)
+				if err != nil {
+					return err
+				}
+				versioned = version != "unknown"
+				ctx = withMSize(withVersion(c.ctx, version), c.ch.MSize())
+
+				select {
+				case c.resumed <- struct{}{}:
+				case <-c.ctx.Done():
+					return c.ctx.Err()
+				case <-c.closed:
+					return c.err
+				}
 			case MessageTflush:
 				var resp *Fcall
 				if tags.remove(msg.Oldtag) {
@@ -138,10 +261,14 @@ func (c *conn) serve() error {
 				case <-c.closed:
 					return c.err
 				}
+				if draining && len(tags) == 0 {
+					return drained()
+				}
 			default:
 				// Allows us to session handlers to cancel processing of the fcall
 				// through context.
-				ctx, cancel := context.WithCancel(c.ctx)
+				fid, _ := msgFid(req.Message)
+				ctx, cancel := context.WithCancel(withRequest(ctx, req.Tag, fid))
 
 				// The contents of these instances are only writable in the main
 				// server loop. The value of tag will not change.
@@ -151,7 +278,10 @@ func (c *conn) serve() error {
 					cancel:  cancel,
 				}
 
+				inflight.Add(1)
 				go func(ctx context.Context, req *Fcall) {
+					defer inflight.Done()
+					defer c.release(req)
 					var resp *Fcall
 					msg, err := c.handler.Handle(ctx, req.Message)
 					if err != nil {
@@ -186,6 +316,9 @@ func (c *conn) serve() error {
 				// response should not be sent.
 			}
 			delete(tags, resp.Tag)
+			if draining && len(tags) == 0 {
+				return drained()
+			}
 		case <-c.ctx.Done():
 			return c.ctx.Err()
 		case <-c.closed:
@@ -194,8 +327,98 @@ func (c *conn) serve() error {
 	}
 }
 
-// read takes requests off the channel and sends them on requests.
-func (c *conn) read(requests chan *Fcall) {
+// read takes requests off the channel and sends them on requests. Counted
+// requests first wait in turn for a slot, see acquire. Reading goes on
+// meanwhile, so that flushes and versions are never held up behind them. A
+// flush of a waiting request drops it, and is answered here on responses, as
+// is a request reusing the tag of a waiting one.
+func (c *conn) read(requests, responses chan *Fcall) {
+	frames := make(chan *Fcall)
+	go c.readFrames(frames)
+
+	var (
+		waiting  []*Fcall           // counted requests, waiting for a slot
+		acquired chan error         // result of acquire for waiting[0]
+		cancel   context.CancelFunc // stops that acquire
+	)
+	// drop stops waiting for a slot for waiting[0].
+	drop := func() {
+		if acquired == nil {
+			return
+		}
+		cancel()
+		if err := <-acquired; err == nil {
+			c.release(waiting[0])
+		}
+		acquired = nil
+	}
+	defer drop()
+
+	for {
+		if len(waiting) > 0 && acquired == nil {
+			acquired, cancel = c.acquireAsync(waiting[0])
+		}
+
+		select {
+		case err := <-acquired:
+			acquired = nil
+			cancel()
+			if err != nil {
+				c.CloseWithError(err)
+				return
+			}
+			req := waiting[0]
+			waiting = waiting[1:]
+			if !c.forward(requests, req) {
+				c.release(req)
+				return
+			}
+		case req := <-frames:
+			if waitingIndex(waiting, req.Tag) >= 0 {
+				if !c.respond(responses, newErrorFcall(req.Tag, ErrDuptag)) {
+					return
+				}
+				continue
+			}
+
+			switch msg := req.Message.(type) {
+			case MessageTflush:
+				i := waitingIndex(waiting, msg.Oldtag)
+				if i < 0 {
+					break
+				}
+				if i == 0 {
+					drop()
+				}
+				waiting = append(waiting[:i], waiting[i+1:]...)
+				if !c.respond(responses, newFcall(req.Tag, MessageRflush{})) {
+					return
+				}
+				continue
+			case MessageTversion:
+				// The waiting requests are aborted with the others.
+				drop()
+				waiting = nil
+			default:
+				if c.slots != nil || c.limiter != nil {
+					waiting = append(waiting, req)
+					continue
+				}
+			}
+			if !c.forward(requests, req) {
+				return
+			}
+		case <-c.ctx.Done():
+			c.CloseWithError(c.ctx.Err())
+			return
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// readFrames reads the requests off the channel, and sends them on frames.
+func (c *conn) readFrames(frames chan *Fcall) {
 	for {
 		req := new(Fcall)
 		if err := c.ch.ReadFcall(c.ctx, req); err != nil {
@@ -213,26 +436,115 @@ func (c *conn) read(requests chan *Fcall) {
 		}
 
 		select {
-		case requests <- req:
+		case frames <- req:
 		case <-c.ctx.Done():
 			c.CloseWithError(c.ctx.Err())
 			return
 		case <-c.closed:
 			return
 		}
+
+		// The next message may use a different codec and msize, which
+		// are set by serve before it lets us continue.
+		if _, ok := req.Message.(MessageTversion); ok {
+			select {
+			case <-c.resumed:
+			case <-c.ctx.Done():
+				c.CloseWithError(c.ctx.Err())
+				return
+			case <-c.closed:
+				return
+			}
+		}
+	}
+}
+
+// acquireAsync runs acquire for req, returning its result and a function
+// stopping it.
+func (c *conn) acquireAsync(req *Fcall) (chan error, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(c.ctx)
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- c.acquire(ctx, req)
+	}()
+	return acquired, cancel
+}
+
+// forward sends req on to serve, reporting false if the conn is done.
+func (c *conn) forward(requests chan *Fcall, req *Fcall) bool {
+	select {
+	case requests <- req:
+		return true
+	case <-c.ctx.Done():
+		c.CloseWithError(c.ctx.Err())
+		return false
+	case <-c.closed:
+		return false
+	}
+}
+
+// respond sends resp to the writer, bypassing serve, reporting false if the
+// conn is done.
+func (c *conn) respond(responses chan *Fcall, resp *Fcall) bool {
+	select {
+	case responses <- resp:
+		return true
+	case <-c.ctx.Done():
+		c.CloseWithError(c.ctx.Err())
+		return false
+	case <-c.closed:
+		return false
+	}
+}
+
+// waitingIndex returns the position of the request with tag in waiting, or
+// -1.
+func waitingIndex(waiting []*Fcall, tag Tag) int {
+	for i, req := range waiting {
+		if req.Tag == tag {
+			return i
+		}
+	}
+	return -1
+}
+
+// reset handles a Tversion received after the initial negotiation. The
+// caller must have aborted the outstanding requests. The handler drops its
+// state, then the version and msize are negotiated anew, as with the first
+// Tversion. A version of "unknown" leaves the connection open, with no
+// session, waiting for another Tversion. This allows "tombstone" versions,
+// see channel.
+func (c *conn) reset(msg MessageTversion) (string, error) {
+	if r, ok := c.handler.(Resetter); ok {
+		if err := r.Reset(c.ctx); err != nil {
+			log.Printf("p9p: error resetting session: %v", err)
+		}
 	}
+
+	// Hold the writer off while the channel changes.
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	return serverversion(c.ctx, c.ch, msg, c.supported)
 }
 
 func (c *conn) write(responses chan *Fcall) {
 	for {
 		select {
 		case resp := <-responses:
+			if resp == nil { // drained, see serve
+				return
+			}
+
 			// TODO(stevvooe): Correctly protect againt overflowing msize from
 			// handler. This can be done above, in the main message handler
 			// loop, by adjusting incoming Tread calls to have a Count that
 			// won't overflow the msize.
 
-			if err := c.ch.WriteFcall(c.ctx, resp); err != nil {
+			c.wmu.Lock()
+			err := c.ch.WriteFcall(c.ctx, resp)
+			c.wmu.Unlock()
+			if err != nil {
 				if err, ok := err.(net.Error); ok {
 					if err.Timeout() || err.Temporary() {
 						// TODO(stevvooe): A full idle timeout on the
@@ -0,0 +1,286 @@
+package p9p
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server accepts 9p connections on listeners, and serves each one with its
+// own Handler, much as net/http.Server does for http.
+//
+// A Server must not be copied after first use. Once Shutdown or Close has
+// been called, the Server can not be reused.
+type Server struct {
+	// NewHandler returns the Handler serving a new connection. Handlers
+	// hold per-connection state, such as fids, so each connection has its
+	// own.
+	NewHandler func(ctx context.Context) (Handler, error)
+
+	// NewSession is used when NewHandler is nil. The connection is served
+	// by SSession of the Session returned.
+	NewSession func(ctx context.Context) (Session, error)
+
+	// BaseContext optionally returns the base context for the connections
+	// accepted on l. The default is context.Background().
+	BaseContext func(l net.Listener) context.Context
+
+	// ConnContext optionally modifies the context passed to NewHandler or
+	// NewSession, and used for the requests of c.
+	ConnContext func(ctx context.Context, c net.Conn) context.Context
+
+	// MaxInflight limits the requests handled at once on each connection,
+	// and MaxInflightTotal those on all connections, see WithMaxInflight.
+	// Zero means no limit. They must be set before serving.
+	MaxInflight      int
+	MaxInflightTotal int
+
+	// ErrorLog receives the errors accepting and serving connections. If
+	// nil, the standard logger of the log package is used.
+	ErrorLog *log.Logger
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[net.Conn]struct{}
+	inShutdown bool
+	shutdown   chan struct{} // closed by Shutdown and Close
+	limiter    *Limiter      // for MaxInflightTotal
+}
+
+// shutdownPollInterval is how often Shutdown checks for connections left.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// ListenAndServe listens on addr and calls Serve. The addr is a tcp
+// address, or a unix socket path prefixed with "unix:".
+func (s *Server) ListenAndServe(addr string) error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+
+	proto := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		proto = "unix"
+		addr = addr[5:]
+	}
+
+	l, err := net.Listen(proto, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l, serving each in a new goroutine. Serve
+// closes l when it returns. After Shutdown or Close, the error returned is
+// ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	if !s.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+
+	ctx := context.Background()
+	if s.BaseContext != nil {
+		ctx = s.BaseContext(l)
+	}
+
+	var delay time.Duration // backoff after temporary accept errors
+	for {
+		cn, err := l.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				s.logf("p9p: error accepting: %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+
+		go s.serve(ctx, cn)
+	}
+}
+
+// serve serves a single connection, and closes it.
+func (s *Server) serve(ctx context.Context, cn net.Conn) {
+	defer cn.Close()
+	if !s.trackConn(cn, true) {
+		return
+	}
+	defer s.trackConn(cn, false)
+
+	if s.ConnContext != nil {
+		ctx = s.ConnContext(ctx, cn)
+	}
+
+	handler, err := s.newHandler(ctx)
+	if err != nil {
+		s.logf("p9p: error starting session for %v: %v", cn.RemoteAddr(), err)
+		return
+	}
+
+	opts := []ServeOption{withShutdown(s.shutdown)}
+	if s.MaxInflight > 0 {
+		opts = append(opts, WithMaxInflight(s.MaxInflight))
+	}
+	if s.limiter != nil {
+		opts = append(opts, WithLimiter(s.limiter))
+	}
+	err = ServeConn(ctx, cn, handler, opts...)
+	if err != nil && !errors.Is(err, ErrServerClosed) && !s.shuttingDown() {
+		s.logf("p9p: error serving %v: %v", cn.RemoteAddr(), err)
+	}
+}
+
+func (s *Server) newHandler(ctx context.Context) (Handler, error) {
+	if s.NewHandler != nil {
+		return s.NewHandler(ctx)
+	}
+	if s.NewSession != nil {
+		session, err := s.NewSession(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return SSession(session), nil
+	}
+	return nil, errors.New("p9p: Server has neither NewHandler nor NewSession")
+}
+
+// Shutdown stops the Server gracefully. It closes the listeners, then
+// waits for each connection to answer its outstanding requests, and closes
+// it. Requests arriving in the meantime are refused with ErrServerClosed.
+//
+// If ctx ends first, Shutdown returns its error, leaving the remaining
+// connections open. Close can then be used to end them.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.closeListeners()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.numConns() == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops the Server immediately, closing its listeners and
+// connections. Outstanding requests are abandoned.
+func (s *Server) Close() error {
+	err := s.closeListeners()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for cn := range s.conns {
+		cn.Close()
+		delete(s.conns, cn)
+	}
+	return err
+}
+
+// closeListeners starts the shutdown, and closes the listeners.
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.inShutdown {
+		s.inShutdown = true
+		s.init()
+		close(s.shutdown)
+	}
+
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.listeners, l)
+	}
+	return err
+}
+
+// init allocates the fields of s. Must be called with s.mu held.
+func (s *Server) init() {
+	if s.shutdown == nil {
+		s.listeners = make(map[net.Listener]struct{})
+		s.conns = make(map[net.Conn]struct{})
+		s.shutdown = make(chan struct{})
+		if s.MaxInflightTotal > 0 {
+			s.limiter = NewLimiter(s.MaxInflightTotal)
+		}
+	}
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inShutdown
+}
+
+func (s *Server) numConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// trackListener adds or removes l. Adding fails once the Server is
+// shutting down.
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if s.inShutdown {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+// trackConn adds or removes cn. Adding fails once the Server is shutting
+// down.
+func (s *Server) trackConn(cn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+
+	if !add {
+		delete(s.conns, cn)
+		return true
+	}
+	if s.inShutdown {
+		return false
+	}
+	s.conns[cn] = struct{}{}
+	return true
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,316 @@
+package p9p
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+// SessionL extends Session with the operations added by 9P2000.L.
+// Sessions implementing it are offered the 9P2000.L version during
+// negotiation. Plain 9P2000 requests (Twalk, Tread, Tclunk, ...) are still
+// dispatched to the Session methods.
+type SessionL interface {
+	Session
+
+	// LOpen and LCreate take Linux open(2) flags, see FlagFromL.
+	LOpen(ctx context.Context, fid Fid, flags uint32) (Qid, uint32, error)
+	LCreate(ctx context.Context, parent Fid, name string, flags, mode, gid uint32) (Qid, uint32, error)
+
+	GetAttr(ctx context.Context, fid Fid, mask uint64) (Attr, error)
+	SetAttr(ctx context.Context, fid Fid, attr SetAttr) error
+
+	// Readdir returns entries starting after the entry with the given
+	// offset (zero to start at the beginning). The encoded entries must not
+	// exceed count bytes, see ReaddirEntry.Size.
+	Readdir(ctx context.Context, fid Fid, offset uint64, count uint32) ([]ReaddirEntry, error)
+
+	Mkdir(ctx context.Context, dfid Fid, name string, mode, gid uint32) (Qid, error)
+	Symlink(ctx context.Context, dfid Fid, name, target string, gid uint32) (Qid, error)
+	Readlink(ctx context.Context, fid Fid) (string, error)
+	Rename(ctx context.Context, fid, dfid Fid, name string) error
+	Renameat(ctx context.Context, olddfid Fid, oldname string, newdfid Fid, newname string) error
+	Unlinkat(ctx context.Context, dfid Fid, name string, flags uint32) error
+
+	Fsync(ctx context.Context, fid Fid, datasync bool) error
+	StatFS(ctx context.Context, fid Fid) (StatFS, error)
+
+	// XattrWalk prepares newfid to read the extended attribute name of fid
+	// (or the list of attributes, if name is empty), returning its size.
+	XattrWalk(ctx context.Context, fid, newfid Fid, name string) (uint64, error)
+
+	Lock(ctx context.Context, fid Fid, lock Lock) (uint8, error)
+	GetLock(ctx context.Context, fid Fid, lock Lock) (Lock, error)
+}
+
+// Bits of Attr.Valid and the Tgetattr request mask.
+const (
+	AttrMode        uint64 = 0x00000001
+	AttrNLink       uint64 = 0x00000002
+	AttrUID         uint64 = 0x00000004
+	AttrGID         uint64 = 0x00000008
+	AttrRDev        uint64 = 0x00000010
+	AttrATime       uint64 = 0x00000020
+	AttrMTime       uint64 = 0x00000040
+	AttrCTime       uint64 = 0x00000080
+	AttrIno         uint64 = 0x00000100
+	AttrSize        uint64 = 0x00000200
+	AttrBlocks      uint64 = 0x00000400
+	AttrBTime       uint64 = 0x00000800
+	AttrGen         uint64 = 0x00001000
+	AttrDataVersion uint64 = 0x00002000
+
+	AttrBasic uint64 = 0x000007ff // everything stat(2) returns
+	AttrAll   uint64 = 0x00003fff
+)
+
+// Attr holds the file attributes returned by Rgetattr. Mode uses the Linux
+// st_mode encoding, including the file type bits.
+type Attr struct {
+	Valid       uint64
+	Qid         Qid
+	Mode        uint32
+	UID         uint32
+	GID         uint32
+	NLink       uint64
+	RDev        uint64
+	Size        uint64
+	BlkSize     uint64
+	Blocks      uint64
+	ATimeSec    uint64
+	ATimeNsec   uint64
+	MTimeSec    uint64
+	MTimeNsec   uint64
+	CTimeSec    uint64
+	CTimeNsec   uint64
+	BTimeSec    uint64
+	BTimeNsec   uint64
+	Gen         uint64
+	DataVersion uint64
+}
+
+// Bits of SetAttr.Valid.
+const (
+	SetAttrMode     uint32 = 0x00000001
+	SetAttrUID      uint32 = 0x00000002
+	SetAttrGID      uint32 = 0x00000004
+	SetAttrSize     uint32 = 0x00000008
+	SetAttrATime    uint32 = 0x00000010
+	SetAttrMTime    uint32 = 0x00000020
+	SetAttrCTime    uint32 = 0x00000040
+	SetAttrATimeSet uint32 = 0x00000080 // use ATimeSec, not the current time
+	SetAttrMTimeSet uint32 = 0x00000100 // use MTimeSec, not the current time
+)
+
+// SetAttr holds the changes requested by Tsetattr. Only fields flagged in
+// Valid are to be applied.
+type SetAttr struct {
+	Valid     uint32
+	Mode      uint32
+	UID       uint32
+	GID       uint32
+	Size      uint64
+	ATimeSec  uint64
+	ATimeNsec uint64
+	MTimeSec  uint64
+	MTimeNsec uint64
+}
+
+// StatFS describes a file system, following statfs(2).
+type StatFS struct {
+	Type    uint32
+	BSize   uint32
+	Blocks  uint64
+	BFree   uint64
+	BAvail  uint64
+	Files   uint64
+	FFree   uint64
+	FSID    uint64
+	NameLen uint32
+}
+
+// V9FSMagic is the statfs(2) file system type of a v9fs mount.
+const V9FSMagic = 0x01021997
+
+// Lock types, statuses and flags for Tlock and Tgetlock.
+const (
+	LockTypeRdlck uint8 = 0
+	LockTypeWrlck uint8 = 1
+	LockTypeUnlck uint8 = 2
+
+	LockSuccess uint8 = 0
+	LockBlocked uint8 = 1
+	LockError   uint8 = 2
+	LockGrace   uint8 = 3
+
+	LockFlagsBlock   uint32 = 1
+	LockFlagsReclaim uint32 = 2
+)
+
+// Lock describes a POSIX byte range lock. Flags is unused by Tgetlock.
+type Lock struct {
+	Type     uint8
+	Flags    uint32
+	Start    uint64
+	Length   uint64
+	ProcID   uint32
+	ClientID string
+}
+
+// AtRemoveDir is set in the Tunlinkat flags to remove a directory.
+const AtRemoveDir = 0x200
+
+// Linux open(2) flags used by Tlopen and Tlcreate.
+const (
+	LOWRONLY = 0x1
+	LORDWR   = 0x2
+	LOCREAT  = 0x40
+	LOEXCL   = 0x80
+	LOTRUNC  = 0x200
+	LOAPPEND = 0x400
+)
+
+// FlagFromL converts Linux open(2) flags to the 9P2000 open mode.
+func FlagFromL(flags uint32) Flag {
+	var mode Flag
+	switch flags & 3 {
+	case LOWRONLY:
+		mode = OWRITE
+	case LORDWR:
+		mode = ORDWR
+	default:
+		mode = OREAD
+	}
+
+	if flags&LOTRUNC != 0 {
+		mode |= OTRUNC
+	}
+	return mode
+}
+
+// Linux st_mode file type bits, used by Attr.Mode.
+const (
+	SIFMT   = 0170000
+	SIFSOCK = 0140000
+	SIFLNK  = 0120000
+	SIFREG  = 0100000
+	SIFBLK  = 0060000
+	SIFDIR  = 0040000
+	SIFCHR  = 0020000
+	SIFIFO  = 0010000
+	SISUID  = 0004000
+	SISGID  = 0002000
+	SISVTX  = 0001000
+)
+
+// ModeFromDir converts a Dir.Mode to a Linux st_mode.
+func ModeFromDir(mode uint32) uint32 {
+	m := mode & 0777
+	switch {
+	case mode&DMDIR != 0:
+		m |= SIFDIR
+	case mode&DMSYMLINK != 0:
+		m |= SIFLNK
+	case mode&DMSOCKET != 0:
+		m |= SIFSOCK
+	case mode&DMNAMEDPIPE != 0:
+		m |= SIFIFO
+	case mode&DMDEVICE != 0:
+		m |= SIFCHR
+	default:
+		m |= SIFREG
+	}
+
+	if mode&DMSETUID != 0 {
+		m |= SISUID
+	}
+	if mode&DMSETGID != 0 {
+		m |= SISGID
+	}
+	return m
+}
+
+// ModeToDir converts a Linux st_mode to a Dir.Mode.
+func ModeToDir(mode uint32) uint32 {
+	m := mode & 0777
+	switch mode & SIFMT {
+	case SIFDIR:
+		m |= DMDIR
+	case SIFLNK:
+		m |= DMSYMLINK
+	case SIFSOCK:
+		m |= DMSOCKET
+	case SIFIFO:
+		m |= DMNAMEDPIPE
+	case SIFCHR, SIFBLK:
+		m |= DMDEVICE
+	}
+
+	if mode&SISUID != 0 {
+		m |= DMSETUID
+	}
+	if mode&SISGID != 0 {
+		m |= DMSETGID
+	}
+	return m
+}
+
+// ReaddirEntry is one directory entry returned by Treaddir. Offset is the
+// value to pass to Treaddir in order to continue after this entry.
+type ReaddirEntry struct {
+	Qid    Qid
+	Offset uint64
+	Type   uint8 // dirent(5) d_type
+	Name   string
+}
+
+// Size returns the number of bytes the entry uses in an Rreaddir.
+func (e ReaddirEntry) Size() int {
+	return 13 + 8 + 1 + 2 + len(e.Name)
+}
+
+// dirent(5) types for ReaddirEntry.Type.
+const (
+	dtDir = 4
+	dtReg = 8
+	dtLnk = 10
+)
+
+// direntType guesses the d_type of a directory entry from its Qid.
+func direntType(qid Qid) uint8 {
+	switch {
+	case qid.Type&QTDIR != 0:
+		return dtDir
+	case qid.Type&QTSYMLINK != 0:
+		return dtLnk
+	}
+	return dtReg
+}
+
+// encodeReaddir packs entries into the data of an Rreaddir.
+func encodeReaddir(entries []ReaddirEntry) ([]byte, error) {
+	var b bytes.Buffer
+	enc := &encoder{wr: &b}
+	for _, e := range entries {
+		if err := enc.encode(e.Qid, e.Offset, e.Type, e.Name); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// decodeReaddir unpacks the data of an Rreaddir.
+func decodeReaddir(p []byte) ([]ReaddirEntry, error) {
+	var entries []ReaddirEntry
+	dec := &decoder{rd: bytes.NewReader(p)}
+	for {
+		var e ReaddirEntry
+		if err := dec.decode(&e.Qid, &e.Offset, &e.Type, &e.Name); err != nil {
+			if err == io.EOF {
+				return entries, nil
+			}
+			return entries, err
+		}
+		entries = append(entries, e)
+	}
+}
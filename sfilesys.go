@@ -3,6 +3,7 @@ package p9p
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 )
 
 // TODO(frobnitzem): Make these methods return errors
@@ -42,11 +43,35 @@ type SFid struct {
 	// If modified by the server, changes will only
 	// apply to future Walk/Create-s from this Ent.
 	Mode Flag // Defined if Open-ed.
+
+	auth   AuthFile // set on auth fids, which have no Ent
+	uname  string   // user given at Attach, see GetUser
+	aname  string   // and the tree attached, see GetAname
+	parent Dirent   // directory containing a non-directory Ent, if known
+
+	dirents []Dir // Directory listing cached by 9P2000.L Readdir.
 }
 
 type session struct {
 	fs   FileSys
 	refs sync.Map // type [Fid](*SFid)
+
+	nfids   int64 // entries in refs, updated atomically
+	maxFids int64 // limit on nfids, if > 0
+
+	checkPerms bool       // see WithPermissions
+	member     MemberFunc // group membership, if checkPerms
+}
+
+// SessionOption configures a session returned by SFileSys.
+type SessionOption func(*session)
+
+// WithMaxFids limits the fids in use at once on the session to n. Past the
+// limit, requests creating fids fail with ErrNofids.
+func WithMaxFids(n int) SessionOption {
+	return func(sess *session) {
+		sess.maxFids = int64(n)
+	}
 }
 
 // TODO(frobnitzem): validate required server returns to ensure non-nil.
@@ -72,22 +97,33 @@ func EnsureNonNil(x interface{}, err error) error {
 //	For example, p9p/ufs translates all fid-s using sess.getRef(fid)
 //	and https://9fans.github.io/usr/local/plan9/src/cmd/ramfs.c
 //	uses user-defined structs for Fid-s.
-func SFileSys(fs FileSys) Session {
-	return &session{
+func SFileSys(fs FileSys, opts ...SessionOption) Session {
+	sess := &session{
 		fs: fs,
 	}
+	for _, opt := range opts {
+		opt(sess)
+	}
+	return sess
 }
 
 func (sess *session) Stop(err error) error {
-	ctx := CancelledCtxt{}
+	sess.clunkAll(CancelledCtxt{})
+	return err
+}
+
+// Reset clunks all fids, as a new Tversion starts a new session.
+func (sess *session) Reset(ctx context.Context) error {
+	sess.clunkAll(ctx)
+	return nil
+}
+
+// clunkAll closes and clunks every fid, ignoring errors.
+func (sess *session) clunkAll(ctx context.Context) {
 	sess.refs.Range(func(fid, ref1 interface{}) bool {
-		ref, ok := ref1.(*SFid)
-		if ok && ref.Ent != nil { // close and clunk
-			delRefAction(ctx, ref, false)
-		}
+		sess.delRef(ctx, fid.(Fid), false)
 		return true
 	})
-	return err
 }
 
 // Acquires a lock on the SFid just after successful lookup.
@@ -114,6 +150,34 @@ func (sess *session) getRef(fid Fid) (*SFid, error) {
 	return ref, nil
 }
 
+// getAuthRef is getRef, also accepting the auth fids, on which only
+// Read, Write and Clunk may be called.
+func (sess *session) getAuthRef(fid Fid) (*SFid, error) {
+	if fid == NOFID {
+		return nil, ErrUnknownfid
+	}
+
+	ref1, found := sess.refs.Load(fid)
+	if !found {
+		return nil, ErrUnknownfid
+	}
+	ref, _ := ref1.(*SFid)
+
+	ref.Lock()
+	if ref.Ent == nil && ref.auth == nil {
+		ref.Unlock()
+		return nil, ErrUnknownfid
+	}
+
+	return ref, nil
+}
+
+// Returns ctx, carrying the identity of ref for the
+// calls on its Dirent and File.
+func (ref *SFid) context(ctx context.Context) context.Context {
+	return withIdentity(ctx, ref.uname, ref.aname)
+}
+
 // Sets ref.Ent (could also informs the ent of ref.)
 func (ref *SFid) link(ent Dirent) {
 	ref.Ent = ent
@@ -149,10 +213,21 @@ func (sess *session) newRef(fid Fid) (ref *SFid, err error) {
 		//ref.Unlock() not needed
 		return nil, ErrDupfid
 	}
+	if n := atomic.AddInt64(&sess.nfids, 1); sess.maxFids > 0 && n > sess.maxFids {
+		sess.forget(fid)
+		return nil, ErrNofids
+	}
 
 	return ref, nil
 }
 
+// forget deletes fid from the refs table, without clunking it.
+func (sess *session) forget(fid Fid) {
+	if _, found := sess.refs.LoadAndDelete(fid); found {
+		atomic.AddInt64(&sess.nfids, -1)
+	}
+}
+
 // Delete reference from the refs table.
 // If remove is true, calls Dirent.Remove.
 // Otherwise, calls Dirent.Clunk.
@@ -163,15 +238,30 @@ func (sess *session) delRef(ctx context.Context, fid Fid,
 	if !found {
 		return ErrUnknownfid
 	}
+	atomic.AddInt64(&sess.nfids, -1)
 	ref, _ := ref1.(*SFid)
 
 	ref.Lock()
 	defer ref.Unlock()
+	ctx = ref.context(ctx)
+	if ref.auth != nil {
+		err := ref.auth.Close(ctx)
+		ref.auth = nil
+		ref.File = nil
+		return err
+	}
 	if ref.Ent == nil {
 		return nil
 	}
 
-	return delRefAction(ctx, ref, remove)
+	// A remove that is not permitted still clunks the fid.
+	var err error
+	if remove {
+		if err = sess.parentAccess(ctx, ref, DMWRITE); err != nil {
+			remove = false
+		}
+	}
+	return combine_errors(err, delRefAction(ctx, ref, remove))
 }
 
 func combine_errors(err, err2 error) error {
@@ -193,6 +283,10 @@ func delRefAction(ctx context.Context, ref *SFid, remove bool) error {
 		err2 = ref.Ent.Clunk(ctx)
 	}
 	ref.Ent = nil
+	if ref.parent != nil {
+		ref.parent.Clunk(ctx)
+		ref.parent = nil
+	}
 	return combine_errors(err, err2)
 }
 
@@ -207,6 +301,11 @@ func (sess *session) Auth(ctx context.Context, afid Fid,
 	if afid == NOFID { // not in spec, but treat as a no-op
 		return aq, nil
 	}
+	uname, err := sess.mapUser(ctx, uname, aname)
+	if err != nil {
+		return aq, err
+	}
+	ctx = withIdentity(ctx, uname, aname)
 	if !sess.fs.RequireAuth(ctx) {
 		return aq, MessageRerror{Ename: "no auth"}
 	}
@@ -219,11 +318,14 @@ func (sess *session) Auth(ctx context.Context, afid Fid,
 
 	afile, err := sess.fs.Auth(ctx, uname, aname)
 	if err != nil { // need to re-acquire session lock to delete
-		sess.refs.Delete(afid)
+		sess.forget(afid)
 		return aq, err
 	}
-	//file, _ := afile.(File)
+	aref.auth = afile
 	aref.File = afile
+	aref.Mode = ORDWR
+	aref.uname = uname
+	aref.aname = aname
 
 	return aq, err
 }
@@ -236,23 +338,23 @@ func (sess *session) Attach(ctx context.Context, fid, afid Fid,
 	//}
 
 	var af AuthFile
+	uname, err := sess.mapUser(ctx, uname, aname)
+	if err != nil {
+		return Qid{}, err
+	}
+	ctx = withIdentity(ctx, uname, aname)
 
 	if afid != NOFID {
-		var aref *SFid
-		var ok bool
-		var err error
-
-		aref, err = sess.getRef(afid)
-		if err != nil || aref.File == nil {
-			return Qid{}, ErrUnknownfid
+		aref, err := sess.getAuthRef(afid)
+		if err != nil {
+			return Qid{}, err
 		}
 		defer aref.Unlock()
 
-		af, ok = aref.File.(AuthFile)
-		if !ok {
+		af = aref.auth
+		if af == nil {
 			return Qid{}, ErrUnknownfid
 		}
-
 		if !af.Success() {
 			return Qid{}, ErrPerm
 		}
@@ -266,14 +368,26 @@ func (sess *session) Attach(ctx context.Context, fid, afid Fid,
 
 	ent, err := sess.fs.Attach(ctx, uname, aname, af)
 	if err != nil {
-		sess.refs.Delete(fid)
+		sess.forget(fid)
 		return Qid{}, err
 	}
 	ref.link(ent)
+	ref.uname = uname
+	ref.aname = aname
 
 	return ent.Qid(), nil
 }
 
+// mapUser returns the user an auth or attach by uname is made as, see
+// UserMapper.
+func (sess *session) mapUser(ctx context.Context, uname,
+	aname string) (string, error) {
+	if um, ok := sess.fs.(UserMapper); ok {
+		return um.MapUser(ctx, uname, aname)
+	}
+	return uname, nil
+}
+
 func (sess *session) Clunk(ctx context.Context, fid Fid) error {
 	return sess.delRef(ctx, fid, false)
 }
@@ -290,7 +404,8 @@ func (sess *session) Walk(ctx context.Context, fid Fid, newfid Fid,
 		return nil, MessageRerror{Ename: "Non-normalized path"}
 	}
 	var qids []Qid
-	var ent Dirent // the newly discovered ent
+	var ent Dirent    // the newly discovered ent
+	var parent Dirent // and its directory, see SFid.parent
 
 	var newref *SFid
 
@@ -298,6 +413,7 @@ func (sess *session) Walk(ctx context.Context, fid Fid, newfid Fid,
 	if err != nil {
 		return nil, err
 	}
+	ctx = ref.context(ctx)
 
 	// lookup ref. from inside the clean-up function
 	defer func() {
@@ -306,7 +422,7 @@ func (sess *session) Walk(ctx context.Context, fid Fid, newfid Fid,
 		// the function returns (or else it's deleted)
 		// (we'll swap it with ref if/when needed)
 		if newref != nil {
-			sess.refs.Delete(newfid)
+			sess.forget(newfid)
 			newref.Unlock()
 		}
 	}()
@@ -316,6 +432,8 @@ func (sess *session) Walk(ctx context.Context, fid Fid, newfid Fid,
 		if err != nil {
 			return nil, err
 		}
+		newref.uname = ref.uname
+		newref.aname = ref.aname
 	}
 
 	// Both paths below must define ent and qids (or else return nil,err)
@@ -329,6 +447,14 @@ func (sess *session) Walk(ctx context.Context, fid Fid, newfid Fid,
 		if err != nil {
 			return nil, err
 		}
+		if ref.parent != nil {
+			_, parent, err = ref.parent.Walk(ctx)
+			err = EnsureNonNil(parent, err)
+			if err != nil {
+				ent.Clunk(ctx)
+				return nil, err
+			}
+		}
 	} else {
 		var err error
 
@@ -336,7 +462,7 @@ func (sess *session) Walk(ctx context.Context, fid Fid, newfid Fid,
 			err = MessageRerror{Ename: "not a directory"}
 			return nil, err
 		}
-		qids, ent, err = ref.Ent.Walk(ctx, names...)
+		qids, ent, parent, err = sess.walk(ctx, ref, names)
 		err = EnsureNonNil(ent, err)
 		if err != nil {
 			return nil, err
@@ -355,6 +481,9 @@ func (sess *session) Walk(ctx context.Context, fid Fid, newfid Fid,
 		// Re-use fid for result of walk.
 		// Note: It is still locked.
 		ref.Ent.Clunk(ctx) // TODO(frobnitzem): note - ignoring error here
+		if ref.parent != nil {
+			ref.parent.Clunk(ctx)
+		}
 	} else {
 		// We have increased the size of sess.refs by 1.
 		// both ref and newref are locked
@@ -364,15 +493,17 @@ func (sess *session) Walk(ctx context.Context, fid Fid, newfid Fid,
 		// cleanup will unlock ref
 	}
 	ref.link(ent)
+	ref.parent = parent
 	return qids, nil
 }
 
 func (sess *session) Read(ctx context.Context, fid Fid, p []byte, offset int64) (n int, err error) {
-	ref, err := sess.getRef(fid)
+	ref, err := sess.getAuthRef(fid)
 	if err != nil {
 		return 0, err
 	}
 	defer ref.Unlock()
+	ctx = ref.context(ctx)
 	if ref.File == nil {
 		return 0, MessageRerror{Ename: "no file open"} //ErrClosed
 	}
@@ -385,11 +516,12 @@ func (sess *session) Read(ctx context.Context, fid Fid, p []byte, offset int64)
 
 func (sess *session) Write(ctx context.Context, fid Fid, p []byte,
 	offset int64) (n int, err error) {
-	ref, err := sess.getRef(fid)
+	ref, err := sess.getAuthRef(fid)
 	if err != nil {
 		return 0, err
 	}
 	defer ref.Unlock()
+	ctx = ref.context(ctx)
 	if ref.File == nil {
 		return 0, MessageRerror{Ename: "no file open"} //ErrClosed
 	}
@@ -407,7 +539,11 @@ func (sess *session) Open(ctx context.Context, fid Fid,
 		return Qid{}, 0, err
 	}
 	defer ref.Unlock()
+	ctx = ref.context(ctx)
 
+	if err := sess.checkOpen(ctx, ref, mode); err != nil {
+		return Qid{}, 0, err
+	}
 	err = openLocked(ctx, ref, mode)
 	if err != nil {
 		return Qid{}, 0, err
@@ -423,7 +559,8 @@ func (_ *Readdir) IOUnit() int {
 // Sets ref.File if successful.
 // Note: This does not check file permissions
 //
-//	before opening!  It is up to the caller.
+//	before opening!  It is up to the caller,
+//	see checkOpen.
 //
 // Should be called with ref-lock held.
 // Does not release the lock.
@@ -442,7 +579,12 @@ func openLocked(ctx context.Context, ref *SFid, mode Flag) error {
 		if err != nil {
 			return err
 		}
-		file = NewReaddir(NewCodec(), dirs)
+		// Directory entries are encoded in the negotiated dialect.
+		codec, err := NewCodecVersion(GetVersion(ctx))
+		if err != nil {
+			codec = NewCodec()
+		}
+		file = NewReaddir(codec, dirs)
 	} else {
 		file, err = ref.Ent.Open(ctx, mode)
 		err = EnsureNonNil(file, err)
@@ -475,15 +617,33 @@ func (sess *session) Create(ctx context.Context, parent Fid, name string,
 		return fail(err.Error())
 	}
 	defer ref.Unlock()
+	ctx = ref.context(ctx)
 
 	if !IsDir(ref.Ent) {
 		return fail("create in non-directory")
 	}
+	if err := sess.access(ctx, ref.uname, ref.Ent, DMWRITE); err != nil {
+		return Qid{}, 0, err
+	}
+
+	// New files keep a clone of their directory, see SFid.parent,
+	// since Create may consume ref.Ent.
+	var dir Dirent
+	if sess.checkPerms && perm&DMDIR == 0 {
+		_, dir, err = ref.Ent.Walk(ctx)
+		err = EnsureNonNil(dir, err)
+		if err != nil {
+			return fail(err.Error())
+		}
+	}
 
 	ent, file, err := ref.Ent.Create(ctx, name, perm, mode)
 	err = EnsureNonNil(ent, err)
 	err = EnsureNonNil(file, err)
 	if err != nil {
+		if dir != nil {
+			dir.Clunk(ctx)
+		}
 		return fail(err.Error())
 	}
 	if IsDir(ent) { // Do our own thing for directories.
@@ -500,6 +660,7 @@ func (sess *session) Create(ctx context.Context, parent Fid, name string,
 
 	// Success. Clean-up ref and replace with ent.
 	//ref.Ent.Clunk(ctx)
+	ref.parent = dir
 	ref.File = nil
 	ref.Mode = 0
 	ref.link(ent)
@@ -515,6 +676,7 @@ func (sess *session) Stat(ctx context.Context, fid Fid) (Dir, error) {
 		return Dir{}, err
 	}
 	defer ref.Unlock()
+	ctx = ref.context(ctx)
 
 	return ref.Ent.Stat(ctx)
 }
@@ -525,10 +687,23 @@ func (sess *session) WStat(ctx context.Context, fid Fid, dir Dir) error {
 		return err
 	}
 	defer ref.Unlock()
+	ctx = ref.context(ctx)
 
+	if err := sess.checkWStat(ctx, ref, dir); err != nil {
+		return err
+	}
 	return ref.Ent.WStat(ctx, dir)
 }
 
 func (sess *session) Version() (msize int, version string) {
 	return DefaultMSize, DefaultVersion
 }
+
+// Versions lists every version, as the Dirent interface hides the
+// differences between them.
+func (sess *session) Versions() VersionInfo {
+	return VersionInfo{
+		Versions: []string{Version9P2000L, Version9P2000u, Version9P2000},
+		MaxMSize: DefaultMSize,
+	}
+}
@@ -0,0 +1,472 @@
+package p9p
+
+import (
+	"context"
+	"syscall"
+	"time"
+)
+
+// The methods below let SFileSys serve 9P2000.L. They translate to the
+// Dirent interface, using the optional extensions in filesys.go where the
+// FileSys provides them.
+
+var _ SessionL = &session{}
+
+func (sess *session) LOpen(ctx context.Context, fid Fid,
+	flags uint32) (Qid, uint32, error) {
+	return sess.Open(ctx, fid, FlagFromL(flags))
+}
+
+// LCreate fails with EEXIST when LOEXCL is set and the name exists, which
+// Create, and the Flag it takes, know nothing of.
+func (sess *session) LCreate(ctx context.Context, parent Fid, name string,
+	flags, mode, gid uint32) (Qid, uint32, error) {
+	if flags&LOEXCL != 0 {
+		if err := sess.checkExcl(ctx, parent, name); err != nil {
+			return Qid{}, 0, err
+		}
+	}
+	return sess.Create(ctx, parent, name, ModeToDir(mode), FlagFromL(flags))
+}
+
+// checkExcl fails if the directory parent holds name.
+func (sess *session) checkExcl(ctx context.Context, parent Fid,
+	name string) error {
+	ref, err := sess.getRef(parent)
+	if err != nil {
+		return err
+	}
+	defer ref.Unlock()
+	ctx = ref.context(ctx)
+
+	if !IsDir(ref.Ent) || name == "." || name == ".." {
+		return nil // left to Create
+	}
+	qids, ent, err := ref.Ent.Walk(ctx, name)
+	if err != nil || ent == nil || len(qids) != 1 {
+		return nil
+	}
+	ent.Clunk(ctx)
+	return MessageRerror{Ename: "file exists", Errno: uint32(syscall.EEXIST)}
+}
+
+func (sess *session) GetAttr(ctx context.Context, fid Fid,
+	mask uint64) (Attr, error) {
+	ref, err := sess.getRef(fid)
+	if err != nil {
+		return Attr{}, err
+	}
+	defer ref.Unlock()
+	ctx = ref.context(ctx)
+
+	if ag, ok := ref.Ent.(AttrGetter); ok {
+		return ag.GetAttr(ctx, mask)
+	}
+
+	dir, err := ref.Ent.Stat(ctx)
+	if err != nil {
+		return Attr{}, err
+	}
+	return AttrFromDir(dir), nil
+}
+
+func (sess *session) SetAttr(ctx context.Context, fid Fid,
+	attr SetAttr) error {
+	ref, err := sess.getRef(fid)
+	if err != nil {
+		return err
+	}
+	defer ref.Unlock()
+	ctx = ref.context(ctx)
+
+	if err := sess.checkSetAttr(ctx, ref, attr); err != nil {
+		return err
+	}
+	if as, ok := ref.Ent.(AttrSetter); ok {
+		return as.SetAttr(ctx, attr)
+	}
+
+	// WStat changes only the mode and size below, and the ctime with them.
+	if attr.Valid&^(SetAttrMode|SetAttrSize|SetAttrCTime) != 0 {
+		return ErrNotsupported
+	}
+	dir := nullDir()
+	if attr.Valid&SetAttrMode != 0 {
+		dir.Mode = ModeToDir(attr.Mode)
+		if IsDir(ref.Ent) {
+			dir.Mode |= DMDIR
+		}
+	}
+	if attr.Valid&SetAttrSize != 0 {
+		dir.Length = attr.Size
+	}
+	return ref.Ent.WStat(ctx, dir)
+}
+
+// Readdir lists the directory on the first call (offset 0) and serves the
+// following calls from that listing. The offset of an entry is its index
+// plus one.
+func (sess *session) Readdir(ctx context.Context, fid Fid, offset uint64,
+	count uint32) ([]ReaddirEntry, error) {
+	ref, err := sess.getRef(fid)
+	if err != nil {
+		return nil, err
+	}
+	defer ref.Unlock()
+	ctx = ref.context(ctx)
+
+	if !IsDir(ref.Ent) {
+		return nil, ErrWalknodir
+	}
+
+	if offset == 0 || ref.dirents == nil {
+		if err := sess.access(ctx, ref.uname, ref.Ent, DMREAD); err != nil {
+			return nil, err
+		}
+		next, err := ref.Ent.OpenDir(ctx)
+		err = EnsureNonNil(next, err)
+		if err != nil {
+			return nil, err
+		}
+		dirs := []Dir{}
+		for {
+			ret, err := next(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if len(ret) == 0 {
+				break
+			}
+			dirs = append(dirs, ret...)
+		}
+		ref.dirents = dirs
+	}
+
+	var entries []ReaddirEntry
+	size := 0
+	for i := offset; i < uint64(len(ref.dirents)); i++ {
+		d := ref.dirents[i]
+		e := ReaddirEntry{
+			Qid:    d.Qid,
+			Offset: i + 1,
+			Type:   direntType(d.Qid),
+			Name:   d.Name,
+		}
+		if size+e.Size() > int(count) {
+			break
+		}
+		size += e.Size()
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (sess *session) Mkdir(ctx context.Context, dfid Fid, name string,
+	mode, gid uint32) (Qid, error) {
+	if name == "." || name == ".." {
+		return Qid{}, MessageRerror{Ename: "illegal filename"}
+	}
+
+	ref, err := sess.getRef(dfid)
+	if err != nil {
+		return Qid{}, err
+	}
+	defer ref.Unlock()
+	ctx = ref.context(ctx)
+
+	if !IsDir(ref.Ent) {
+		return Qid{}, ErrCreatenondir
+	}
+	if err := sess.access(ctx, ref.uname, ref.Ent, DMWRITE); err != nil {
+		return Qid{}, err
+	}
+
+	// Create may consume its Dirent, and dfid stays on the directory.
+	_, dir, err := ref.Ent.Walk(ctx)
+	err = EnsureNonNil(dir, err)
+	if err != nil {
+		return Qid{}, err
+	}
+	ent, _, err := dir.Create(ctx, name, DMDIR|mode&0777, OREAD)
+	err = EnsureNonNil(ent, err)
+	if err != nil {
+		dir.Clunk(ctx)
+		return Qid{}, err
+	}
+	qid := ent.Qid()
+	return qid, ent.Clunk(ctx)
+}
+
+func (sess *session) Symlink(ctx context.Context, dfid Fid, name,
+	target string, gid uint32) (Qid, error) {
+	ref, err := sess.getRef(dfid)
+	if err != nil {
+		return Qid{}, err
+	}
+	defer ref.Unlock()
+	ctx = ref.context(ctx)
+
+	sl, ok := ref.Ent.(Symlinker)
+	if !ok {
+		return Qid{}, ErrNotsupported
+	}
+	if err := sess.access(ctx, ref.uname, ref.Ent, DMWRITE); err != nil {
+		return Qid{}, err
+	}
+	return sl.Symlink(ctx, name, target, gid)
+}
+
+func (sess *session) Readlink(ctx context.Context, fid Fid) (string, error) {
+	ref, err := sess.getRef(fid)
+	if err != nil {
+		return "", err
+	}
+	defer ref.Unlock()
+	ctx = ref.context(ctx)
+
+	rl, ok := ref.Ent.(Readlinker)
+	if !ok {
+		return "", MessageRerror{Ename: "not a symlink",
+			Errno: uint32(syscall.EINVAL)}
+	}
+	return rl.Readlink(ctx)
+}
+
+// Rename is done through WStat, which only renames a file within its
+// directory. Dirents do not know their parent, so dfid is assumed to be it,
+// though permission is checked on the actual parent, as for WStat.
+func (sess *session) Rename(ctx context.Context, fid, dfid Fid,
+	name string) error {
+	dref, err := sess.getRef(dfid)
+	if err != nil {
+		return err
+	}
+	isdir := IsDir(dref.Ent)
+	if isdir {
+		err = sess.access(ctx, dref.uname, dref.Ent, DMWRITE)
+	}
+	dref.Unlock()
+	if !isdir {
+		return ErrWalknodir
+	}
+	if err != nil {
+		return err
+	}
+
+	ref, err := sess.getRef(fid)
+	if err != nil {
+		return err
+	}
+	defer ref.Unlock()
+	ctx = ref.context(ctx)
+
+	dir := nullDir()
+	dir.Name = name
+	if err := sess.checkWStat(ctx, ref, dir); err != nil {
+		return err
+	}
+	return ref.Ent.WStat(ctx, dir)
+}
+
+func (sess *session) Renameat(ctx context.Context, olddfid Fid,
+	oldname string, newdfid Fid, newname string) error {
+	ref, err := sess.getRef(olddfid)
+	if err != nil {
+		return err
+	}
+	defer ref.Unlock()
+	ctx = ref.context(ctx)
+
+	if err := sess.access(ctx, ref.uname, ref.Ent, DMWRITE); err != nil {
+		return err
+	}
+	if olddfid == newdfid {
+		return renameEnt(ctx, ref.Ent, oldname, ref.Ent, newname)
+	}
+
+	nref, err := sess.getRef(newdfid)
+	if err != nil {
+		return err
+	}
+	defer nref.Unlock()
+
+	if err := sess.access(ctx, nref.uname, nref.Ent, DMWRITE); err != nil {
+		return err
+	}
+
+	return renameEnt(ctx, ref.Ent, oldname, nref.Ent, newname)
+}
+
+// renameEnt moves oldname in olddir to newname in newdir.
+func renameEnt(ctx context.Context, olddir Dirent, oldname string,
+	newdir Dirent, newname string) error {
+	if ValidPath([]string{oldname}) != 0 || ValidPath([]string{newname}) != 0 {
+		return MessageRerror{Ename: "illegal filename"}
+	}
+	if !IsDir(olddir) || !IsDir(newdir) {
+		return ErrWalknodir
+	}
+
+	if r, ok := olddir.(Renamer); ok {
+		return r.Rename(ctx, oldname, newdir, newname)
+	}
+	if olddir.Qid() != newdir.Qid() {
+		return MessageRerror{Ename: "cross-directory rename",
+			Errno: uint32(syscall.EXDEV)}
+	}
+
+	_, ent, err := olddir.Walk(ctx, oldname)
+	err = EnsureNonNil(ent, err)
+	if err != nil {
+		return err
+	}
+	defer ent.Clunk(ctx)
+
+	dir := nullDir()
+	dir.Name = newname
+	return ent.WStat(ctx, dir)
+}
+
+func (sess *session) Unlinkat(ctx context.Context, dfid Fid, name string,
+	flags uint32) error {
+	ref, err := sess.getRef(dfid)
+	if err != nil {
+		return err
+	}
+	defer ref.Unlock()
+	ctx = ref.context(ctx)
+
+	if ValidPath([]string{name}) != 0 {
+		return MessageRerror{Ename: "illegal filename"}
+	}
+	if !IsDir(ref.Ent) {
+		return ErrWalknodir
+	}
+	if err := sess.access(ctx, ref.uname, ref.Ent, DMWRITE); err != nil {
+		return err
+	}
+
+	_, ent, err := ref.Ent.Walk(ctx, name)
+	err = EnsureNonNil(ent, err)
+	if err != nil {
+		return err
+	}
+
+	switch isdir := IsDir(ent); {
+	case isdir && flags&AtRemoveDir == 0:
+		ent.Clunk(ctx)
+		return ErrIsdir
+	case !isdir && flags&AtRemoveDir != 0:
+		ent.Clunk(ctx)
+		return ErrWalknodir
+	}
+	return ent.Remove(ctx)
+}
+
+func (sess *session) Fsync(ctx context.Context, fid Fid, datasync bool) error {
+	ref, err := sess.getRef(fid)
+	if err != nil {
+		return err
+	}
+	defer ref.Unlock()
+	ctx = ref.context(ctx)
+
+	if s, ok := ref.File.(Syncer); ok {
+		return s.Sync(ctx, datasync)
+	}
+	if s, ok := ref.Ent.(Syncer); ok {
+		return s.Sync(ctx, datasync)
+	}
+	return nil
+}
+
+func (sess *session) StatFS(ctx context.Context, fid Fid) (StatFS, error) {
+	ref, err := sess.getRef(fid)
+	if err != nil {
+		return StatFS{}, err
+	}
+	defer ref.Unlock()
+	ctx = ref.context(ctx)
+
+	if s, ok := ref.Ent.(StatFSer); ok {
+		return s.StatFS(ctx)
+	}
+	return StatFS{Type: V9FSMagic, BSize: 4096, NameLen: 255}, nil
+}
+
+// Extended attributes are not supported by the Dirent interface.
+func (sess *session) XattrWalk(ctx context.Context, fid, newfid Fid,
+	name string) (uint64, error) {
+	return 0, ErrNotsupported
+}
+
+// Locks are only advisory. Without a way to share them between clients,
+// every lock is granted, as done by diod without its lock tracking.
+func (sess *session) Lock(ctx context.Context, fid Fid,
+	lock Lock) (uint8, error) {
+	ref, err := sess.getRef(fid)
+	if err != nil {
+		return LockError, err
+	}
+	ref.Unlock()
+
+	return LockSuccess, nil
+}
+
+func (sess *session) GetLock(ctx context.Context, fid Fid,
+	lock Lock) (Lock, error) {
+	ref, err := sess.getRef(fid)
+	if err != nil {
+		return Lock{}, err
+	}
+	ref.Unlock()
+
+	lock.Type = LockTypeUnlck
+	return lock, nil
+}
+
+// nullDir returns a Dir requesting no changes from WStat, see stat(5).
+func nullDir() Dir {
+	return Dir{
+		Type:   ^uint16(0),
+		Dev:    ^uint32(0),
+		Qid:    Qid{Type: ^QType(0), Version: ^uint32(0), Path: ^uint64(0)},
+		Mode:   ^uint32(0),
+		Length: ^uint64(0),
+		NUID:   NONUNAME,
+		NGID:   NONUNAME,
+		NMUID:  NONUNAME,
+	}
+}
+
+// AttrFromDir fills in the attributes of a file from its Dir.
+func AttrFromDir(dir Dir) Attr {
+	attr := Attr{
+		Valid:    AttrBasic &^ AttrBTime,
+		Qid:      dir.Qid,
+		Mode:     ModeFromDir(dir.Mode),
+		NLink:    1,
+		Size:     dir.Length,
+		BlkSize:  4096,
+		Blocks:   (dir.Length + 511) / 512,
+		ATimeSec: unixTime(dir.AccessTime),
+		MTimeSec: unixTime(dir.ModTime),
+		CTimeSec: unixTime(dir.ModTime),
+		UID:      dir.NUID,
+		GID:      dir.NGID,
+	}
+	if dir.NUID == NONUNAME {
+		attr.UID = 0
+	}
+	if dir.NGID == NONUNAME {
+		attr.GID = 0
+	}
+	return attr
+}
+
+func unixTime(t time.Time) uint64 {
+	if t.IsZero() || t.Unix() < 0 {
+		return 0
+	}
+	return uint64(t.Unix())
+}
@@ -110,15 +110,29 @@ func (s sleepTime) duration() time.Duration {
 	return t
 }
 
+// sleep waits for the duration of s, or until the request is flushed.
+func (s sleepTime) sleep(ctx context.Context) error {
+	timer := time.NewTimer(s.duration())
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (s sleepTime) Read(ctx context.Context, p []byte,
 	offset int64) (n int, err error) {
-	time.Sleep(s.duration())
-	return 0, nil
+	return 0, s.sleep(ctx)
 }
 
 func (s sleepTime) Write(ctx context.Context, p []byte,
 	offset int64) (n int, err error) {
-	time.Sleep(s.duration())
+	if err := s.sleep(ctx); err != nil {
+		return 0, err
+	}
 	return len(p), nil
 }
 
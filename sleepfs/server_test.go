@@ -1,7 +1,10 @@
 package sleepfs
 
 import (
+	"io"
+	"log"
 	"net"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -133,3 +136,297 @@ func TestServer(t *testing.T) {
 	cancel() // signal the server to stop serving
 	wg.Wait()
 }
+
+/** A cancelled read is flushed, and stops sleeping on the server.
+ */
+func TestFlush(t *testing.T) {
+	var wg sync.WaitGroup
+	assert := assert.New(t)
+
+	ctx := context.Background()
+	sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+
+	reqC, repC := net.Pipe()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		session := p9p.SFileSys(NewServer(sctx))
+		p9p.ServeConn(sctx, repC, p9p.SSession(session))
+	}()
+
+	session, err := p9p.CSession(ctx, reqC)
+	assert.Nil(err)
+
+	fid0, fid1 := p9p.Fid(0), p9p.Fid(1)
+	_, err = session.Attach(ctx, fid0, p9p.NOFID, "snooz", "/")
+	assert.Nil(err)
+	_, err = session.Walk(ctx, fid0, fid1, "3", "0") // 3 seconds
+	assert.Nil(err)
+	_, _, err = session.Open(ctx, fid1, p9p.OREAD)
+	assert.Nil(err)
+
+	start := time.Now()
+	rctx, rcancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	_, err = session.Read(rctx, fid1, make([]byte, 10), 0)
+	rcancel()
+	assert.Equal(context.DeadlineExceeded, err)
+
+	// The server gave up the read too, releasing the fid.
+	_, err = session.Stat(ctx, fid1)
+	assert.Nil(err)
+	assert.True(time.Since(start) < time.Second)
+
+	cancel() // signal the server to stop serving
+	wg.Wait()
+}
+
+/** Shutdown waits for an outstanding read, then closes the connection.
+ */
+func TestShutdown(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(err) {
+		return
+	}
+	srv := &p9p.Server{
+		NewSession: func(ctx context.Context) (p9p.Session, error) {
+			return p9p.SFileSys(NewServer(ctx)), nil
+		},
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(l)
+	}()
+
+	cn, err := net.Dial("tcp", l.Addr().String())
+	if !assert.Nil(err) {
+		return
+	}
+	defer cn.Close()
+	session, err := p9p.CSession(ctx, cn)
+	if !assert.Nil(err) {
+		return
+	}
+
+	fid0, fid1 := p9p.Fid(0), p9p.Fid(1)
+	_, err = session.Attach(ctx, fid0, p9p.NOFID, "snooz", "/")
+	assert.Nil(err)
+	_, err = session.Walk(ctx, fid0, fid1, "0", "300") // 300 milliseconds
+	assert.Nil(err)
+	_, _, err = session.Open(ctx, fid1, p9p.OREAD)
+	assert.Nil(err)
+
+	read := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		_, err := session.Read(ctx, fid1, make([]byte, 10), 0)
+		read <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	assert.Nil(srv.Shutdown(sctx))
+	assert.True(time.Since(start) >= 300*time.Millisecond)
+	assert.Equal(io.EOF, <-read) // answered, with no data
+	assert.Equal(p9p.ErrServerClosed, <-served)
+
+	// The listener and the connection are closed.
+	_, err = net.Dial("tcp", l.Addr().String())
+	assert.NotNil(err)
+	_, err = session.Stat(ctx, fid0)
+	assert.NotNil(err)
+	assert.Equal(p9p.ErrServerClosed, srv.Serve(l))
+}
+
+/** Close ends idle connections at once, and ListenAndServe understands
+ * unix sockets.
+ */
+func TestClose(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	addr := filepath.Join(t.TempDir(), "9p.sock")
+	srv := &p9p.Server{
+		NewSession: func(ctx context.Context) (p9p.Session, error) {
+			return p9p.SFileSys(NewServer(ctx)), nil
+		},
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServe("unix:" + addr)
+	}()
+
+	var cn net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if cn, err = net.Dial("unix", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !assert.Nil(err) {
+		return
+	}
+	defer cn.Close()
+	session, err := p9p.CSession(ctx, cn)
+	if !assert.Nil(err) {
+		return
+	}
+	_, err = session.Attach(ctx, p9p.Fid(0), p9p.NOFID, "snooz", "/")
+	assert.Nil(err)
+
+	assert.Nil(srv.Close())
+	assert.Equal(p9p.ErrServerClosed, <-served)
+	_, err = session.Stat(ctx, p9p.Fid(0))
+	assert.NotNil(err)
+}
+
+/** Requests in flight are limited per connection, and across connections
+ * sharing a Limiter.
+ */
+func TestMaxInflight(t *testing.T) {
+	var wg sync.WaitGroup
+	assert := assert.New(t)
+
+	ctx := context.Background()
+	sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+
+	var mu sync.Mutex
+	var inflight, most int
+	count := p9p.Hook(p9p.Hooks{
+		Request: func(ctx context.Context, req p9p.Message) {
+			mu.Lock()
+			if inflight++; inflight > most {
+				most = inflight
+			}
+			mu.Unlock()
+		},
+		Response: func(ctx context.Context, req, resp p9p.Message, err error,
+			elapsed time.Duration) {
+			mu.Lock()
+			inflight--
+			mu.Unlock()
+		},
+	})
+
+	// Open 4 fids on each connection, each sleeping 50ms on read.
+	connect := func(opts ...p9p.ServeOption) (p9p.Session, []p9p.Fid) {
+		reqC, repC := net.Pipe()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session := p9p.SFileSys(NewServer(sctx))
+			handler := p9p.Chain(p9p.SSession(session), count)
+			p9p.ServeConn(sctx, repC, handler, opts...)
+		}()
+
+		session, err := p9p.CSession(ctx, reqC)
+		assert.Nil(err)
+		_, err = session.Attach(ctx, 0, p9p.NOFID, "snooz", "/")
+		assert.Nil(err)
+		fids := []p9p.Fid{1, 2, 3, 4}
+		for _, fid := range fids {
+			_, err = session.Walk(ctx, 0, fid, "0", "50")
+			assert.Nil(err)
+			_, _, err = session.Open(ctx, fid, p9p.OREAD)
+			assert.Nil(err)
+		}
+		return session, fids
+	}
+
+	readAll := func(sessions []p9p.Session, fids []p9p.Fid) {
+		mu.Lock()
+		most = 0
+		mu.Unlock()
+
+		var rg sync.WaitGroup
+		for _, session := range sessions {
+			for _, fid := range fids {
+				rg.Add(1)
+				go func(session p9p.Session, fid p9p.Fid) {
+					defer rg.Done()
+					_, err := session.Read(ctx, fid, make([]byte, 10), 0)
+					assert.Equal(io.EOF, err)
+				}(session, fid)
+			}
+		}
+		rg.Wait()
+	}
+
+	session, fids := connect(p9p.WithMaxInflight(2))
+	start := time.Now()
+	readAll([]p9p.Session{session}, fids)
+	assert.True(time.Since(start) >= 100*time.Millisecond)
+	assert.Equal(2, most)
+
+	l := p9p.NewLimiter(3)
+	s1, fids := connect(p9p.WithLimiter(l))
+	s2, _ := connect(p9p.WithLimiter(l), p9p.WithMaxInflight(1))
+	readAll([]p9p.Session{s1, s2}, fids)
+	assert.Equal(3, most)
+
+	cancel()
+	wg.Wait()
+}
+
+/** Fids past the limit of the session are refused.
+ */
+func TestMaxFids(t *testing.T) {
+	var wg sync.WaitGroup
+	assert := assert.New(t)
+
+	ctx := context.Background()
+	sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+
+	reqC, repC := net.Pipe()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		session := p9p.SFileSys(NewServer(sctx), p9p.WithMaxFids(3))
+		p9p.ServeConn(sctx, repC, p9p.SSession(session))
+	}()
+
+	session, err := p9p.CSession(ctx, reqC)
+	assert.Nil(err)
+	_, err = session.Attach(ctx, 0, p9p.NOFID, "snooz", "/")
+	assert.Nil(err)
+	_, err = session.Walk(ctx, 0, 1, "0")
+	assert.Nil(err)
+	_, err = session.Walk(ctx, 0, 2, "0")
+	assert.Nil(err)
+	_, err = session.Walk(ctx, 0, 3, "0")
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), p9p.ErrNofids.Error())
+	}
+	_, err = session.Walk(ctx, 0, 0, "0") // no new fid
+	assert.Nil(err)
+
+	assert.Nil(session.Clunk(ctx, 1))
+	_, err = session.Walk(ctx, 2, 3)
+	assert.Nil(err)
+
+	cancel()
+	wg.Wait()
+}
+
+/** The files have no numeric ids, which 9P2000.u would take for root's.
+ */
+func TestNumericIds(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	root, err := NewServer(ctx).Attach(ctx, "glenda", "/", nil)
+	if !assert.Nil(err) {
+		return
+	}
+	dir, err := root.Stat(ctx)
+	assert.Nil(err)
+	assert.Equal(p9p.NONUNAME, dir.NUID)
+	assert.Equal(p9p.NONUNAME, dir.NGID)
+	assert.Equal(p9p.NONUNAME, dir.NMUID)
+}
@@ -36,6 +36,11 @@ func (st sleepTime) Info() p9p.Dir {
 	dir.Length = 0
 	dir.MUID = "sleeper"
 
+	// Only sent to 9P2000.u clients.
+	dir.NUID = p9p.NONUNAME
+	dir.NGID = p9p.NONUNAME
+	dir.NMUID = p9p.NONUNAME
+
 	if st.IsDir() {
 		dir.Qid.Type |= p9p.QTDIR
 		dir.Mode |= p9p.DMDIR
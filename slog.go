@@ -0,0 +1,192 @@
+package p9p
+
+import (
+	"context"
+	"log/slog"
+	"path"
+	"sync"
+	"time"
+)
+
+// LogOptions configure the Logging middleware.
+type LogOptions struct {
+	// Level is the level of the records of message types missing from
+	// Levels. The zero value is slog.LevelInfo.
+	Level slog.Level
+
+	// Levels sets the level of the records by message type. Reads and
+	// writes default to slog.LevelDebug.
+	Levels map[FcallType]slog.Level
+
+	// WriteData logs the payloads of Twrite messages, which are otherwise
+	// redacted to their length. Read data are never logged.
+	WriteData bool
+}
+
+// level returns the level of the records of messages of type t.
+func (o LogOptions) level(t FcallType) slog.Level {
+	if l, ok := o.Levels[t]; ok {
+		return l
+	}
+	switch t {
+	case Tread, Twrite, Treaddir:
+		return slog.LevelDebug
+	}
+	return o.Level
+}
+
+// Logging returns a Middleware logging each request and its outcome to
+// logger, one record per request, named after the message type.
+//
+// The records carry the fid of the request, along with its path, uname and
+// aname, which are followed from the attach of the fid through its walks,
+// creates and renames. On the server side, they also carry the remote
+// address of the connection.
+func Logging(logger *slog.Logger, opts LogOptions) Middleware {
+	return func(next Handler) Handler {
+		h := &logHandler{
+			logger: logger,
+			opts:   opts,
+			fids:   make(map[Fid]fidInfo),
+		}
+		h.wrappedHandler = wrappedHandler{next, h.handle}
+		return h
+	}
+}
+
+// fidInfo is what a logHandler knows about a fid.
+type fidInfo struct {
+	path, uname, aname string
+}
+
+type logHandler struct {
+	wrappedHandler
+	logger *slog.Logger
+	opts   LogOptions
+
+	mu   sync.Mutex
+	fids map[Fid]fidInfo
+}
+
+func (h *logHandler) handle(ctx context.Context, msg Message) (Message, error) {
+	start := time.Now()
+	resp, err := h.next.Handle(ctx, msg)
+	elapsed := time.Since(start)
+
+	h.mu.Lock()
+	fid, hasFid := msgFid(msg)
+	info := h.fids[fid]
+	h.track(msg, resp, err)
+	if _, ok := msg.(MessageTattach); ok {
+		info = h.fids[fid]
+	}
+	h.mu.Unlock()
+
+	level := h.opts.level(msg.Type())
+	if !h.logger.Enabled(ctx, level) {
+		return resp, err
+	}
+
+	attrs := make([]slog.Attr, 0, 10)
+	if addr := GetRemoteAddr(ctx); addr != nil {
+		attrs = append(attrs, slog.String("remote", addr.String()))
+	}
+	if hasFid {
+		attrs = append(attrs, slog.Uint64("fid", uint64(fid)))
+		if info.uname != "" || info.path != "" {
+			attrs = append(attrs,
+				slog.String("path", info.path),
+				slog.String("uname", info.uname),
+				slog.String("aname", info.aname))
+		}
+	}
+	attrs = append(attrs, h.msgAttrs("req", msg)...)
+	if err != nil {
+		attrs = append(attrs, slog.String("err", err.Error()))
+	} else if resp != nil {
+		attrs = append(attrs, h.msgAttrs("resp", resp)...)
+	}
+	attrs = append(attrs, slog.Duration("elapsed", elapsed))
+
+	h.logger.LogAttrs(ctx, level, msg.Type().String(), attrs...)
+	return resp, err
+}
+
+// msgAttrs returns the attributes logging msg under key, redacting file
+// data.
+func (h *logHandler) msgAttrs(key string, msg Message) []slog.Attr {
+	switch msg := msg.(type) {
+	case MessageTwrite:
+		attrs := []slog.Attr{
+			slog.Uint64("offset", msg.Offset),
+			slog.Int("count", len(msg.Data)),
+		}
+		if h.opts.WriteData {
+			attrs = append(attrs, slog.String("data", string(msg.Data)))
+		}
+		return attrs
+	case MessageRread:
+		return []slog.Attr{slog.Int("count", len(msg.Data))}
+	case MessageRreaddir:
+		return []slog.Attr{slog.Int("count", len(msg.Data))}
+	}
+	return []slog.Attr{slog.Any(key, msg)}
+}
+
+// track follows the fids created, moved and released by a request. Must be
+// called with h.mu held.
+func (h *logHandler) track(msg, resp Message, err error) {
+	switch msg := msg.(type) {
+	case MessageTclunk:
+		delete(h.fids, msg.Fid)
+		return
+	case MessageTremove:
+		delete(h.fids, msg.Fid)
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	switch msg := msg.(type) {
+	case MessageTattach:
+		h.fids[msg.Fid] = fidInfo{"/", msg.Uname, msg.Aname}
+	case MessageTwalk:
+		if rwalk, ok := resp.(MessageRwalk); ok && len(rwalk.Qids) == len(msg.Wnames) {
+			info := h.fids[msg.Fid]
+			info.path = path.Join(append([]string{info.path}, msg.Wnames...)...)
+			h.fids[msg.Newfid] = info
+		}
+	case MessageTxattrwalk:
+		h.fids[msg.Newfid] = h.fids[msg.Fid]
+	case MessageTcreate:
+		h.rename(msg.Fid, msg.Fid, msg.Name)
+	case MessageTlcreate:
+		h.rename(msg.Fid, msg.Fid, msg.Name)
+	case MessageTwstat:
+		if msg.Stat.Name != "" {
+			h.rename(msg.Fid, msg.Fid, "../"+msg.Stat.Name)
+		}
+	case MessageTrename:
+		h.rename(msg.Fid, msg.Dfid, msg.Name)
+	}
+}
+
+// rename sets the path of fid to name, relative to the path of dir. Must be
+// called with h.mu held.
+func (h *logHandler) rename(fid, dir Fid, name string) {
+	info, ok := h.fids[fid]
+	if !ok {
+		return
+	}
+	info.path = path.Join(h.fids[dir].path, name)
+	h.fids[fid] = info
+}
+
+// Reset forgets the fids, which are clunked by a new Tversion.
+func (h *logHandler) Reset(ctx context.Context) error {
+	h.mu.Lock()
+	h.fids = make(map[Fid]fidInfo)
+	h.mu.Unlock()
+	return h.wrappedHandler.Reset(ctx)
+}
@@ -0,0 +1,82 @@
+package p9p
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogging(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	logging := Logging(logger, LogOptions{
+		Levels: map[FcallType]slog.Level{
+			Twrite: slog.LevelInfo,
+			Tclunk: slog.LevelDebug,
+		},
+	})
+
+	cc, sc := net.Pipe()
+	go ServeConn(ctx, sc, Chain(echoHandler{}, logging))
+
+	session, err := CSession(ctx, cc)
+	if !assert.Nil(err) {
+		return
+	}
+	_, err = session.Attach(ctx, 0, NOFID, "glenda", "main")
+	assert.Nil(err)
+	_, err = session.Walk(ctx, 0, 1, "a", "b")
+	assert.Nil(err)
+	_, err = session.Read(ctx, 1, make([]byte, 10), 0)
+	assert.Nil(err)
+	_, err = session.Write(ctx, 1, []byte("secret"), 3)
+	assert.Nil(err)
+	_, err = session.Stat(ctx, 1)
+	assert.NotNil(err)
+	assert.Nil(session.Clunk(ctx, 1))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if !assert.Len(lines, 4) {
+		return
+	}
+	assert.Contains(lines[0], "msg=Tattach")
+	assert.Contains(lines[0], "remote=pipe")
+	assert.Contains(lines[0], "path=/ uname=glenda aname=main")
+	assert.Contains(lines[1], "msg=Twalk remote=pipe fid=0 path=/")
+	assert.Contains(lines[2], "fid=1 path=/a/b uname=glenda")
+	assert.Contains(lines[2], "offset=3 count=6")
+	assert.NotContains(lines[2], "secret")
+	assert.Contains(lines[3], "fid=1 path=/a/b")
+	assert.Contains(lines[3], `err="9p: file not found"`)
+
+	// Clients log through WithMiddleware, with the data if asked to.
+	buf.Reset()
+	cc, sc = net.Pipe()
+	go ServeConn(ctx, sc, echoHandler{})
+	logging = Logging(logger, LogOptions{
+		Level:     slog.LevelWarn,
+		Levels:    map[FcallType]slog.Level{Twrite: slog.LevelWarn},
+		WriteData: true,
+	})
+	session, err = CSession(ctx, cc, WithMiddleware(logging))
+	if !assert.Nil(err) {
+		return
+	}
+	_, err = session.Attach(ctx, 0, NOFID, "glenda", "")
+	assert.Nil(err)
+	_, err = session.Write(ctx, 0, []byte("public"), 0)
+	assert.Nil(err)
+	assert.Contains(buf.String(), "level=WARN msg=Tattach")
+	assert.Contains(buf.String(), "data=public")
+	assert.NotContains(buf.String(), "remote=")
+}
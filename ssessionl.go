@@ -0,0 +1,163 @@
+package p9p
+
+import "context"
+
+// handleL dispatches the messages added by 9P2000.L to session. It is only
+// called once 9P2000.L has been negotiated.
+func handleL(ctx context.Context, session SessionL, msize int,
+	msg Message) (Message, error) {
+	switch msg := msg.(type) {
+	case MessageTlopen:
+		qid, iounit, err := session.LOpen(ctx, msg.Fid, msg.Flags)
+		if err != nil {
+			return nil, err
+		}
+
+		return MessageRlopen{
+			Qid:    qid,
+			IOUnit: iounit,
+		}, nil
+	case MessageTlcreate:
+		qid, iounit, err := session.LCreate(ctx, msg.Fid, msg.Name,
+			msg.Flags, msg.Mode, msg.Gid)
+		if err != nil {
+			return nil, err
+		}
+
+		return MessageRlcreate{
+			Qid:    qid,
+			IOUnit: iounit,
+		}, nil
+	case MessageTgetattr:
+		attr, err := session.GetAttr(ctx, msg.Fid, msg.RequestMask)
+		if err != nil {
+			return nil, err
+		}
+
+		return MessageRgetattr{Attr: attr}, nil
+	case MessageTsetattr:
+		if err := session.SetAttr(ctx, msg.Fid, msg.Attr); err != nil {
+			return nil, err
+		}
+
+		return MessageRsetattr{}, nil
+	case MessageTreaddir:
+		// As with Tread, the reply must fit in msize.
+		count := msg.Count
+		if int(count) > msize-11 {
+			count = uint32(msize - 11)
+		}
+		entries, err := session.Readdir(ctx, msg.Fid, msg.Offset, count)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := encodeReaddir(entries)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > int(count) {
+			return nil, ErrBadcount
+		}
+
+		return MessageRreaddir{Data: data}, nil
+	case MessageTmkdir:
+		qid, err := session.Mkdir(ctx, msg.Dfid, msg.Name, msg.Mode, msg.Gid)
+		if err != nil {
+			return nil, err
+		}
+
+		return MessageRmkdir{Qid: qid}, nil
+	case MessageTsymlink:
+		qid, err := session.Symlink(ctx, msg.Fid, msg.Name, msg.Target, msg.Gid)
+		if err != nil {
+			return nil, err
+		}
+
+		return MessageRsymlink{Qid: qid}, nil
+	case MessageTreadlink:
+		target, err := session.Readlink(ctx, msg.Fid)
+		if err != nil {
+			return nil, err
+		}
+
+		return MessageRreadlink{Target: target}, nil
+	case MessageTrenameat:
+		if err := session.Renameat(ctx, msg.OldDfid, msg.OldName,
+			msg.NewDfid, msg.NewName); err != nil {
+			return nil, err
+		}
+
+		return MessageRrenameat{}, nil
+	case MessageTrename:
+		// Trename is the fid-based predecessor of Trenameat.
+		if err := session.Rename(ctx, msg.Fid, msg.Dfid, msg.Name); err != nil {
+			return nil, err
+		}
+
+		return MessageRrename{}, nil
+	case MessageTunlinkat:
+		if err := session.Unlinkat(ctx, msg.Dfid, msg.Name, msg.Flags); err != nil {
+			return nil, err
+		}
+
+		return MessageRunlinkat{}, nil
+	case MessageTfsync:
+		if err := session.Fsync(ctx, msg.Fid, msg.Datasync != 0); err != nil {
+			return nil, err
+		}
+
+		return MessageRfsync{}, nil
+	case MessageTstatfs:
+		stat, err := session.StatFS(ctx, msg.Fid)
+		if err != nil {
+			return nil, err
+		}
+
+		return MessageRstatfs{Stat: stat}, nil
+	case MessageTxattrwalk:
+		size, err := session.XattrWalk(ctx, msg.Fid, msg.Newfid, msg.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		return MessageRxattrwalk{Size: size}, nil
+	case MessageTlock:
+		status, err := session.Lock(ctx, msg.Fid, Lock{
+			Type:     msg.LockType,
+			Flags:    msg.Flags,
+			Start:    msg.Start,
+			Length:   msg.Length,
+			ProcID:   msg.ProcID,
+			ClientID: msg.ClientID,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return MessageRlock{Status: status}, nil
+	case MessageTgetlock:
+		lock, err := session.GetLock(ctx, msg.Fid, Lock{
+			Type:     msg.LockType,
+			Start:    msg.Start,
+			Length:   msg.Length,
+			ProcID:   msg.ProcID,
+			ClientID: msg.ClientID,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return MessageRgetlock{
+			LockType: lock.Type,
+			Start:    lock.Start,
+			Length:   lock.Length,
+			ProcID:   lock.ProcID,
+			ClientID: lock.ClientID,
+		}, nil
+	case MessageTxattrcreate, MessageTmknod, MessageTlink:
+		return nil, ErrNotsupported
+	default:
+		return nil, ErrUnknownMsg
+	}
+}
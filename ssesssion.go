@@ -4,7 +4,7 @@ import "context"
 
 // Handler defines an interface for 9p message handlers. A handler
 // implementation could be used to intercept calls of all types before sending
-// them to the next handler.
+// them to the next handler, see Middleware.
 // This is different than roundTripper because it handles multiple messages,
 // and needs to provide a shutdown callback.
 type Handler interface {
@@ -14,8 +14,7 @@ type Handler interface {
 
 type sessionHandler struct {
 	s     Session
-	msize int
-	// TODO(frobnitzem): make use of version to audit messages at this level
+	msize int // used unless the msize was negotiated, see GetMSize
 }
 
 // SSession returns a handler that transforms messages
@@ -35,10 +34,26 @@ func (sess sessionHandler) Stop(err error) error {
 	return sess.s.Stop(err)
 }
 
+// Reset forwards a version reset to the session, if it implements Resetter.
+func (sess sessionHandler) Reset(ctx context.Context) error {
+	if r, ok := sess.s.(Resetter); ok {
+		return r.Reset(ctx)
+	}
+	return nil
+}
+
+// Versions forwards the versions supported by the session.
+func (sess sessionHandler) Versions() VersionInfo {
+	return sessionVersions(sess.s)
+}
+
 func (sess sessionHandler) Handle(ctx context.Context,
 	msg Message) (Message, error) {
 	session := sess.s
 	msize := sess.msize
+	if m := GetMSize(ctx); m > 0 {
+		msize = m
+	}
 	switch msg := msg.(type) {
 	case MessageTauth:
 		qid, err := session.Auth(ctx, msg.Afid, msg.Uname, msg.Aname)
@@ -147,6 +162,9 @@ func (sess sessionHandler) Handle(ctx context.Context,
 
 		return MessageRwstat{}, nil
 	default:
+		if sl, ok := session.(SessionL); ok && GetVersion(ctx) == Version9P2000L {
+			return handleL(ctx, sl, msize, msg)
+		}
 		return nil, ErrUnknownMsg
 	}
 }
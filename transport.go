@@ -25,23 +25,34 @@ type transport struct {
 	ctx      context.Context
 	ch       Channel
 	requests chan *fcallRequest
+	flushes  chan *fcallRequest // requests abandoned by send
 
 	shutdown chan struct{}
 	once     sync.Once // protect closure of shutdown
 	closed   chan struct{}
+	err      error // reason for closed, if not ErrClosed
+
+	// onTagError decides the fate of responses that match no request.
+	onTagError func(*TagError) error
 
 	tags uint16
 }
 
 var _ roundTripper = &transport{}
 
-func newTransport(ctx context.Context, ch Channel) roundTripper {
+func newTransport(ctx context.Context, ch Channel, onTagError func(*TagError) error) *transport {
+	if onTagError == nil {
+		onTagError = dropTagError
+	}
+
 	t := &transport{
-		ctx:      ctx,
-		ch:       ch,
-		requests: make(chan *fcallRequest),
-		shutdown: make(chan struct{}),
-		closed:   make(chan struct{}),
+		ctx:        ctx,
+		ch:         ch,
+		requests:   make(chan *fcallRequest),
+		flushes:    make(chan *fcallRequest),
+		shutdown:   make(chan struct{}),
+		closed:     make(chan struct{}),
+		onTagError: onTagError,
 	}
 
 	go t.handle()
@@ -50,11 +61,21 @@ func newTransport(ctx context.Context, ch Channel) roundTripper {
 }
 
 // fcallRequest encompasses the request to send a message via fcall.
+//
+// The remaining fields are owned by the handle loop. A request that has been
+// flushed keeps its tag until the server answers the Tflush, as required by
+// flush(5). A response to it arriving in the meantime means that the request
+// was done: it is discarded, but a fid it made on the server is clunked, as
+// its caller never learnt of it.
 type fcallRequest struct {
 	ctx      context.Context
 	message  Message
 	response chan *Fcall
 	err      chan error
+
+	tag     Tag
+	flushed bool
+	flushes *fcallRequest // for a Tflush, the request being flushed
 }
 
 func newFcallRequest(ctx context.Context, msg Message) *fcallRequest {
@@ -72,7 +93,7 @@ func (t *transport) send(ctx context.Context, msg Message) (Message, error) {
 	// dispatch the request.
 	select {
 	case <-t.closed:
-		return nil, ErrClosed
+		return nil, t.closedErr()
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	case t.requests <- req:
@@ -81,8 +102,9 @@ func (t *transport) send(ctx context.Context, msg Message) (Message, error) {
 	// wait for the response.
 	select {
 	case <-t.closed:
-		return nil, ErrClosed
+		return nil, t.closedErr()
 	case <-ctx.Done():
+		t.flush(req)
 		return nil, ctx.Err()
 	case err := <-req.err:
 		return nil, err
@@ -173,47 +195,91 @@ func (t *transport) handle() {
 		}
 	}()
 
+	// write sends req under a newly allocated tag.
+	write := func(ctx context.Context, req *fcallRequest) error {
+		var err error
+
+		selected, err = allocateTag(req, outstanding, selected)
+		if err != nil {
+			return err
+		}
+
+		req.tag = selected
+		outstanding[selected] = req
+		fcall := newFcall(selected, req.message)
+
+		if err := t.ch.WriteFcall(ctx, fcall); err != nil {
+			delete(outstanding, fcall.Tag)
+			return err
+		}
+		return nil
+	}
+
 	for {
 		select {
 		case req := <-t.requests:
-			var err error
-
-			selected, err = allocateTag(req, outstanding, selected)
-			if err != nil {
+			if err := write(req.ctx, req); err != nil {
 				req.err <- err
+			}
+		case req := <-t.flushes:
+			if outstanding[req.tag] != req || req.flushed {
+				// already answered
 				continue
 			}
 
-			outstanding[selected] = req
-			fcall := newFcall(selected, req.message)
-
-			// TODO(stevvooe): Consider the case of requests that never
-			// receive a response. We need to remove the fcall context from
-			// the tag map and dealloc the tag. We may also want to send a
-			// flush for the tag.
-			if err := t.ch.WriteFcall(req.ctx, fcall); err != nil {
-				delete(outstanding, fcall.Tag)
-				req.err <- err
+			// The request was abandoned by its caller. Ask the server to
+			// stop working on it. Its tag is reclaimed on Rflush.
+			req.flushed = true
+			flush := newFcallRequest(t.ctx, MessageTflush{Oldtag: req.tag})
+			flush.flushes = req
+			if err := write(t.ctx, flush); err != nil {
+				log.Println("p9p: error sending flush:", err)
+				delete(outstanding, req.tag)
 			}
 		case b := <-responses:
 			req, ok := outstanding[b.Tag]
 			if !ok {
-				// BUG(stevvooe): The exact handling of an unknown tag is
-				// unclear at this point. These may not necessarily fatal to
-				// the session, since they could be messages that the client no
-				// longer cares for. When we figure this out, replace this
-				// panic with something more sensible.
-				panic(fmt.Sprintf("unknown tag received: %v", b))
+				// Possibly a message that the client no longer cares for,
+				// or a confused server.
+				if err := t.onTagError(&TagError{Fcall: b}); err != nil {
+					t.err = err
+					return
+				}
+				continue
+			}
+
+			if req.flushed {
+				// A late response, the caller is gone. The tag stays
+				// reserved until Rflush.
+				if fid, ok := newFid(req.message, b); ok {
+					clunk := newFcallRequest(t.ctx, MessageTclunk{Fid: fid})
+					if err := write(t.ctx, clunk); err != nil {
+						log.Println("p9p: error clunking fid of flushed request:", err)
+					}
+				}
+				continue
+			}
+
+			if !answers(req.message, b) {
+				// A duplicate response to an earlier use of the tag. Keep
+				// the entry, so that the right caller is woken up by the
+				// real response.
+				if err := t.onTagError(&TagError{Fcall: b, Request: req.message}); err != nil {
+					t.err = err
+					return
+				}
+				continue
 			}
 
-			// BUG(stevvooe): Must detect duplicate tag and ensure that we are
-			// waking up the right caller. If a duplicate is received, the
-			// entry should not be deleted.
 			delete(outstanding, b.Tag)
 
-			req.response <- b
+			if req.flushes != nil {
+				// Rflush (or an error): the flushed tag can be reused.
+				delete(outstanding, req.flushes.tag)
+				continue
+			}
 
-			// TODO(stevvooe): Reclaim tag id.
+			req.response <- b
 		case <-t.shutdown:
 			return
 		case <-t.ctx.Done():
@@ -222,10 +288,47 @@ func (t *transport) handle() {
 	}
 }
 
-func (t *transport) flush(ctx context.Context, tag Tag) error {
-	// TODO(stevvooe): We need to fire and forget flush messages when a call
-	// context gets cancelled.
-	panic("not implemented")
+// newFid returns the fid made on the server by req, if resp tells of its
+// success. A walk of a fid in place makes none.
+func newFid(req Message, resp *Fcall) (Fid, bool) {
+	switch req := req.(type) {
+	case MessageTauth:
+		return req.Afid, resp.Type == Rauth
+	case MessageTattach:
+		return req.Fid, resp.Type == Rattach
+	case MessageTwalk:
+		rwalk, ok := resp.Message.(MessageRwalk)
+		return req.Newfid, ok && req.Newfid != req.Fid &&
+			len(rwalk.Qids) == len(req.Wnames)
+	case MessageTxattrwalk:
+		return req.Newfid, resp.Type == Rxattrwalk
+	}
+	return NOFID, false
+}
+
+// answers reports whether resp is a valid response to req.
+func answers(req Message, resp *Fcall) bool {
+	return resp.Type == Rerror || resp.Type == req.Type()+1
+}
+
+// closedErr returns the error for calls on a closed transport. It must only
+// be called once closed is closed.
+func (t *transport) closedErr() error {
+	if t.err != nil {
+		return t.err
+	}
+	return ErrClosed
+}
+
+// flush hands a request abandoned by its caller back to the handle loop,
+// which sends a Tflush for it unless it has been answered already. It does
+// not wait for the Rflush.
+func (t *transport) flush(req *fcallRequest) {
+	select {
+	case t.flushes <- req:
+	case <-t.closed:
+	case <-t.shutdown:
+	}
 }
 
 func (t *transport) Close() error {
@@ -245,3 +348,35 @@ func (t *transport) close() {
 		close(t.shutdown)
 	})
 }
+
+// TagError reports a response that matches no outstanding request. Either its
+// tag is unknown, or its type does not answer the request sent with that tag,
+// as happens with a duplicate response to a tag that has been reused.
+type TagError struct {
+	Fcall   *Fcall  // the offending response
+	Request Message // the request outstanding under the tag, if any
+}
+
+func (e *TagError) Error() string {
+	if e.Request == nil {
+		return fmt.Sprintf("p9p: response for unknown tag: %v", e.Fcall)
+	}
+	return fmt.Sprintf("p9p: response does not match request %v: %v",
+		e.Request.Type(), e.Fcall)
+}
+
+// Is lets errors.Is match a TagError with ErrUnknownTag, or with ErrDuptag
+// for a duplicate response.
+func (e *TagError) Is(target error) bool {
+	if e.Request == nil {
+		return target == ErrUnknownTag
+	}
+	return target == ErrDuptag
+}
+
+// dropTagError is the default handling of a TagError: it is logged and the
+// response is dropped.
+func dropTagError(err *TagError) error {
+	log.Println(err)
+	return nil
+}
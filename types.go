@@ -9,10 +9,31 @@ const (
 	// DefaultMSize messages size used to establish a session.
 	DefaultMSize = 64 << 10
 
-	// DefaultVersion for this package. Currently, the only supported version.
-	DefaultVersion = "9P2000"
+	// MinMSize is the smallest message size accepted by default. It leaves
+	// room for a useful Rread or Rstat.
+	MinMSize = 256
+
+	// maxWalk is the largest number of names in a Twalk, see walk(5).
+	maxWalk = 16
+
+	// DefaultVersion for this package.
+	DefaultVersion = Version9P2000
+
+	// Version9P2000 is the base protocol, understood by all peers.
+	Version9P2000 = "9P2000"
+
+	// Version9P2000u is the Unix extension of the protocol, adding numeric
+	// ids, errno values and special files.
+	Version9P2000u = "9P2000.u"
+
+	// Version9P2000L is the Linux extension of the protocol, as spoken by
+	// the v9fs kernel client when mounting with version=9p2000.L.
+	Version9P2000L = "9P2000.L"
 )
 
+// NONUNAME indicates the lack of a numeric user id in 9P2000.u messages.
+const NONUNAME = ^uint32(0)
+
 // Mode constants for use Dir.Mode.
 const (
 	DMDIR    = 0x80000000 // mode bit for directories
@@ -69,6 +90,11 @@ const (
 	QTAUTH   QType = 0x08 // type bit for authentication file
 	QTTMP    QType = 0x04 // type bit for not-backed-up file
 	QTFILE   QType = 0x00 // plain file
+
+	// 9p2000.u extensions
+
+	QTSYMLINK QType = 0x02 // type bit for symbolic links
+	QTLINK    QType = 0x01 // type bit for hard links
 )
 
 func (qt QType) String() string {
@@ -87,6 +113,10 @@ func (qt QType) String() string {
 		return "tmp"
 	case QTFILE:
 		return "file"
+	case QTSYMLINK:
+		return "symlink"
+	case QTLINK:
+		return "link"
 	}
 
 	return "unknown"
@@ -141,6 +171,15 @@ type Dir struct {
 	UID    string
 	GID    string
 	MUID   string
+
+	// 9P2000.u extensions. These are not sent by the 9P2000 codec. Numeric
+	// ids that are unknown, or in a Twstat are not to be changed, are
+	// NONUNAME rather than zero, which is root.
+
+	Extension string `9p:"u"` // symlink target, device numbers, etc.
+	NUID      uint32 `9p:"u"` // numeric owner id
+	NGID      uint32 `9p:"u"` // numeric group id
+	NMUID     uint32 `9p:"u"` // numeric id of the last modifier
 }
 
 func (d Dir) String() string {
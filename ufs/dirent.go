@@ -38,7 +38,11 @@ func (ref *FileRef) OpenDir(ctx context.Context) (p9p.ReadNext, error) {
 		return nil, p9p.MessageRerror{Ename: "not a directory"}
 	}
 
-	files, err := os.ReadDir(ref.fullPath())
+	fpath, err := ref.followPath()
+	if err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(fpath)
 	if err != nil {
 		return nil, err
 	}
@@ -64,7 +68,11 @@ func (ref *FileRef) Remove(ctx context.Context) error {
 	if ref.Path == "/" || ref.Path == "\\" {
 		return p9p.MessageRerror{Ename: "cannot remove root"}
 	}
-	return os.Remove(ref.fullPath())
+	fpath, err := ref.fullPath()
+	if err != nil {
+		return err
+	}
+	return os.Remove(fpath)
 }
 
 func (ref *FileRef) Walk(ctx context.Context, names ...string) ([]p9p.Qid, p9p.Dirent, error) {
@@ -77,18 +85,26 @@ func (ref *FileRef) Walk(ctx context.Context, names ...string) ([]p9p.Qid, p9p.D
 	}
 
 	// names is guaranteed to pass p9p.ValidPath
-	newpath, err := p9p.WalkName(ref.Path, names...)
-	if err != nil {
+	if _, err := p9p.WalkName(ref.Path, names...); err != nil {
 		return nil, nil, err
 	}
-	next, err := ref.fs.newRef(newpath)
-	// TODO(frobnitzem): return qid-s corresponding to partial walk
-	if err != nil {
-		return nil, nil, err
+
+	// Step through the names, to return the qid-s of a partial walk.
+	qids := make([]p9p.Qid, 0, len(names))
+	var next *FileRef
+	for i := range names {
+		newpath, _ := p9p.WalkName(ref.Path, names[:i+1]...)
+		var err error
+		next, err = ref.fs.newRef(newpath)
+		if err != nil {
+			if i == 0 {
+				return nil, nil, err
+			}
+			return qids, ref, nil
+		}
+		qids = append(qids, next.Qid())
 	}
-	qids := make([]p9p.Qid, len(names))
-	qids[len(qids)-1] = next.Qid()
-	return qids, next, err
+	return qids, next, nil
 }
 
 func (ref *FileRef) Create(ctx context.Context, name string,
@@ -136,12 +152,25 @@ func (ref *FileRef) Create(ctx context.Context, name string,
 }
 
 func (ref *FileRef) Stat(ctx context.Context) (p9p.Dir, error) {
+	// Refresh, the file may have changed since it was walked to.
+	if next, err := ref.fs.newRef(ref.Path); err == nil {
+		ref.Info = next.Info
+	}
 	return ref.Info, nil
 }
 
 func (ref *FileRef) WStat(ctx context.Context, dir p9p.Dir) error {
+	fpath, err := ref.fullPath()
+	if err != nil {
+		return err
+	}
+
 	if dir.Mode != ^uint32(0) {
-		err := os.Chmod(ref.fullPath(), os.FileMode(dir.Mode&0777))
+		fpath, err := ref.followPath()
+		if err != nil {
+			return err
+		}
+		err = os.Chmod(fpath, os.FileMode(dir.Mode&0777))
 		if err != nil {
 			return err
 		}
@@ -164,7 +193,7 @@ func (ref *FileRef) WStat(ctx context.Context, dir p9p.Dir) error {
 		if err != nil {
 			return err
 		}
-		if err := os.Chown(ref.fullPath(), uid, gid); err != nil {
+		if err := os.Lchown(fpath, uid, gid); err != nil {
 			return err
 		}
 	}
@@ -181,14 +210,18 @@ func (ref *FileRef) WStat(ctx context.Context, dir p9p.Dir) error {
 		if err != nil {
 			return err
 		}
-		if err = syscall.Rename(ref.fullPath(), newpath); err != nil {
+		if err = syscall.Rename(fpath, newpath); err != nil {
 			return err
 		}
 		ref.Path = rel
 	}
 
 	if dir.Length != ^uint64(0) {
-		if err := os.Truncate(ref.fullPath(), int64(dir.Length)); err != nil {
+		fpath, err := ref.followPath()
+		if err != nil {
+			return err
+		}
+		if err := os.Truncate(fpath, int64(dir.Length)); err != nil {
 			return err
 		}
 	}
@@ -221,7 +254,11 @@ func (ref *FileRef) WStat(ctx context.Context, dir p9p.Dir) error {
 
 func (ref *FileRef) Open(ctx context.Context,
 	mode p9p.Flag) (p9p.File, error) {
-	file, err := os.OpenFile(ref.fullPath(), oflags(mode), 0)
+	fpath, err := ref.fullPath()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(fpath, oflags(mode), 0)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,183 @@
+package ufs
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+
+	p9p "github.com/frobnitzem/go-p9p"
+)
+
+// The methods below implement the optional Dirent interfaces
+// used to serve 9P2000.L.
+
+func (ref *FileRef) lstat() (*syscall.Stat_t, error) {
+	fpath, err := ref.fullPath()
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(fpath)
+	if err != nil {
+		return nil, err
+	}
+	ref.Info = dirFromInfo(info)
+	return info.Sys().(*syscall.Stat_t), nil
+}
+
+func (ref *FileRef) GetAttr(ctx context.Context, mask uint64) (p9p.Attr, error) {
+	stat, err := ref.lstat()
+	if err != nil {
+		return p9p.Attr{}, err
+	}
+
+	attr := attrFromStat(stat)
+	attr.Valid = p9p.AttrBasic
+	attr.Qid = ref.Info.Qid
+	return attr, nil
+}
+
+func (ref *FileRef) SetAttr(ctx context.Context, attr p9p.SetAttr) error {
+	fpath, err := ref.fullPath()
+	if err != nil {
+		return err
+	}
+	if attr.Valid&(p9p.SetAttrMode|p9p.SetAttrSize|
+		p9p.SetAttrATime|p9p.SetAttrMTime) != 0 {
+		// These follow a symbolic link.
+		if fpath, err = ref.followPath(); err != nil {
+			return err
+		}
+	}
+
+	if attr.Valid&p9p.SetAttrMode != 0 {
+		if err := os.Chmod(fpath, os.FileMode(attr.Mode&0777)); err != nil {
+			return err
+		}
+	}
+
+	if attr.Valid&(p9p.SetAttrUID|p9p.SetAttrGID) != 0 {
+		uid, gid := -1, -1
+		if attr.Valid&p9p.SetAttrUID != 0 {
+			uid = int(attr.UID)
+		}
+		if attr.Valid&p9p.SetAttrGID != 0 {
+			gid = int(attr.GID)
+		}
+		if err := os.Lchown(fpath, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	if attr.Valid&p9p.SetAttrSize != 0 {
+		if err := os.Truncate(fpath, int64(attr.Size)); err != nil {
+			return err
+		}
+	}
+
+	if attr.Valid&(p9p.SetAttrATime|p9p.SetAttrMTime) != 0 {
+		// os.Chtimes sets both, so fill in the current value
+		// of the one not being changed.
+		info, err := os.Stat(fpath)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		at := atime(info.Sys().(*syscall.Stat_t))
+		mt := info.ModTime()
+
+		switch {
+		case attr.Valid&p9p.SetAttrATimeSet != 0:
+			at = time.Unix(int64(attr.ATimeSec), int64(attr.ATimeNsec))
+		case attr.Valid&p9p.SetAttrATime != 0:
+			at = now
+		}
+		switch {
+		case attr.Valid&p9p.SetAttrMTimeSet != 0:
+			mt = time.Unix(int64(attr.MTimeSec), int64(attr.MTimeNsec))
+		case attr.Valid&p9p.SetAttrMTime != 0:
+			mt = now
+		}
+		if err := os.Chtimes(fpath, at, mt); err != nil {
+			return err
+		}
+	}
+
+	_, err = ref.lstat()
+	return err
+}
+
+func (ref *FileRef) Symlink(ctx context.Context, name, target string,
+	gid uint32) (p9p.Qid, error) {
+	newrel, err := p9p.CreateName(ref.Path, name)
+	if err != nil {
+		return p9p.Qid{}, err
+	}
+	newpath, err := ref.fs.fullPath(newrel)
+	if err != nil {
+		return p9p.Qid{}, err
+	}
+
+	if err := ref.fs.checkTarget(ref.Path, target); err != nil {
+		return p9p.Qid{}, &os.LinkError{Op: "symlink", Old: target,
+			New: newrel, Err: err}
+	}
+	if err := os.Symlink(target, newpath); err != nil {
+		return p9p.Qid{}, err
+	}
+	ent, err := ref.fs.newRef(newrel)
+	if err != nil {
+		return p9p.Qid{}, err
+	}
+	return ent.Qid(), nil
+}
+
+func (ref *FileRef) Readlink(ctx context.Context) (string, error) {
+	fpath, err := ref.fullPath()
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(fpath)
+}
+
+func (ref *FileRef) Rename(ctx context.Context, oldname string,
+	newdir p9p.Dirent, newname string) error {
+	dir, ok := newdir.(*FileRef)
+	if !ok || dir.fs != ref.fs {
+		return syscall.EXDEV
+	}
+
+	oldrel, err := p9p.CreateName(ref.Path, oldname)
+	if err != nil {
+		return err
+	}
+	newrel, err := p9p.CreateName(dir.Path, newname)
+	if err != nil {
+		return err
+	}
+	oldpath, err := ref.fs.fullPath(oldrel)
+	if err != nil {
+		return err
+	}
+	newpath, err := ref.fs.fullPath(newrel)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(oldpath, newpath)
+}
+
+func (ref *FileRef) Sync(ctx context.Context, datasync bool) error {
+	if ref.file == nil {
+		return nil
+	}
+	return ref.file.Sync()
+}
+
+func (ref *FileRef) StatFS(ctx context.Context) (p9p.StatFS, error) {
+	fpath, err := ref.followPath()
+	if err != nil {
+		return p9p.StatFS{}, err
+	}
+	return statFS(fpath)
+}
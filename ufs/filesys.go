@@ -6,6 +6,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"github.com/frobnitzem/go-p9p"
 )
@@ -30,6 +31,10 @@ type FileRef struct {
 // These fullPath functions should be the only way used to create a path
 // referencing the underlying system.  They ensure
 // we only access files inside our domain.
+//
+// The host resolves symbolic links in the middle of a path, and they may
+// lead anywhere, so no parent of a path may be one.  The last element may
+// be a symbolic link, for Readlink, Lstat and the like; see followPath.
 
 // Return the system's underlying path for the internal path, p.
 //
@@ -42,15 +47,84 @@ func (fs *fServer) fullPath(p string) (string, error) {
 	if path.Clean(p) != p { // removes ../ at root.
 		return "", p9p.MessageRerror{Ename: "Invalid path"}
 	}
-	return filepath.Join(fs.Base, filepath.FromSlash(p)), nil
+
+	fpath := fs.Base
+	elems := strings.Split(p[1:], "/")
+	for i, name := range elems[:len(elems)-1] {
+		fpath = filepath.Join(fpath, name)
+		info, err := os.Lstat(fpath)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", &os.PathError{Op: "walk",
+				Path: "/" + path.Join(elems[:i+1]...), Err: syscall.ELOOP}
+		}
+	}
+	return filepath.Join(fpath, elems[len(elems)-1]), nil
 }
 
 // Return the system's underlying path for the ref.
 // Assumes fs.Base is a valid full-path on the
-// host filesystem.  Also assumes ref.Path is
-// a valid internal path.
-func (ref FileRef) fullPath() string {
-	return filepath.Join(ref.fs.Base, filepath.FromSlash(ref.Path))
+// host filesystem.
+func (ref FileRef) fullPath() (string, error) {
+	return ref.fs.fullPath(ref.Path)
+}
+
+// Return the system's underlying path for the ref, to be used by calls
+// following a symbolic link in its last element.  The ref may not be one.
+func (ref FileRef) followPath() (string, error) {
+	fpath, err := ref.fullPath()
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Lstat(fpath)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return "", &os.PathError{Op: "follow", Path: ref.Path,
+			Err: syscall.ELOOP}
+	}
+	return fpath, nil
+}
+
+// checkTarget refuses a symbolic link target, relative to the directory
+// dir, unless it stays inside our domain: it may not be absolute, climb
+// above the root, or pass through another symbolic link.
+func (fs *fServer) checkTarget(dir, target string) error {
+	if path.IsAbs(target) {
+		return syscall.EPERM
+	}
+	elems := strings.Split(target, "/")
+	for i, name := range elems {
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if dir == "/" {
+				return syscall.EPERM
+			}
+			dir = path.Dir(dir)
+			continue
+		}
+		dir = path.Join(dir, name)
+		if i == len(elems)-1 {
+			break
+		}
+		fpath, err := fs.fullPath(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		info, err := os.Lstat(fpath)
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return syscall.EPERM
+		}
+	}
+	return nil
 }
 
 // Create a new FileRef pointing to absolute path, p
@@ -61,7 +135,7 @@ func (fs *fServer) newRef(p string) (*FileRef, error) {
 	if err != nil {
 		return nil, err
 	}
-	info, err := os.Stat(fpath)
+	info, err := os.Lstat(fpath)
 	if err != nil {
 		return nil, err
 	}
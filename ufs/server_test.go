@@ -1,9 +1,17 @@
 package ufs
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"net"
+	"os"
+	"path/filepath"
 	"sync"
+	"syscall"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"github.com/frobnitzem/go-p9p"
@@ -122,3 +130,850 @@ func TestServer(t *testing.T) {
 	cancel() // signal the server to stop serving
 	wg.Wait()
 }
+
+/** Mount the server over 9P2000.L, the way the Linux kernel would.
+ */
+func TestServerL(t *testing.T) {
+	var wg sync.WaitGroup
+	assert := assert.New(t)
+
+	ctx := context.Background()
+	sctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+
+	reqC, repC := net.Pipe()
+	root := t.TempDir()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		session := p9p.SFileSys(NewServer(sctx, root))
+		err := p9p.ServeConn(sctx, repC, p9p.SSession(session))
+		assert.NotNil(err)
+	}()
+
+	session, err := p9p.CSessionL(ctx, reqC)
+	assert.Nil(err)
+	if err != nil {
+		cancel()
+		wg.Wait()
+		return
+	}
+
+	_, version := session.Version()
+	assert.Equal(p9p.Version9P2000L, version)
+
+	fid0, fid1, fid2 := p9p.Fid(0), p9p.Fid(1), p9p.Fid(2)
+
+	_, err = session.Attach(ctx, fid0, p9p.NOFID, "user1", "/")
+	assert.Nil(err)
+
+	qid, err := session.Mkdir(ctx, fid0, "dir", 0755, 0)
+	assert.Nil(err)
+	assert.True(qid.Type&p9p.QTDIR != 0)
+
+	// Create a file and write to it.
+	_, err = session.Walk(ctx, fid0, fid1, "dir")
+	assert.Nil(err)
+	_, _, err = session.LCreate(ctx, fid1, "file", p9p.LORDWR, 0644, 0)
+	assert.Nil(err)
+	n, err := session.Write(ctx, fid1, []byte("hello"), 0)
+	assert.Nil(err)
+	assert.Equal(5, n)
+	assert.Nil(session.Fsync(ctx, fid1, false))
+
+	attr, err := session.GetAttr(ctx, fid1, p9p.AttrBasic)
+	assert.Nil(err)
+	assert.Equal(uint64(5), attr.Size)
+	assert.Equal(uint32(p9p.SIFREG|0644), attr.Mode)
+
+	assert.Nil(session.SetAttr(ctx, fid1, p9p.SetAttr{
+		Valid: p9p.SetAttrSize | p9p.SetAttrMode,
+		Size:  2,
+		Mode:  0600,
+	}))
+	attr, err = session.GetAttr(ctx, fid1, p9p.AttrBasic)
+	assert.Nil(err)
+	assert.Equal(uint64(2), attr.Size)
+	assert.Equal(uint32(p9p.SIFREG|0600), attr.Mode)
+	assert.Nil(session.Clunk(ctx, fid1))
+
+	// Symlinks.
+	_, err = session.Walk(ctx, fid0, fid1, "dir")
+	assert.Nil(err)
+	qid, err = session.Symlink(ctx, fid1, "link", "file", 0)
+	assert.Nil(err)
+	assert.True(qid.Type&p9p.QTSYMLINK != 0)
+	_, err = session.Walk(ctx, fid1, fid2, "link")
+	assert.Nil(err)
+	target, err := session.Readlink(ctx, fid2)
+	assert.Nil(err)
+	assert.Equal("file", target)
+	assert.Nil(session.Clunk(ctx, fid2))
+
+	// Symlinks may not lead out of the root, even through other links.
+	_, err = session.Symlink(ctx, fid1, "up", "..", 0)
+	assert.Nil(err)
+	for _, target := range []string{"/", "../..", "up/.."} {
+		_, err = session.Symlink(ctx, fid1, "esc", target, 0)
+		assert.True(errors.Is(err, syscall.EPERM), "%s: %v", target, err)
+	}
+	assert.Nil(session.Unlinkat(ctx, fid1, "up", 0))
+
+	// Nor are links made on the host followed.
+	assert.Nil(os.Symlink("/", filepath.Join(root, "esc")))
+	qids, err := session.Walk(ctx, fid0, fid2, "esc", "etc")
+	assert.Nil(err)
+	assert.Equal(1, len(qids)) // a partial walk, stopped by the link
+	_, err = session.Walk(ctx, fid0, fid2, "esc")
+	assert.Nil(err)
+	_, err = session.Walk(ctx, fid2, p9p.Fid(3), "etc")
+	assert.NotNil(err)
+	_, _, err = session.LOpen(ctx, fid2, 0)
+	assert.True(errors.Is(err, syscall.ELOOP), "%v", err)
+	err = session.SetAttr(ctx, fid2, p9p.SetAttr{
+		Valid: p9p.SetAttrMode, Mode: 0777})
+	assert.True(errors.Is(err, syscall.ELOOP), "%v", err)
+	assert.Nil(session.Clunk(ctx, fid2))
+	assert.Nil(session.Unlinkat(ctx, fid0, "esc", 0))
+
+	// Rename across directories, then list them.
+	assert.Nil(session.Renameat(ctx, fid1, "file", fid0, "moved"))
+
+	_, _, err = session.LOpen(ctx, fid1, 0)
+	assert.Nil(err)
+	entries, err := session.Readdir(ctx, fid1, 0, 1024)
+	assert.Nil(err)
+	if assert.Equal(1, len(entries)) {
+		assert.Equal("link", entries[0].Name)
+		more, err := session.Readdir(ctx, fid1, entries[0].Offset, 1024)
+		assert.Nil(err)
+		assert.Equal(0, len(more))
+	}
+
+	_, err = session.Walk(ctx, fid0, fid2)
+	assert.Nil(err)
+	_, _, err = session.LOpen(ctx, fid2, 0)
+	assert.Nil(err)
+	entries, err = session.Readdir(ctx, fid2, 0, 1024)
+	assert.Nil(err)
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	assert.ElementsMatch([]string{"dir", "moved"}, names)
+	assert.Nil(session.Clunk(ctx, fid2))
+
+	stat, err := session.StatFS(ctx, fid0)
+	assert.Nil(err)
+	assert.True(stat.BSize > 0)
+
+	// Errors carry their errno.
+	err = session.Unlinkat(ctx, fid0, "dir", 0)
+	assert.True(errors.Is(err, syscall.EISDIR), "%v", err)
+	err = session.Unlinkat(ctx, fid0, "missing", 0)
+	assert.True(errors.Is(err, syscall.ENOENT), "%v", err)
+
+	assert.Nil(session.Unlinkat(ctx, fid1, "link", 0))
+	assert.Nil(session.Clunk(ctx, fid1))
+	assert.Nil(session.Unlinkat(ctx, fid0, "dir", p9p.AtRemoveDir))
+	assert.Nil(session.Unlinkat(ctx, fid0, "moved", 0))
+	assert.Nil(session.Clunk(ctx, fid0))
+
+	cancel() // signal the server to stop serving
+	wg.Wait()
+}
+
+/** Restart the server under a reconnecting client session.
+ */
+func TestReconnect(t *testing.T) {
+	var wg sync.WaitGroup
+	assert := assert.New(t)
+
+	ctx := context.Background()
+	sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	root := t.TempDir()
+	assert.Nil(os.WriteFile(filepath.Join(root, "a"), []byte("hello"), 0644))
+	assert.Nil(os.WriteFile(filepath.Join(root, "b"), []byte("world"), 0644))
+
+	// Each dial starts a new server, over the same directory.
+	var servers []net.Conn
+	dial := func(ctx context.Context) (net.Conn, error) {
+		reqC, repC := net.Pipe()
+		servers = append(servers, repC)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session := p9p.SFileSys(NewServer(sctx, root))
+			p9p.ServeConn(sctx, repC, p9p.SSession(session))
+		}()
+		return reqC, nil
+	}
+	restart := func() {
+		servers[len(servers)-1].Close()
+	}
+
+	session, err := p9p.ReconnectingSession(ctx, dial)
+	assert.Nil(err)
+	if err != nil {
+		return
+	}
+
+	fid0, fid1, fid2, fid3 := p9p.Fid(0), p9p.Fid(1), p9p.Fid(2), p9p.Fid(3)
+
+	_, err = session.Attach(ctx, fid0, p9p.NOFID, "user1", "/")
+	assert.Nil(err)
+	_, err = session.Walk(ctx, fid0, fid1, "a")
+	assert.Nil(err)
+	_, _, err = session.Open(ctx, fid1, p9p.OREAD)
+	assert.Nil(err)
+	_, err = session.Walk(ctx, fid0, fid2, "b")
+	assert.Nil(err)
+
+	// Open fids are re-opened.
+	restart()
+	msg := make([]byte, 10)
+	n, err := session.Read(ctx, fid1, msg, 0)
+	assert.Nil(err)
+	assert.Equal("hello", string(msg[:n]))
+	assert.Equal(2, len(servers))
+
+	// Created files are found again by name.
+	_, err = session.Walk(ctx, fid0, fid3)
+	assert.Nil(err)
+	_, _, err = session.Create(ctx, fid3, "c", 0644, p9p.ORDWR|p9p.OTRUNC)
+	assert.Nil(err)
+	_, err = session.Write(ctx, fid3, []byte("abcd"), 0)
+	assert.Nil(err)
+
+	// Replace b while the server is away.
+	restart()
+	tmp := filepath.Join(root, "b.new")
+	assert.Nil(os.WriteFile(tmp, []byte("again"), 0644))
+	assert.Nil(os.Rename(tmp, filepath.Join(root, "b")))
+
+	n, err = session.Read(ctx, fid3, msg, 0)
+	assert.Nil(err)
+	assert.Equal("abcd", string(msg[:n]), "OTRUNC is not repeated")
+	assert.Equal(3, len(servers))
+
+	_, err = session.Stat(ctx, fid2)
+	assert.True(errors.Is(err, p9p.ErrStale), "%v", err)
+	var stale *p9p.StaleError
+	if assert.True(errors.As(err, &stale)) {
+		assert.Equal([]string{"b"}, stale.Path)
+	}
+	_, err = session.Stat(ctx, fid2)
+	assert.True(errors.Is(err, p9p.ErrStale), "%v", err)
+	assert.Nil(session.Clunk(ctx, fid2))
+
+	// The root survives too.
+	_, err = session.Walk(ctx, fid0, fid2, "b")
+	assert.Nil(err)
+	assert.Nil(session.Clunk(ctx, fid2))
+
+	assert.Nil(session.Clunk(ctx, fid3))
+	assert.Nil(session.Clunk(ctx, fid1))
+	assert.Nil(session.Clunk(ctx, fid0))
+	session.Stop(nil)
+
+	_, err = session.Attach(ctx, fid0, p9p.NOFID, "user1", "/")
+	assert.Equal(p9p.ErrClosed, err)
+
+	cancel()
+	wg.Wait()
+}
+
+/** Read a large directory, over 9P2000.L so that entries use the
+ *  extended encoding.
+ */
+func TestReaddir(t *testing.T) {
+	var wg sync.WaitGroup
+	assert := assert.New(t)
+
+	ctx := context.Background()
+	sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+
+	reqC, repC := net.Pipe()
+	root := t.TempDir()
+	var names []string
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("file%03d", i)
+		names = append(names, name)
+		assert.Nil(os.WriteFile(filepath.Join(root, name), nil, 0644))
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		session := p9p.SFileSys(NewServer(sctx, root))
+		p9p.ServeConn(sctx, repC, p9p.SSession(session))
+	}()
+
+	session, err := p9p.CSessionL(ctx, reqC)
+	assert.Nil(err)
+	if err != nil {
+		cancel()
+		wg.Wait()
+		return
+	}
+
+	fid0, fid1, fid2 := p9p.Fid(0), p9p.Fid(1), p9p.Fid(2)
+	_, err = session.Attach(ctx, fid0, p9p.NOFID, "user1", "/")
+	assert.Nil(err)
+
+	dirs, err := p9p.ReaddirAll(ctx, session, fid0, fid1)
+	assert.Nil(err)
+	got := []string{}
+	for _, d := range dirs {
+		got = append(got, d.Name)
+	}
+	assert.ElementsMatch(names, got)
+
+	// fid1 was clunked.
+	_, err = session.Walk(ctx, fid0, fid1)
+	assert.Nil(err)
+
+	// Stream the entries, a few at a time.
+	_, _, err = session.Open(ctx, fid1, p9p.OREAD)
+	assert.Nil(err)
+	dr, err := p9p.NewDirReader(session, fid1, 200)
+	assert.Nil(err)
+	got = got[:0]
+	for {
+		d, err := dr.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if !assert.Nil(err) {
+			break
+		}
+		got = append(got, d.Name)
+	}
+	assert.ElementsMatch(names, got)
+	assert.Nil(session.Clunk(ctx, fid1))
+
+	// Through CFileSys.
+	fs := p9p.CFileSys(session)
+	ent, err := fs.Attach(ctx, "user1", "/", nil)
+	assert.Nil(err)
+	next, err := ent.OpenDir(ctx)
+	assert.Nil(err)
+	got = got[:0]
+	for {
+		dirs, err := next(ctx)
+		if !assert.Nil(err) || len(dirs) == 0 {
+			break
+		}
+		for _, d := range dirs {
+			got = append(got, d.Name)
+		}
+	}
+	assert.ElementsMatch(names, got)
+	assert.Nil(ent.Clunk(ctx))
+
+	_, err = p9p.ReaddirAll(ctx, session, fid2, fid1)
+	assert.NotNil(err)
+	assert.Nil(session.Clunk(ctx, fid0))
+
+	cancel()
+	wg.Wait()
+}
+
+/** Walk paths longer than a single Twalk allows.
+ */
+func TestLongWalk(t *testing.T) {
+	var wg sync.WaitGroup
+	assert := assert.New(t)
+
+	ctx := context.Background()
+	sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+
+	reqC, repC := net.Pipe()
+	root := t.TempDir()
+	var names []string
+	for i := 0; i < 40; i++ {
+		names = append(names, fmt.Sprintf("d%d", i))
+	}
+	assert.Nil(os.MkdirAll(filepath.Join(append([]string{root}, names...)...), 0755))
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		session := p9p.SFileSys(NewServer(sctx, root))
+		p9p.ServeConn(sctx, repC, p9p.SSession(session))
+	}()
+
+	session, err := p9p.CSession(ctx, reqC)
+	assert.Nil(err)
+	if err != nil {
+		cancel()
+		wg.Wait()
+		return
+	}
+
+	fid0, fid1 := p9p.Fid(0), p9p.Fid(1)
+	_, err = session.Attach(ctx, fid0, p9p.NOFID, "user1", "/")
+	assert.Nil(err)
+
+	qids, err := session.Walk(ctx, fid0, fid1, names...)
+	assert.Nil(err)
+	assert.Equal(40, len(qids))
+	dir, err := session.Stat(ctx, fid1)
+	assert.Nil(err)
+	assert.Equal("d39", dir.Name)
+	assert.Nil(session.Clunk(ctx, fid1))
+
+	_, err = session.Walk(ctx, fid0, fid0, names...)
+	assert.Equal(p9p.ErrWalkLimit, err)
+
+	// A partial walk leaves newfid alone, whichever Twalk stops.
+	missing := append(append([]string{}, names[:30]...), "nothere", "d31")
+	qids, err = session.Walk(ctx, fid0, fid1, missing...)
+	assert.Nil(err)
+	assert.Equal(30, len(qids))
+	assert.NotNil(session.Clunk(ctx, fid1))
+
+	// Through CFileSys, the failing element is reported.
+	fs := p9p.CFileSys(session)
+	ent, err := fs.Attach(ctx, "user1", "/", nil)
+	assert.Nil(err)
+	qids, _, err = ent.Walk(ctx, missing...)
+	assert.Equal(30, len(qids))
+	var werr *p9p.WalkError
+	if assert.True(errors.As(err, &werr), "%v", err) {
+		assert.Equal(30, werr.Index())
+		assert.Equal("nothere", werr.Name())
+	}
+	// Including when the first element fails, with the server's error.
+	qids, _, err = ent.Walk(ctx, "nothere", "d0")
+	assert.Equal(0, len(qids))
+	if assert.True(errors.As(err, &werr), "%v", err) {
+		assert.Equal(0, werr.Index())
+		assert.Equal("nothere", werr.Name())
+		assert.NotNil(werr.Err)
+	}
+	assert.True(errors.Is(err, os.ErrNotExist), "%v", err)
+	qids, next, err := ent.Walk(ctx, names...)
+	assert.Nil(err)
+	assert.Equal(40, len(qids))
+	assert.Equal(qids[39], next.Qid())
+	assert.Nil(next.Clunk(ctx))
+	assert.Nil(ent.Clunk(ctx))
+	assert.Nil(session.Clunk(ctx, fid0))
+
+	cancel()
+	wg.Wait()
+}
+
+/** Use the os-like Client API.
+ */
+func TestClient(t *testing.T) {
+	var wg sync.WaitGroup
+	assert := assert.New(t)
+
+	ctx := context.Background()
+	sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+
+	reqC, repC := net.Pipe()
+	root := t.TempDir()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		session := p9p.SFileSys(NewServer(sctx, root))
+		p9p.ServeConn(sctx, repC, p9p.SSession(session))
+	}()
+
+	session, err := p9p.CSession(ctx, reqC)
+	assert.Nil(err)
+	if err != nil {
+		cancel()
+		wg.Wait()
+		return
+	}
+
+	client, err := p9p.NewClient(ctx, session, "user1", "/")
+	assert.Nil(err)
+
+	assert.Nil(client.MkdirAll("/a/b/c", 0755))
+	assert.Nil(client.MkdirAll("a/b", 0755))
+	info, err := client.Stat("a/b/c")
+	assert.Nil(err)
+	assert.True(info.IsDir())
+	assert.Equal("c", info.Name())
+
+	_, err = client.Stat("a/missing")
+	assert.True(errors.Is(err, fs.ErrNotExist), "%v", err)
+	_, err = client.Open("a/missing/deeper")
+	assert.True(errors.Is(err, fs.ErrNotExist), "%v", err)
+
+	// Large enough to take several pipelined requests.
+	data := make([]byte, 200<<10)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	assert.Nil(client.WriteFile("a/file", data, 0640))
+	got, err := client.ReadFile("a/file")
+	assert.Nil(err)
+	assert.Equal(data, got)
+	info, err = client.Stat("a/file")
+	assert.Nil(err)
+	assert.Equal(int64(len(data)), info.Size())
+	assert.Equal(fs.FileMode(0640), info.Mode())
+
+	f, err := client.OpenFile("a/file", os.O_RDWR, 0)
+	assert.Nil(err)
+	off, err := f.Seek(-10, io.SeekEnd)
+	assert.Nil(err)
+	assert.Equal(int64(len(data)-10), off)
+	n, err := f.Write([]byte("0123456789abc"))
+	assert.Nil(err)
+	assert.Equal(13, n)
+	_, err = f.Seek(-3, io.SeekCurrent)
+	assert.Nil(err)
+	p := make([]byte, 10)
+	n, err = f.Read(p)
+	assert.Nil(err)
+	assert.Equal("abc", string(p[:n]))
+	_, err = f.Read(p)
+	assert.Equal(io.EOF, err)
+	n, err = f.ReadAt(p, 0)
+	assert.Nil(err)
+	assert.Equal(data[:10], p[:n])
+	assert.Nil(f.Close())
+	assert.True(errors.Is(f.Close(), fs.ErrClosed))
+
+	_, err = client.OpenFile("a/file", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	assert.True(errors.Is(err, fs.ErrExist), "%v", err)
+
+	f, err = client.OpenFile("a/log", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	assert.Nil(err)
+	f.Write([]byte("one "))
+	f.Write([]byte("two"))
+	assert.Nil(f.Close())
+	got, err = client.ReadFile("a/log")
+	assert.Nil(err)
+	assert.Equal("one two", string(got))
+
+	assert.Nil(client.Rename("a/log", "a/log.old"))
+	var lerr *os.LinkError
+	assert.True(errors.As(client.Rename("a/log.old", "a/b/log"), &lerr))
+
+	entries, err := client.ReadDir("a")
+	assert.Nil(err)
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.Equal([]string{"b", "file", "log.old"}, names)
+	assert.True(entries[0].IsDir())
+
+	assert.Nil(client.Remove("a/log.old"))
+	assert.Nil(client.Remove("a/file"))
+	assert.NotNil(client.Remove("a/b"))
+	assert.Nil(client.Remove("a/b/c"))
+	assert.Nil(client.Close())
+
+	cancel()
+	wg.Wait()
+}
+
+/** Check the io/fs adapter against testing/fstest.
+ */
+func TestFS(t *testing.T) {
+	var wg sync.WaitGroup
+	assert := assert.New(t)
+
+	ctx := context.Background()
+	sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+
+	reqC, repC := net.Pipe()
+	root := t.TempDir()
+	assert.Nil(os.MkdirAll(filepath.Join(root, "a", "b"), 0755))
+	assert.Nil(os.WriteFile(filepath.Join(root, "a", "hello.txt"), []byte("hello"), 0644))
+	assert.Nil(os.WriteFile(filepath.Join(root, "a", "b", "small"), []byte("small"), 0644))
+	assert.Nil(os.WriteFile(filepath.Join(root, "secret"), nil, 0))
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		session := p9p.SFileSys(NewServer(sctx, root))
+		p9p.ServeConn(sctx, repC, p9p.SSession(session))
+	}()
+
+	session, err := p9p.CSession(ctx, reqC)
+	assert.Nil(err)
+	if err != nil {
+		cancel()
+		wg.Wait()
+		return
+	}
+
+	ent, err := p9p.CFileSys(session).Attach(ctx, "user1", "/", nil)
+	assert.Nil(err)
+	fsys := p9p.NewFS(ctx, ent)
+
+	assert.Nil(fstest.TestFS(fsys, "a/hello.txt", "a/b/small", "secret"))
+
+	data, err := fs.ReadFile(fsys, "a/hello.txt")
+	assert.Nil(err)
+	assert.Equal("hello", string(data))
+
+	_, err = fs.Stat(fsys, "a/nothere")
+	assert.True(errors.Is(err, fs.ErrNotExist), "%v", err)
+	_, err = fsys.Open("/a")
+	assert.True(errors.Is(err, fs.ErrInvalid), "%v", err)
+	if os.Geteuid() != 0 {
+		_, err = fsys.Open("secret")
+		assert.True(errors.Is(err, fs.ErrPermission), "%v", err)
+	}
+
+	var walked []string
+	assert.Nil(fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		walked = append(walked, p)
+		return err
+	}))
+	assert.Equal([]string{".", "a", "a/b", "a/b/small", "a/hello.txt", "secret"}, walked)
+
+	assert.Nil(ent.Clunk(ctx))
+	cancel()
+	wg.Wait()
+}
+
+/** A Mux routes attaches to separate trees by aname.
+ */
+func TestMux(t *testing.T) {
+	var wg sync.WaitGroup
+	assert := assert.New(t)
+
+	ctx := context.Background()
+	sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+
+	mux := p9p.NewMux()
+	mux.Handle("a", NewServer(sctx, t.TempDir()))
+	mux.Handle("/b/", NewServer(sctx, t.TempDir()))
+
+	// Each client attaches over its own connection.
+	attach := func(aname string) (*p9p.Client, error) {
+		reqC, repC := net.Pipe()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session := p9p.SFileSys(mux)
+			p9p.ServeConn(sctx, repC, p9p.SSession(session))
+		}()
+
+		session, err := p9p.CSession(ctx, reqC)
+		if err != nil {
+			return nil, err
+		}
+		return p9p.NewClient(ctx, session, "user1", aname)
+	}
+
+	a, err := attach("a")
+	assert.Nil(err)
+	assert.Nil(a.WriteFile("x", []byte("in a"), 0644))
+
+	b, err := attach("/b/one")
+	assert.Nil(err)
+	_, err = b.Stat("x")
+	assert.NotNil(err)
+	assert.Nil(b.WriteFile("y", []byte("in b"), 0644))
+
+	// Anames with the same prefix reach the same tree.
+	b2, err := attach("/b/two")
+	assert.Nil(err)
+	data, err := b2.ReadFile("y")
+	assert.Nil(err)
+	assert.Equal("in b", string(data))
+
+	_, err = attach("ab")
+	assert.Equal(p9p.ErrBadattach, err)
+	_, err = attach("/b")
+	assert.Equal(p9p.ErrBadattach, err)
+
+	mux.HandleDefault(mux.Route("a"))
+	c, err := attach("ab")
+	assert.Nil(err)
+	data, err = c.ReadFile("x")
+	assert.Nil(err)
+	assert.Equal("in a", string(data))
+
+	cancel()
+	wg.Wait()
+}
+
+/** A Namespace unions a scratch tree over an export, and replaces a
+ * directory by other trees.
+ */
+func TestNamespace(t *testing.T) {
+	var wg sync.WaitGroup
+	assert := assert.New(t)
+
+	ctx := context.Background()
+	sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+
+	tree := func(files map[string]string) string {
+		dir := t.TempDir()
+		for name, data := range files {
+			p := filepath.Join(dir, name)
+			assert.Nil(os.MkdirAll(filepath.Dir(p), 0755))
+			assert.Nil(os.WriteFile(p, []byte(data), 0644))
+		}
+		return dir
+	}
+	base := tree(map[string]string{"a": "base a", "b": "base b", "d/f": "f"})
+	scratch := tree(map[string]string{"a": "scratch a"})
+	other := tree(map[string]string{"g": "g"})
+	extra := tree(map[string]string{"h": "h", "g": "not g"})
+
+	ns := p9p.NewNamespace(NewServer(sctx, base))
+	assert.Nil(ns.Bind(NewServer(sctx, scratch), "/", p9p.MBEFORE|p9p.MCREATE))
+	assert.Nil(ns.Bind(NewServer(sctx, other), "/d", p9p.MREPL))
+	assert.Nil(ns.Bind(NewServer(sctx, extra), "d", p9p.MAFTER))
+	assert.NotNil(ns.Bind(NewServer(sctx, extra), "/", p9p.MBEFORE|p9p.MAFTER))
+
+	reqC, repC := net.Pipe()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		session := p9p.SFileSys(ns)
+		p9p.ServeConn(sctx, repC, p9p.SSession(session))
+	}()
+
+	session, err := p9p.CSession(ctx, reqC)
+	assert.Nil(err)
+	client, err := p9p.NewClient(ctx, session, "user1", "/")
+	assert.Nil(err)
+
+	names := func(dir string) []string {
+		entries, err := client.ReadDir(dir)
+		assert.Nil(err)
+		var ret []string
+		for _, e := range entries {
+			ret = append(ret, e.Name())
+		}
+		return ret
+	}
+
+	// The first member holding a name wins.
+	assert.Equal([]string{"a", "b", "d"}, names("."))
+	data, err := client.ReadFile("a")
+	assert.Nil(err)
+	assert.Equal("scratch a", string(data))
+	data, err = client.ReadFile("b")
+	assert.Nil(err)
+	assert.Equal("base b", string(data))
+
+	// The directory d is replaced.
+	assert.Equal([]string{"g", "h"}, names("d"))
+	_, err = client.Stat("d/f")
+	assert.NotNil(err)
+	data, err = client.ReadFile("d/g")
+	assert.Nil(err)
+	assert.Equal("g", string(data))
+	info, err := client.Stat("d")
+	assert.Nil(err)
+	assert.Equal("d", info.Name())
+
+	// Creation goes to the scratch tree, and is not allowed in d.
+	assert.Nil(client.WriteFile("new", []byte("new"), 0644))
+	_, err = os.Stat(filepath.Join(scratch, "new"))
+	assert.Nil(err)
+	_, err = os.Stat(filepath.Join(base, "new"))
+	assert.True(errors.Is(err, fs.ErrNotExist))
+	assert.NotNil(client.WriteFile("d/new", nil, 0644))
+
+	// Walking ".." leaves the bound tree.
+	fid0, fid1 := p9p.Fid(100), p9p.Fid(101)
+	qid, err := session.Attach(ctx, fid0, p9p.NOFID, "user1", "/")
+	assert.Nil(err)
+	_, err = session.Walk(ctx, fid0, fid1, "d")
+	assert.Nil(err)
+	qids, err := session.Walk(ctx, fid1, fid1, "..")
+	assert.Nil(err)
+	if assert.Equal(1, len(qids)) {
+		assert.Equal(qid, qids[0])
+	}
+	qids, err = session.Walk(ctx, fid1, fid1, "d", "g", "x")
+	assert.Nil(err)
+	assert.Equal(2, len(qids))
+	assert.Nil(session.Clunk(ctx, fid1))
+	assert.Nil(session.Clunk(ctx, fid0))
+
+	assert.Nil(client.Close())
+	cancel()
+	wg.Wait()
+}
+
+/** The trees of a Namespace requiring auth are attached with the AuthFile of
+ * the attach, when walking into binds and back up "..".
+ */
+func TestNamespaceAuth(t *testing.T) {
+	var wg sync.WaitGroup
+	assert := assert.New(t)
+
+	ctx := context.Background()
+	sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+
+	base, other := t.TempDir(), t.TempDir()
+	assert.Nil(os.Mkdir(filepath.Join(base, "d"), 0755))
+	assert.Nil(os.WriteFile(filepath.Join(other, "g"), []byte("g"), 0644))
+
+	secrets := p9p.Secrets{"glenda": []byte("s3cret")}
+	ns := p9p.NewNamespace(p9p.HMACAuth(NewServer(sctx, base), secrets))
+	assert.Nil(ns.Bind(p9p.HMACAuth(NewServer(sctx, other), secrets),
+		"/d", p9p.MREPL))
+
+	reqC, repC := net.Pipe()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p9p.ServeConn(sctx, repC, p9p.SSession(p9p.SFileSys(ns)))
+	}()
+
+	session, err := p9p.CSession(ctx, reqC)
+	if !assert.Nil(err) {
+		return
+	}
+	cfs := p9p.CFileSys(session)
+	af, err := p9p.HMACAuthenticate(ctx, cfs, "glenda", "main", secrets["glenda"])
+	if !assert.Nil(err) {
+		return
+	}
+	root, err := cfs.Attach(ctx, "glenda", "main", af)
+	if !assert.Nil(err) {
+		return
+	}
+
+	qids, g, err := root.Walk(ctx, "d", "g")
+	assert.Nil(err)
+	assert.Equal(2, len(qids))
+	if g != nil {
+		assert.Nil(g.Clunk(ctx))
+	}
+	_, d, err := root.Walk(ctx, "d")
+	if assert.Nil(err) {
+		qids, up, err := d.Walk(ctx, "..")
+		assert.Nil(err)
+		assert.Equal(1, len(qids))
+		if up != nil {
+			assert.Nil(up.Clunk(ctx))
+		}
+		assert.Nil(d.Clunk(ctx))
+	}
+	assert.Nil(root.Clunk(ctx))
+	assert.Nil(af.Close(ctx))
+
+	reqC.Close()
+	cancel()
+	wg.Wait()
+}
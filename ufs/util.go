@@ -16,20 +16,30 @@ func dirFromEntry(entry os.DirEntry) (p9p.Dir, error) {
 }
 func dirFromInfo(info os.FileInfo) p9p.Dir {
 	dir := p9p.Dir{}
+	stat := info.Sys().(*syscall.Stat_t)
 
-	dir.Qid.Path = info.Sys().(*syscall.Stat_t).Ino
+	dir.Qid.Path = stat.Ino
 	dir.Qid.Version = uint32(info.ModTime().UnixNano() / 1000000)
 
 	dir.Name = info.Name()
 	dir.Mode = uint32(info.Mode() & 0777)
 	dir.Length = uint64(info.Size())
-	dir.AccessTime = atime(info.Sys().(*syscall.Stat_t))
+	dir.AccessTime = atime(stat)
 	dir.ModTime = info.ModTime()
 	dir.MUID = "none"
 
-	if info.Mode().IsDir() {
+	// Only sent to 9P2000.u clients.
+	dir.NUID = stat.Uid
+	dir.NGID = stat.Gid
+	dir.NMUID = p9p.NONUNAME
+
+	switch {
+	case info.Mode().IsDir():
 		dir.Qid.Type |= p9p.QTDIR
 		dir.Mode |= p9p.DMDIR
+	case info.Mode()&os.ModeSymlink != 0:
+		dir.Qid.Type |= p9p.QTSYMLINK
+		dir.Mode |= p9p.DMSYMLINK
 	}
 
 	return dir
@@ -60,5 +70,8 @@ func oflags(mode p9p.Flag) int {
 		flags |= os.O_TRUNC
 	}
 
+	// Never open the target of a symbolic link, which may be anywhere.
+	flags |= syscall.O_NOFOLLOW
+
 	return flags
 }
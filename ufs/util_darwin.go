@@ -6,8 +6,49 @@ package ufs
 import (
 	"syscall"
 	"time"
+
+	p9p "github.com/frobnitzem/go-p9p"
 )
 
 func atime(stat *syscall.Stat_t) time.Time {
 	return time.Unix(stat.Atimespec.Unix())
 }
+
+func attrFromStat(stat *syscall.Stat_t) p9p.Attr {
+	return p9p.Attr{
+		Mode:      uint32(stat.Mode),
+		UID:       stat.Uid,
+		GID:       stat.Gid,
+		NLink:     uint64(stat.Nlink),
+		RDev:      uint64(stat.Rdev),
+		Size:      uint64(stat.Size),
+		BlkSize:   uint64(stat.Blksize),
+		Blocks:    uint64(stat.Blocks),
+		ATimeSec:  uint64(stat.Atimespec.Sec),
+		ATimeNsec: uint64(stat.Atimespec.Nsec),
+		MTimeSec:  uint64(stat.Mtimespec.Sec),
+		MTimeNsec: uint64(stat.Mtimespec.Nsec),
+		CTimeSec:  uint64(stat.Ctimespec.Sec),
+		CTimeNsec: uint64(stat.Ctimespec.Nsec),
+		BTimeSec:  uint64(stat.Birthtimespec.Sec),
+		BTimeNsec: uint64(stat.Birthtimespec.Nsec),
+	}
+}
+
+func statFS(path string) (p9p.StatFS, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return p9p.StatFS{}, err
+	}
+	return p9p.StatFS{
+		Type:    st.Type,
+		BSize:   st.Bsize,
+		Blocks:  st.Blocks,
+		BFree:   st.Bfree,
+		BAvail:  st.Bavail,
+		Files:   st.Files,
+		FFree:   st.Ffree,
+		FSID:    uint64(uint32(st.Fsid.Val[0])) | uint64(uint32(st.Fsid.Val[1]))<<32,
+		NameLen: 255,
+	}, nil
+}
@@ -6,8 +6,47 @@ package ufs
 import (
 	"syscall"
 	"time"
+
+	p9p "github.com/frobnitzem/go-p9p"
 )
 
 func atime(stat *syscall.Stat_t) time.Time {
 	return time.Unix(stat.Atim.Unix())
 }
+
+func attrFromStat(stat *syscall.Stat_t) p9p.Attr {
+	return p9p.Attr{
+		Mode:      stat.Mode,
+		UID:       stat.Uid,
+		GID:       stat.Gid,
+		NLink:     uint64(stat.Nlink),
+		RDev:      stat.Rdev,
+		Size:      uint64(stat.Size),
+		BlkSize:   uint64(stat.Blksize),
+		Blocks:    uint64(stat.Blocks),
+		ATimeSec:  uint64(stat.Atim.Sec),
+		ATimeNsec: uint64(stat.Atim.Nsec),
+		MTimeSec:  uint64(stat.Mtim.Sec),
+		MTimeNsec: uint64(stat.Mtim.Nsec),
+		CTimeSec:  uint64(stat.Ctim.Sec),
+		CTimeNsec: uint64(stat.Ctim.Nsec),
+	}
+}
+
+func statFS(path string) (p9p.StatFS, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return p9p.StatFS{}, err
+	}
+	return p9p.StatFS{
+		Type:    uint32(st.Type),
+		BSize:   uint32(st.Bsize),
+		Blocks:  st.Blocks,
+		BFree:   st.Bfree,
+		BAvail:  st.Bavail,
+		Files:   st.Files,
+		FFree:   st.Ffree,
+		FSID:    uint64(uint32(st.Fsid.X__val[0])) | uint64(uint32(st.Fsid.X__val[1]))<<32,
+		NameLen: uint32(st.Namelen),
+	}, nil
+}
@@ -2,6 +2,7 @@ package p9p
 
 import (
 	"fmt"
+	"strings"
 
 	"context"
 )
@@ -12,6 +13,110 @@ import (
 // Really, these should be refactored into some sort of channel type that can
 // support resets through version messages during the protocol exchange.
 
+// VersionInfo describes the protocol versions and message sizes a server is
+// able to handle. For a proxy, these are the capabilities of its origin.
+type VersionInfo struct {
+	Versions []string // supported versions, in order of preference
+	MinMSize int      // smallest msize accepted, MinMSize if zero
+	MaxMSize int      // largest msize accepted, DefaultMSize if zero
+}
+
+// Versioner is implemented by Handlers and Sessions declaring the versions
+// they support. ServeConn negotiates the version and msize within these
+// bounds. Sessions not implementing it are assumed to support only the
+// version and msize returned by Session.Version.
+type Versioner interface {
+	Versions() VersionInfo
+}
+
+func (v VersionInfo) minMSize() int {
+	if v.MinMSize <= 0 {
+		return MinMSize
+	}
+	return v.MinMSize
+}
+
+func (v VersionInfo) maxMSize() int {
+	if v.MaxMSize <= 0 {
+		return DefaultMSize
+	}
+	return v.MaxMSize
+}
+
+// sessionVersions returns the versions a session is able to serve.
+func sessionVersions(session Session) VersionInfo {
+	var info VersionInfo
+	if v, ok := session.(Versioner); ok {
+		info = v.Versions()
+	} else {
+		msize, version := session.Version()
+		info = VersionInfo{Versions: []string{version}, MaxMSize: msize}
+	}
+
+	// The 9P2000.L messages can only be dispatched to a SessionL.
+	if _, ok := session.(SessionL); !ok {
+		var versions []string
+		for _, v := range info.Versions {
+			if v != Version9P2000L {
+				versions = append(versions, v)
+			}
+		}
+		info.Versions = versions
+	}
+	return info
+}
+
+// codecChannel is implemented by channels able to switch their codec once a
+// protocol version other than 9P2000 has been negotiated.
+type codecChannel interface {
+	Channel
+	SetCodec(codec Codec)
+}
+
+// setChannelVersion selects the codec of ch for the negotiated version.
+func setChannelVersion(ch Channel, version string) error {
+	codec, err := NewCodecVersion(version)
+	if err != nil {
+		return err
+	}
+
+	if cch, ok := ch.(codecChannel); ok {
+		cch.SetCodec(codec)
+		return nil
+	}
+
+	if version != Version9P2000 {
+		return fmt.Errorf("channel cannot speak version %v", version)
+	}
+
+	return nil
+}
+
+// pickVersion returns the version a server answers with when the client
+// proposes version. The supported versions are listed in order of
+// preference. If none is acceptable, "unknown" is returned.
+func pickVersion(version string, supported []string) string {
+	for _, v := range supported {
+		if v == version {
+			return v
+		}
+	}
+
+	// version(5) says "The server may respond with the client’s version
+	// string, or a version string identifying an earlier defined protocol
+	// version." Every dialect we know is a suffixed 9P2000, so fall back to
+	// that if we have it.
+	if strings.HasPrefix(version, Version9P2000) {
+		for _, v := range supported {
+			if v == Version9P2000 {
+				return v
+			}
+		}
+	}
+
+	return "unknown"
+}
+
 // clientnegotiate negiotiates the protocol version using channel, blocking
 // until a response is received. The received value will be the version
 // implemented by the server.
@@ -33,9 +138,15 @@ func clientnegotiate(ctx context.Context, ch Channel, version string) (string, e
 	switch v := resp.Message.(type) {
 	case MessageRversion:
 
-		if v.Version != version {
+		// The server may only answer with our version or downgrade us to
+		// the base protocol.
+		if v.Version != version && v.Version != Version9P2000 {
 			// TODO(stevvooe): A stubborn client indeed!
-			return "", fmt.Errorf("unsupported server version: %v", version)
+			return "", fmt.Errorf("unsupported server version: %v", v.Version)
+		}
+
+		if err := setChannelVersion(ch, v.Version); err != nil {
+			return "", err
 		}
 
 		if int(v.MSize) < ch.MSize() {
@@ -52,8 +163,11 @@ func clientnegotiate(ctx context.Context, ch Channel, version string) (string, e
 }
 
 // servernegotiate blocks until a version message is received or a timeout
-// occurs. The msize for the tranport will be set from the negotiation. If
-// negotiate returns nil, a server may proceed with the connection.
+// occurs. The msize and codec for the tranport will be set from the
+// negotiation. If negotiate returns no error, a server may proceed with the
+// connection using the returned version. The version is picked from those
+// supported, and the msize is the smaller of the client's and the largest
+// supported.
 //
 // In the future, it might be better to handle the version messages in a
 // separate object that manages the session. Each set of version requests
@@ -61,52 +175,66 @@ func clientnegotiate(ctx context.Context, ch Channel, version string) (string, e
 // outstanding IO is aborted. This is probably slightly racy, in practice with
 // a misbehaved client. The main issue is that we cannot tell which session
 // messages belong to.
-func servernegotiate(ctx context.Context, ch Channel, version string) error {
+func servernegotiate(ctx context.Context, ch Channel, supported VersionInfo) (string, error) {
 	// wait for the version message over the transport.
 	req := new(Fcall)
 	if err := ch.ReadFcall(ctx, req); err != nil {
-		return err
+		return "", err
 	}
 
 	mv, ok := req.Message.(MessageTversion)
 	if !ok {
-		return fmt.Errorf("expected version message: %v", mv)
+		return "", fmt.Errorf("expected version message: %v", mv)
 	}
 
-	respmsg := MessageRversion{
-		Version: version,
+	version, err := serverversion(ctx, ch, mv, supported)
+	if err != nil {
+		return "", err
 	}
 
-	if mv.Version != version {
-		// TODO(stevvooe): Not the best place to do version handling. We need
-		// to have a way to pass supported versions into this method then have
-		// it return the actual version. For now, respond with 9P2000 for
-		// anything that doesn't match the provided version string.
-		//
-		// version(9) says "The server may respond with the client’s
-		// version string, or a version string identifying an earlier
-		// defined protocol version. Currently, the only defined
-		// version is the 6 characters 9P2000." Therefore, it is always
-		// OK to respond with this.
-		respmsg.Version = "9P2000"
-	}
-
-	if int(mv.MSize) < ch.MSize() {
-		// if the server msize is too large, use the client's suggested msize.
-		ch.SetMSize(int(mv.MSize))
-		respmsg.MSize = mv.MSize
-	} else {
-		respmsg.MSize = uint32(ch.MSize())
+	if version == "unknown" {
+		return "", fmt.Errorf("bad version negotiation")
+	}
+
+	return version, nil
+}
+
+// serverversion answers the version request mv, then sets the msize and
+// codec of ch accordingly. If no version is acceptable, "unknown" is
+// returned without error, after telling the client so.
+func serverversion(ctx context.Context, ch Channel, mv MessageTversion, supported VersionInfo) (string, error) {
+	msize := int(mv.MSize)
+	if max := supported.maxMSize(); msize > max {
+		msize = max
+	}
+	if msize < supported.minMSize() {
+		err := MessageRerror{Ename: fmt.Sprintf("msize %v too small", mv.MSize)}
+		if werr := ch.WriteFcall(ctx, newErrorFcall(NOTAG, err)); werr != nil {
+			return "", werr
+		}
+		return "", err
 	}
+	ch.SetMSize(msize)
 
+	respmsg := MessageRversion{
+		Version: pickVersion(mv.Version, supported.Versions),
+		MSize:   uint32(msize),
+	}
+
+	// Version messages are encoded alike in every dialect.
 	resp := newFcall(NOTAG, respmsg)
 	if err := ch.WriteFcall(ctx, resp); err != nil {
-		return err
+		return "", err
 	}
 
 	if respmsg.Version == "unknown" {
-		return fmt.Errorf("bad version negotiation")
+		return respmsg.Version, nil
 	}
 
-	return nil
+	// The response went out in the base encoding. Switch afterwards.
+	if err := setChannelVersion(ch, respmsg.Version); err != nil {
+		return "", err
+	}
+
+	return respmsg.Version, nil
 }
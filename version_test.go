@@ -0,0 +1,203 @@
+package p9p
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiate(t *testing.T) {
+	for _, testcase := range []struct {
+		client   string
+		expected string
+	}{
+		{Version9P2000u, Version9P2000u},
+		{Version9P2000, Version9P2000},
+		{"9P2000.xyz", Version9P2000},
+		{"unsupported", "unknown"},
+	} {
+		t.Run(testcase.client, func(t *testing.T) {
+			assert := assert.New(t)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			cc, sc := net.Pipe()
+			defer cc.Close()
+			defer sc.Close()
+			cch := newChannel(cc, codec9p{}, 1024)
+			sch := newChannel(sc, codec9p{}, 2048)
+
+			done := make(chan string)
+			go func() {
+				version, _ := servernegotiate(ctx, sch, VersionInfo{Versions: serverVersions})
+				done <- version
+			}()
+
+			version, err := clientnegotiate(ctx, cch, testcase.client)
+			if testcase.expected == "unknown" {
+				assert.NotNil(err)
+				assert.Equal("", <-done)
+				return
+			}
+			assert.Nil(err)
+			assert.Equal(testcase.expected, version)
+			assert.Equal(testcase.expected, <-done)
+			assert.Equal(1024, sch.MSize())
+
+			codec, _ := NewCodecVersion(testcase.expected)
+			assert.Equal(codec, cch.codec)
+			assert.Equal(codec, sch.codec)
+		})
+	}
+}
+
+func TestNegotiateMSize(t *testing.T) {
+	for _, testcase := range []struct {
+		description string
+		client      int
+		supported   VersionInfo
+		expected    int // zero if negotiation must fail
+	}{
+		{"client smaller", 1024, VersionInfo{Versions: serverVersions}, 1024},
+		{"server smaller", 4096, VersionInfo{Versions: serverVersions, MaxMSize: 2048}, 2048},
+		{"below minimum", 1024, VersionInfo{Versions: serverVersions, MinMSize: 2048}, 0},
+		{"no common version", 1024, VersionInfo{Versions: []string{Version9P2000L}}, 0},
+	} {
+		t.Run(testcase.description, func(t *testing.T) {
+			assert := assert.New(t)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			cc, sc := net.Pipe()
+			defer cc.Close()
+			defer sc.Close()
+			cch := newChannel(cc, codec9p{}, testcase.client)
+			sch := newChannel(sc, codec9p{}, testcase.supported.maxMSize())
+
+			done := make(chan error)
+			go func() {
+				_, err := servernegotiate(ctx, sch, testcase.supported)
+				done <- err
+			}()
+
+			_, err := clientnegotiate(ctx, cch, Version9P2000)
+			serr := <-done
+			if testcase.expected == 0 {
+				assert.NotNil(err)
+				assert.NotNil(serr)
+				return
+			}
+			assert.Nil(err)
+			assert.Nil(serr)
+			assert.Equal(testcase.expected, cch.MSize())
+			assert.Equal(testcase.expected, sch.MSize())
+		})
+	}
+}
+
+func TestSessionVersions(t *testing.T) {
+	assert := assert.New(t)
+
+	// A proxy offers what its origin negotiated.
+	c := &client{version: Version9P2000u, msize: 8192}
+	info := SSession(c).(Versioner).Versions()
+	assert.Equal([]string{Version9P2000u}, info.Versions)
+	assert.Equal(8192, info.maxMSize())
+
+	// 9P2000.L is only offered to sessions able to serve it.
+	info = sessionVersions(SFileSys(nil))
+	assert.Equal(Version9P2000L, info.Versions[0])
+	info = sessionVersions(&client{version: Version9P2000L, msize: 8192})
+	assert.Equal(0, len(info.Versions))
+	info = sessionVersions(clientL{&client{version: Version9P2000L, msize: 8192}})
+	assert.Equal([]string{Version9P2000L}, info.Versions)
+}
+
+// resetHandler blocks on Tread until its request is aborted, and answers
+// anything else with an Rstat.
+type resetHandler struct {
+	mu      sync.Mutex
+	resets  int
+	msize   int
+	aborted chan struct{}
+}
+
+func (h *resetHandler) Handle(ctx context.Context, msg Message) (Message, error) {
+	switch msg.(type) {
+	case MessageTread:
+		<-ctx.Done()
+		close(h.aborted)
+		return nil, ctx.Err()
+	}
+
+	h.mu.Lock()
+	h.msize = GetMSize(ctx)
+	h.mu.Unlock()
+	return MessageRstat{}, nil
+}
+
+func (h *resetHandler) Reset(ctx context.Context) error {
+	h.mu.Lock()
+	h.resets++
+	h.mu.Unlock()
+	return nil
+}
+
+func (h *resetHandler) Stop(err error) error {
+	return err
+}
+
+func TestVersionReset(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	h := &resetHandler{aborted: make(chan struct{})}
+	go ServeConn(ctx, sc, h)
+
+	ch := NewChannel(cc, 8192)
+	call := func(tag Tag, msg Message) Message {
+		assert.Nil(ch.WriteFcall(ctx, newFcall(tag, msg)))
+		resp := new(Fcall)
+		assert.Nil(ch.ReadFcall(ctx, resp))
+		assert.Equal(tag, resp.Tag)
+		return resp.Message
+	}
+
+	assert.Equal(MessageRversion{MSize: 8192, Version: Version9P2000},
+		call(NOTAG, MessageTversion{MSize: 8192, Version: Version9P2000}))
+
+	// An outstanding request is aborted by the new version, and gets no
+	// response.
+	assert.Nil(ch.WriteFcall(ctx, newFcall(1, MessageTread{Fid: 1, Count: 10})))
+	assert.Equal(MessageRversion{MSize: 4096, Version: Version9P2000},
+		call(NOTAG, MessageTversion{MSize: 4096, Version: Version9P2000}))
+	<-h.aborted
+
+	call(2, MessageTstat{Fid: 1})
+	h.mu.Lock()
+	assert.Equal(1, h.resets)
+	assert.Equal(4096, h.msize)
+	h.mu.Unlock()
+
+	// A tombstone version leaves the connection without a session.
+	assert.Equal(MessageRversion{MSize: 4096, Version: "unknown"},
+		call(NOTAG, MessageTversion{MSize: 4096, Version: "tombstone"}))
+	_, ok := call(3, MessageTstat{Fid: 1}).(MessageRerror)
+	assert.True(ok)
+
+	assert.Equal(MessageRversion{MSize: 8192, Version: Version9P2000},
+		call(NOTAG, MessageTversion{MSize: 8192, Version: Version9P2000}))
+	_, ok = call(4, MessageTstat{Fid: 1}).(MessageRstat)
+	assert.True(ok)
+	h.mu.Lock()
+	assert.Equal(3, h.resets)
+	assert.Equal(8192, h.msize)
+	h.mu.Unlock()
+}